@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	httpinternal "buck_It_Up/internal/http"
+	"buck_It_Up/internal/storage"
+)
+
+// backup writes a backup archive to the file given in args. Blobs that a
+// running server deletes meanwhile cannot be held back from here, so while
+// a server is running, its /backup endpoint is the safer way.
+func backup(r *httpinternal.Router, args []string) {
+	if len(args) != 1 {
+		log.Fatal("usage: buckitup backup <file.tar.gz>")
+	}
+	path := args[0]
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".backup-*")
+	if err != nil {
+		log.Fatalf("backup: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	manifest, err := r.Backup(context.Background(), tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		log.Fatalf("backup: %v", err)
+	}
+	fmt.Printf("backed up the database and %d blobs to %s\n", len(manifest.Blobs), path)
+	if len(manifest.Missing) > 0 {
+		fmt.Printf("%d blobs referenced by the database were missing and are not in the backup\n", len(manifest.Missing))
+	}
+}
+
+// restore unpacks the backup archive given in args into the database at
+// dbPath and the storage below dataRoot, neither of which may hold anything
+// yet.
+func restore(dbPath, dataRoot string, args []string) {
+	if len(args) != 1 {
+		log.Fatal("usage: buckitup restore <file.tar.gz>")
+	}
+	if os.Getenv("BUCKITUP_DB_URL") != "" {
+		log.Fatal("restore: backups only hold SQLite databases; unset BUCKITUP_DB_URL")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	defer f.Close()
+
+	blobs, err := storage.Open(os.Getenv("BUCKITUP_STORAGE"), dataRoot)
+	if err != nil {
+		log.Fatalf("failed to open storage: %v", err)
+	}
+	manifest, err := httpinternal.Restore(context.Background(), f, dbPath, blobs)
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	fmt.Printf("restored the database to %s and %d blobs below %s\n", dbPath, len(manifest.Blobs), dataRoot)
+	if _, err := os.Stat(filepath.Join(dataRoot, "secret.key")); os.Getenv("BUCKITUP_SECRET_KEY") == "" && err != nil {
+		fmt.Println("backups do not hold the server secret key: copy secret.key of the old data directory or set BUCKITUP_SECRET_KEY, or S3 requests signed with the restored access keys fail")
+	}
+	if len(manifest.Missing) > 0 {
+		fmt.Printf("%d blobs were already missing when the backup was taken; fsck lists the objects affected\n", len(manifest.Missing))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	httpinternal "buck_It_Up/internal/http"
+)
+
+// fsck checks every object against its blob and looks for blobs nothing
+// references, printing what it finds. With -repair it marks the objects with
+// a problem corrupt and deletes the orphaned blobs. It exits with status 1 if
+// it found problems it did not repair.
+func fsck(r *httpinternal.Router, args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "mark corrupt objects and delete orphaned blobs")
+	flags.Parse(args)
+
+	report, err := r.Fsck(context.Background(), *repair)
+	if err != nil {
+		log.Fatalf("fsck: %v", err)
+	}
+	for _, p := range report.Problems {
+		version := ""
+		if p.VersionID != "" {
+			version = " version " + p.VersionID
+		}
+		fmt.Printf("object %q%s in bucket %d (blob %s): %s\n", p.ObjectKey, version, p.BucketID, p.BlobKey, p.Problem)
+	}
+	for _, key := range report.Orphans {
+		fmt.Printf("orphaned blob %s\n", key)
+	}
+
+	fmt.Printf("checked %d objects (%d not verifiable): %d with problems, %d orphaned blobs\n",
+		report.Objects, report.Unverified, len(report.Problems), len(report.Orphans))
+	if *repair {
+		fmt.Println("objects with problems are marked corrupt, orphaned blobs deleted")
+	}
+	if !*repair && len(report.Problems)+len(report.Orphans) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,105 @@
+package checksum
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Digests holds the hex encoded digests computed for an object's content.
+type Digests struct {
+	SHA256 string
+	MD5    string
+	CRC32C string
+}
+
+// Hasher computes SHA-256, MD5 and CRC32C in a single pass. It is an
+// io.Writer so it can sit behind an io.MultiWriter or io.TeeReader.
+type Hasher struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+	crc32c hash.Hash32
+}
+
+func NewHasher() *Hasher {
+	return &Hasher{
+		sha256: sha256.New(),
+		md5:    md5.New(),
+		crc32c: crc32.New(castagnoli),
+	}
+}
+
+func (h *Hasher) Write(p []byte) (int, error) {
+	h.sha256.Write(p)
+	h.md5.Write(p)
+	h.crc32c.Write(p)
+	return len(p), nil
+}
+
+func (h *Hasher) Sum() Digests {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, h.crc32c.Sum32())
+	return Digests{
+		SHA256: hex.EncodeToString(h.sha256.Sum(nil)),
+		MD5:    hex.EncodeToString(h.md5.Sum(nil)),
+		CRC32C: hex.EncodeToString(crc),
+	}
+}
+
+// Expected holds digests supplied by a client. Empty fields are not checked.
+type Expected struct {
+	SHA256 string
+	MD5    string
+	CRC32C string
+}
+
+// MismatchError reports which digest did not match the received content.
+type MismatchError struct {
+	Algorithm string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch: %s", e.Algorithm)
+}
+
+// Verify compares d against the expected digests and returns a
+// *MismatchError for the first one that differs.
+func (d Digests) Verify(exp Expected) error {
+	if exp.SHA256 != "" && exp.SHA256 != d.SHA256 {
+		return &MismatchError{Algorithm: "sha256"}
+	}
+	if exp.MD5 != "" && exp.MD5 != d.MD5 {
+		return &MismatchError{Algorithm: "md5"}
+	}
+	if exp.CRC32C != "" && exp.CRC32C != d.CRC32C {
+		return &MismatchError{Algorithm: "crc32c"}
+	}
+	return nil
+}
+
+// Normalize converts a client supplied digest of size bytes, given either
+// as hex or as standard base64, into lower-case hex.
+func Normalize(value string, size int) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	if len(value) == size*2 {
+		if b, err := hex.DecodeString(value); err == nil {
+			return hex.EncodeToString(b), nil
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(b) != size {
+		return "", fmt.Errorf("invalid digest %q", value)
+	}
+	return hex.EncodeToString(b), nil
+}
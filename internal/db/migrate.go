@@ -0,0 +1,332 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The schema is changed by numbered migrations embedded from
+// migrations/<dialect>/, each a pair of files <version>_<name>.up.sql and
+// <version>_<name>.down.sql. Both dialects have the same migrations.
+// schema_migrations records the versions applied to a database. Every
+// migration runs in a transaction of its own, together with its record.
+
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version  int
+	Name     string
+	up, down string
+}
+
+// MigrationStatus is a migration known to the binary or recorded in the
+// database. AppliedAt is zero for pending migrations; Unknown is set for
+// migrations applied by a newer binary.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt int64
+	Unknown   bool
+}
+
+// Migrations returns the embedded migrations of the dialect ordered by
+// version.
+func Migrations(dialect Dialect) ([]*Migration, error) {
+	dir := "migrations/" + string(dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		m := migrationFileName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := migrationFiles.ReadFile(dir + "/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.up = string(data)
+		} else {
+			mig.down = string(data)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		migrations = append(migrations, mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if mig.up == "" || mig.down == "" {
+			return nil, fmt.Errorf("migration %d needs both an up and a down file", mig.Version)
+		}
+	}
+	return migrations, nil
+}
+
+// prepareMigrations creates schema_migrations if it does not exist yet. A
+// database that already has tables then predates it: it is upgraded to the
+// baseline schema the old way and the baseline recorded as applied.
+func prepareMigrations(db *sql.DB) error {
+	exists, err := tableExists(db, "schema_migrations")
+	if err != nil || exists {
+		return err
+	}
+	legacy, err := tableExists(db, "buckets")
+	if err != nil {
+		return err
+	}
+	if legacy && DialectOf(db) != SQLite {
+		return fmt.Errorf("database has tables but no schema_migrations")
+	}
+	if legacy {
+		if err := upgradeLegacySchema(db); err != nil {
+			return fmt.Errorf("upgrade schema of database from before migrations: %w", err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+          version     INTEGER PRIMARY KEY,
+          name        TEXT NOT NULL,
+          applied_at  BIGINT NOT NULL
+        )
+    `); err != nil {
+		return err
+	}
+	if legacy {
+		if _, err := tx.Exec(`
+            INSERT INTO schema_migrations (version, name, applied_at) VALUES (1, 'baseline', ?)
+        `, time.Now().Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func tableExists(db *sql.DB, table string) (bool, error) {
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`
+	if DialectOf(db) == Postgres {
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?`
+	}
+	var n int
+	err := db.QueryRow(query, table).Scan(&n)
+	return n > 0, err
+}
+
+func appliedMigrations(db *sql.DB) (map[int]MigrationStatus, error) {
+	rows, err := db.Query(`SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]MigrationStatus)
+	for rows.Next() {
+		var s MigrationStatus
+		if err := rows.Scan(&s.Version, &s.Name, &s.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[s.Version] = s
+	}
+	return applied, rows.Err()
+}
+
+// migrationLockID is the PostgreSQL advisory lock taken while migrations are
+// inspected or run.
+const migrationLockID = 0x6275636b69747570 // "buckitup"
+
+// withMigrationLock runs fn while holding the migration lock, so instances
+// started together against one PostgreSQL database take turns: the first one
+// migrates and the others find the schema up to date. The lock is held by a
+// connection of its own while fn uses the pool. SQLite has no such lock; its
+// database belongs to a single instance.
+func withMigrationLock(db *sql.DB, fn func() error) error {
+	if DialectOf(db) != Postgres {
+		return fn()
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock(?)`, int64(migrationLockID)); err != nil {
+		return fmt.Errorf("take migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock(?)`, int64(migrationLockID))
+	return fn()
+}
+
+// Status lists the embedded migrations and whether they are applied,
+// followed by the migrations a newer binary applied.
+func Status(db *sql.DB) (statuses []MigrationStatus, err error) {
+	err = withMigrationLock(db, func() error {
+		statuses, err = status(db)
+		return err
+	})
+	return statuses, err
+}
+
+func status(db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := Migrations(DialectOf(db))
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareMigrations(db); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, mig := range migrations {
+		statuses = append(statuses, MigrationStatus{Version: mig.Version, Name: mig.Name, AppliedAt: applied[mig.Version].AppliedAt})
+		delete(applied, mig.Version)
+	}
+	for _, s := range applied {
+		s.Unknown = true
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// checkNotNewer fails if the database has migrations applied that the binary
+// does not know, as it would not understand the schema.
+func checkNotNewer(statuses []MigrationStatus, migrations []*Migration) error {
+	for _, s := range statuses {
+		if s.Unknown {
+			return fmt.Errorf("database schema is at version %d, newer than the %d this binary knows; upgrade buckitup", statuses[len(statuses)-1].Version, len(migrations))
+		}
+	}
+	return nil
+}
+
+// Migrate applies every pending migration in order and returns how many it
+// applied. It refuses to touch a database whose schema is newer than the
+// binary.
+func Migrate(db *sql.DB) (n int, err error) {
+	err = withMigrationLock(db, func() error {
+		n, err = migrate(db)
+		return err
+	})
+	return n, err
+}
+
+func migrate(db *sql.DB) (int, error) {
+	migrations, err := Migrations(DialectOf(db))
+	if err != nil {
+		return 0, err
+	}
+	statuses, err := status(db)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkNotNewer(statuses, migrations); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i, mig := range migrations {
+		if statuses[i].AppliedAt != 0 {
+			continue
+		}
+		if err := runMigration(db, mig.up, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+                INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)
+            `, mig.Version, mig.Name, time.Now().Unix())
+			return err
+		}); err != nil {
+			return n, fmt.Errorf("migration %d %s: %w", mig.Version, mig.Name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Rollback reverts the last steps applied migrations, newest first, and
+// returns how many it reverted.
+func Rollback(db *sql.DB, steps int) (n int, err error) {
+	err = withMigrationLock(db, func() error {
+		n, err = rollback(db, steps)
+		return err
+	})
+	return n, err
+}
+
+func rollback(db *sql.DB, steps int) (int, error) {
+	migrations, err := Migrations(DialectOf(db))
+	if err != nil {
+		return 0, err
+	}
+	statuses, err := status(db)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkNotNewer(statuses, migrations); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := len(migrations) - 1; i >= 0 && n < steps; i-- {
+		mig := migrations[i]
+		if statuses[i].AppliedAt == 0 {
+			continue
+		}
+		if err := runMigration(db, mig.down, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, mig.Version)
+			return err
+		}); err != nil {
+			return n, fmt.Errorf("revert migration %d %s: %w", mig.Version, mig.Name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+func runMigration(db *sql.DB, script string, record func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
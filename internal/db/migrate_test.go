@@ -0,0 +1,193 @@
+package db
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMigrationsMatchAcrossDialects(t *testing.T) {
+	sqlite, err := Migrations(SQLite)
+	if err != nil {
+		t.Fatalf("sqlite migrations: %v", err)
+	}
+	postgres, err := Migrations(Postgres)
+	if err != nil {
+		t.Fatalf("postgres migrations: %v", err)
+	}
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("%d SQLite migrations, %d PostgreSQL migrations", len(sqlite), len(postgres))
+	}
+	for i := range sqlite {
+		if sqlite[i].Name != postgres[i].Name {
+			t.Errorf("migration %d is %s for SQLite and %s for PostgreSQL", sqlite[i].Version, sqlite[i].Name, postgres[i].Name)
+		}
+	}
+}
+
+// schema describes the tables and indexes of a SQLite database other than
+// schema_migrations and SQLite's own.
+func schema(t *testing.T, d *sql.DB) string {
+	t.Helper()
+	rows, err := d.Query(`
+        SELECT sql FROM sqlite_master
+        WHERE sql IS NOT NULL AND name != 'schema_migrations' AND name NOT LIKE 'sqlite%'
+        ORDER BY name
+    `)
+	if err != nil {
+		t.Fatalf("read schema: %v", err)
+	}
+	defer rows.Close()
+	var stmts []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatalf("read schema: %v", err)
+		}
+		stmts = append(stmts, s)
+	}
+	return strings.Join(stmts, ";\n")
+}
+
+func applied(t *testing.T, d *sql.DB) []int {
+	t.Helper()
+	statuses, err := Status(d)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	var versions []int
+	for _, s := range statuses {
+		if s.AppliedAt != 0 {
+			versions = append(versions, s.Version)
+		}
+	}
+	return versions
+}
+
+func TestMigrateAndRollback(t *testing.T) {
+	d := Open(filepath.Join(t.TempDir(), "test.db"))
+	defer d.Close()
+	migrations, err := Migrations(SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := make([]int, len(migrations))
+	for i, mig := range migrations {
+		all[i] = mig.Version
+	}
+
+	statuses, err := Status(d)
+	if err != nil {
+		t.Fatalf("status of a new database: %v", err)
+	}
+	if len(statuses) != len(migrations) || len(applied(t, d)) != 0 {
+		t.Fatalf("status of a new database = %+v, want %d pending migrations", statuses, len(migrations))
+	}
+
+	if n, err := Migrate(d); err != nil || n != len(migrations) {
+		t.Fatalf("migrate = %d, %v; want %d", n, err, len(migrations))
+	}
+	if got := applied(t, d); !slices.Equal(got, all) {
+		t.Errorf("applied after migrating = %v, want %v", got, all)
+	}
+	if n, err := Migrate(d); err != nil || n != 0 {
+		t.Errorf("migrate again = %d, %v; want 0", n, err)
+	}
+	latest := schema(t, d)
+
+	// Roll back one migration at a time, then apply them all again: every
+	// down migration has to undo its up migration exactly.
+	schemas := []string{latest}
+	for i := len(all); i > 0; i-- {
+		if n, err := Rollback(d, 1); err != nil || n != 1 {
+			t.Fatalf("roll back migration %d = %d, %v", i, n, err)
+		}
+		if got := applied(t, d); !slices.Equal(got, all[:i-1]) {
+			t.Fatalf("applied after rolling back migration %d = %v, want %v", i, got, all[:i-1])
+		}
+		schemas = append(schemas, schema(t, d))
+	}
+	if schemas[len(schemas)-1] != "" {
+		t.Errorf("tables left after rolling back every migration:\n%s", schemas[len(schemas)-1])
+	}
+	if n, err := Rollback(d, 1); err != nil || n != 0 {
+		t.Errorf("roll back with nothing applied = %d, %v; want 0", n, err)
+	}
+	if n, err := Migrate(d); err != nil || n != len(migrations) {
+		t.Fatalf("migrate after rolling back = %d, %v; want %d", n, err, len(migrations))
+	}
+	if got := schema(t, d); got != latest {
+		t.Errorf("schema after rolling back and migrating again differs:\n%s\nwant\n%s", got, latest)
+	}
+
+	if n, err := Rollback(d, 2); err != nil || n != 2 {
+		t.Fatalf("roll back two migrations = %d, %v", n, err)
+	}
+	if got := schema(t, d); got != schemas[2] {
+		t.Errorf("schema after rolling back two migrations differs:\n%s\nwant\n%s", got, schemas[2])
+	}
+	if n, err := Migrate(d); err != nil || n != 2 {
+		t.Fatalf("migrate after rolling back two = %d, %v; want 2", n, err)
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	d := Open(filepath.Join(t.TempDir(), "test.db"))
+	defer d.Close()
+	if _, err := Migrate(d); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, err := d.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (999, 'future', 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := Status(d)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if last := statuses[len(statuses)-1]; last.Version != 999 || !last.Unknown {
+		t.Errorf("last status = %+v, want unknown migration 999", last)
+	}
+	if _, err := Migrate(d); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("migrate = %v, want an error about the newer schema", err)
+	}
+	if _, err := Rollback(d, 1); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("roll back = %v, want an error about the newer schema", err)
+	}
+}
+
+// TestMigrateLegacyDatabase migrates a database created before
+// schema_migrations existed, which has the tables but no record of them.
+func TestMigrateLegacyDatabase(t *testing.T) {
+	d := Open(filepath.Join(t.TempDir(), "test.db"))
+	defer d.Close()
+	if _, err := d.Exec(`
+        CREATE TABLE buckets (
+          id          INTEGER PRIMARY KEY AUTOINCREMENT,
+          name        TEXT NOT NULL UNIQUE,
+          created_at  INTEGER NOT NULL
+        )
+    `); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Exec(`INSERT INTO buckets (name, created_at) VALUES ('old', 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := Migrations(SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Migrate(d); err != nil || n != len(migrations)-1 {
+		t.Fatalf("migrate = %d, %v; want every migration but the baseline", n, err)
+	}
+	var name string
+	if err := d.QueryRow(`SELECT name FROM buckets`).Scan(&name); err != nil || name != "old" {
+		t.Errorf("bucket after migrating = %q, %v", name, err)
+	}
+	if n, err := Migrate(d); err != nil || n != 0 {
+		t.Errorf("migrate again = %d, %v; want 0", n, err)
+	}
+}
@@ -0,0 +1,180 @@
+CREATE TABLE IF NOT EXISTS buckets (
+  id               BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  name             TEXT COLLATE "C" NOT NULL UNIQUE,
+  created_at       BIGINT NOT NULL,
+  versioning       BOOLEAN NOT NULL DEFAULT FALSE,
+  max_bytes        BIGINT NOT NULL DEFAULT 0,
+  max_objects      BIGINT NOT NULL DEFAULT 0,
+  max_object_size  BIGINT NOT NULL DEFAULT 0,
+  compression      TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS access_keys (
+  id             BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  bucket_id      BIGINT NOT NULL,
+  key_id         TEXT NOT NULL,
+  secret_hash    TEXT NOT NULL,
+  role           TEXT NOT NULL,
+  created_at     BIGINT NOT NULL,
+  secret_sealed  TEXT,
+  FOREIGN KEY(bucket_id) REFERENCES buckets(id),
+  UNIQUE (key_id)
+);
+
+CREATE TABLE IF NOT EXISTS objects (
+  id               BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  bucket_id        BIGINT NOT NULL,
+  object_key       TEXT COLLATE "C" NOT NULL,
+  file_path        TEXT COLLATE "C" NOT NULL,
+  size             BIGINT NOT NULL,
+  content_type     TEXT,
+  checksum         TEXT,
+  created_at       BIGINT NOT NULL,
+  checksum_sha256  TEXT,
+  checksum_md5     TEXT,
+  checksum_crc32c  TEXT,
+  version_id       TEXT,
+  encoding         TEXT NOT NULL DEFAULT '',
+  encryption       TEXT NOT NULL DEFAULT '',
+  key_id           TEXT NOT NULL DEFAULT '',
+  data_key         TEXT NOT NULL DEFAULT '',
+  corrupt          TEXT NOT NULL DEFAULT '',
+  FOREIGN KEY(bucket_id) REFERENCES buckets(id),
+  UNIQUE(bucket_id, object_key)
+);
+
+CREATE TABLE IF NOT EXISTS multipart_uploads (
+  id            BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  upload_id     TEXT NOT NULL UNIQUE,
+  bucket_id     BIGINT NOT NULL,
+  object_key    TEXT COLLATE "C" NOT NULL,
+  content_type  TEXT,
+  created_at    BIGINT NOT NULL,
+  metadata      TEXT,
+  tags          TEXT,
+  FOREIGN KEY(bucket_id) REFERENCES buckets(id)
+);
+
+CREATE TABLE IF NOT EXISTS upload_parts (
+  upload_id    TEXT NOT NULL,
+  part_number  BIGINT NOT NULL,
+  file_path    TEXT COLLATE "C" NOT NULL,
+  size         BIGINT NOT NULL,
+  etag         TEXT NOT NULL,
+  created_at   BIGINT NOT NULL,
+  PRIMARY KEY (upload_id, part_number),
+  FOREIGN KEY(upload_id) REFERENCES multipart_uploads(upload_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS object_versions (
+  id                BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  bucket_id         BIGINT NOT NULL,
+  object_key        TEXT COLLATE "C" NOT NULL,
+  version_id        TEXT NOT NULL,
+  file_path         TEXT COLLATE "C" NOT NULL,
+  size              BIGINT NOT NULL,
+  content_type      TEXT,
+  checksum          TEXT,
+  checksum_sha256   TEXT,
+  checksum_md5      TEXT,
+  checksum_crc32c   TEXT,
+  is_delete_marker  BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at        BIGINT NOT NULL,
+  encoding          TEXT NOT NULL DEFAULT '',
+  encryption        TEXT NOT NULL DEFAULT '',
+  key_id            TEXT NOT NULL DEFAULT '',
+  data_key          TEXT NOT NULL DEFAULT '',
+  corrupt           TEXT NOT NULL DEFAULT '',
+  FOREIGN KEY(bucket_id) REFERENCES buckets(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_object_versions_key ON object_versions(bucket_id, object_key, version_id);
+
+CREATE TABLE IF NOT EXISTS object_metadata (
+  bucket_id   BIGINT NOT NULL,
+  object_key  TEXT COLLATE "C" NOT NULL,
+  version_id  TEXT NOT NULL,
+  name        TEXT NOT NULL,
+  value       TEXT NOT NULL,
+  PRIMARY KEY (bucket_id, object_key, version_id, name),
+  FOREIGN KEY(bucket_id) REFERENCES buckets(id)
+);
+
+CREATE TABLE IF NOT EXISTS object_tags (
+  bucket_id   BIGINT NOT NULL,
+  object_key  TEXT COLLATE "C" NOT NULL,
+  version_id  TEXT NOT NULL,
+  name        TEXT NOT NULL,
+  value       TEXT NOT NULL,
+  PRIMARY KEY (bucket_id, object_key, version_id, name),
+  FOREIGN KEY(bucket_id) REFERENCES buckets(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_object_tags_tag ON object_tags(bucket_id, name, value);
+
+CREATE TABLE IF NOT EXISTS tus_uploads (
+  id             BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  upload_id      TEXT NOT NULL UNIQUE,
+  bucket_id      BIGINT NOT NULL,
+  object_key     TEXT COLLATE "C" NOT NULL,
+  content_type   TEXT,
+  file_path      TEXT COLLATE "C" NOT NULL,
+  upload_length  BIGINT NOT NULL,
+  upload_offset  BIGINT NOT NULL DEFAULT 0,
+  metadata       TEXT,
+  created_at     BIGINT NOT NULL,
+  expires_at     BIGINT NOT NULL,
+  FOREIGN KEY(bucket_id) REFERENCES buckets(id)
+);
+
+CREATE TABLE IF NOT EXISTS settings (
+  name   TEXT PRIMARY KEY,
+  value  TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+  id          TEXT PRIMARY KEY,
+  bucket_id   BIGINT NOT NULL,
+  kind        TEXT NOT NULL,
+  prefix      TEXT NOT NULL DEFAULT '',
+  status      TEXT NOT NULL,
+  processed   BIGINT NOT NULL DEFAULT 0,
+  error       TEXT NOT NULL DEFAULT '',
+  created_at  BIGINT NOT NULL,
+  updated_at  BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status);
+
+CREATE TABLE IF NOT EXISTS lifecycle_rules (
+  id                            BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  bucket_id                     BIGINT NOT NULL,
+  rule_id                       TEXT NOT NULL,
+  prefix                        TEXT NOT NULL DEFAULT '',
+  enabled                       BOOLEAN NOT NULL DEFAULT TRUE,
+  expiration_days               BIGINT NOT NULL DEFAULT 0,
+  keep_newest                   BIGINT NOT NULL DEFAULT 0,
+  abort_incomplete_upload_days  BIGINT NOT NULL DEFAULT 0,
+  UNIQUE(bucket_id, rule_id),
+  FOREIGN KEY(bucket_id) REFERENCES buckets(id)
+);
+
+CREATE TABLE IF NOT EXISTS blob_refs (
+  blob_key  TEXT COLLATE "C" PRIMARY KEY,
+  size      BIGINT NOT NULL DEFAULT 0,
+  refcount  BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_blob_refs_refcount ON blob_refs(refcount);
+
+CREATE TABLE IF NOT EXISTS lost_objects (
+  id           BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+  bucket_id    BIGINT NOT NULL,
+  object_key   TEXT COLLATE "C" NOT NULL,
+  version_id   TEXT NOT NULL DEFAULT '',
+  file_path    TEXT COLLATE "C" NOT NULL,
+  size         BIGINT NOT NULL,
+  checksum     TEXT NOT NULL,
+  reason       TEXT NOT NULL,
+  detected_at  BIGINT NOT NULL
+);
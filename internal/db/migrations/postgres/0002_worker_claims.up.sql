@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS leases (
+  name        TEXT PRIMARY KEY,
+  owner       TEXT NOT NULL,
+  expires_at  BIGINT NOT NULL
+);
+
+ALTER TABLE jobs ADD COLUMN owner TEXT NOT NULL DEFAULT '';
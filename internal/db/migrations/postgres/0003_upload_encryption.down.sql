@@ -0,0 +1,7 @@
+ALTER TABLE tus_uploads DROP COLUMN data_key;
+ALTER TABLE tus_uploads DROP COLUMN key_id;
+ALTER TABLE tus_uploads DROP COLUMN encryption;
+
+ALTER TABLE multipart_uploads DROP COLUMN data_key;
+ALTER TABLE multipart_uploads DROP COLUMN key_id;
+ALTER TABLE multipart_uploads DROP COLUMN encryption;
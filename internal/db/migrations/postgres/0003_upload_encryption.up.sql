@@ -0,0 +1,7 @@
+ALTER TABLE multipart_uploads ADD COLUMN encryption TEXT NOT NULL DEFAULT '';
+ALTER TABLE multipart_uploads ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE multipart_uploads ADD COLUMN data_key TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE tus_uploads ADD COLUMN encryption TEXT NOT NULL DEFAULT '';
+ALTER TABLE tus_uploads ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE tus_uploads ADD COLUMN data_key TEXT NOT NULL DEFAULT '';
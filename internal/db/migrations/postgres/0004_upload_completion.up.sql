@@ -0,0 +1 @@
+ALTER TABLE multipart_uploads ADD COLUMN completing_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,14 @@
+DROP TABLE IF EXISTS lost_objects;
+DROP TABLE IF EXISTS blob_refs;
+DROP TABLE IF EXISTS lifecycle_rules;
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS settings;
+DROP TABLE IF EXISTS tus_uploads;
+DROP TABLE IF EXISTS object_tags;
+DROP TABLE IF EXISTS object_metadata;
+DROP TABLE IF EXISTS object_versions;
+DROP TABLE IF EXISTS upload_parts;
+DROP TABLE IF EXISTS multipart_uploads;
+DROP TABLE IF EXISTS objects;
+DROP TABLE IF EXISTS access_keys;
+DROP TABLE IF EXISTS buckets;
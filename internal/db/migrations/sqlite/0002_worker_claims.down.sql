@@ -0,0 +1,3 @@
+ALTER TABLE jobs DROP COLUMN owner;
+
+DROP TABLE IF EXISTS leases;
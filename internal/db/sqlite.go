@@ -1,71 +1,69 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"log"
+	"net/url"
+	"runtime"
+	"strings"
 
 	_ "modernc.org/sqlite"
 )
 
+// ErrSnapshotUnsupported is returned by Snapshot for PostgreSQL databases.
+var ErrSnapshotUnsupported = errors.New("snapshots are only supported for SQLite; back up PostgreSQL with pg_dump")
+
+// sqlitePragmas are run on every new connection. In WAL mode readers keep
+// working while a transaction writes, busy_timeout makes a writer wait for
+// the lock instead of failing with "database is locked", and SQLite only
+// enforces foreign keys when asked to.
+var sqlitePragmas = []string{"busy_timeout(5000)", "journal_mode(WAL)", "foreign_keys(1)"}
+
+// Open opens the SQLite database at dbPath. Its schema is brought up to date
+// by Migrate.
 func Open(dbPath string) *sql.DB {
-	db, err := sql.Open("sqlite", dbPath)
+	params := url.Values{"_pragma": sqlitePragmas}
+	// Transactions take the write lock when they begin. A transaction that
+	// only asks for it at its first write fails at once, without waiting,
+	// if another one wrote since it started reading.
+	params.Set("_txlock", "immediate")
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+
+	db, err := sql.Open("sqlite", dbPath+sep+params.Encode())
 	if err != nil {
 		log.Fatalf("failed to open sqlite db: %v", err)
 	}
 
+	// Writers take turns anyway, so more connections than this only add
+	// more of them waiting for the lock. Idle connections are kept, as every
+	// connection prepares the statements of the stores again.
+	conns := max(8, 2*runtime.GOMAXPROCS(0))
+	db.SetMaxOpenConns(conns)
+	db.SetMaxIdleConns(conns)
+
 	if err := db.Ping(); err != nil {
 		log.Fatalf("failed to ping sqlite db: %v", err)
 	}
 
-	if err := migrate(db); err != nil {
-		log.Fatalf("failed to run migrations: %v", err)
-	}
-
 	return db
 }
 
-func migrate(db *sql.DB) error {
-	stmts := []string{
-		`
-        CREATE TABLE IF NOT EXISTS buckets (
-          id          INTEGER PRIMARY KEY AUTOINCREMENT,
-          name        TEXT NOT NULL UNIQUE,
-          created_at  INTEGER NOT NULL
-        );
-        `,
-		`
-        CREATE TABLE IF NOT EXISTS access_keys (
-          id           INTEGER PRIMARY KEY AUTOINCREMENT,
-          bucket_id    INTEGER NOT NULL,
-          key_id       TEXT NOT NULL,
-          secret_hash  TEXT NOT NULL,
-          role         TEXT NOT NULL,
-          created_at   INTEGER NOT NULL,
-          FOREIGN KEY(bucket_id) REFERENCES buckets(id),
-          UNIQUE (key_id)
-        );
-        `,
-		`
-        CREATE TABLE IF NOT EXISTS objects (
-          id            INTEGER PRIMARY KEY AUTOINCREMENT,
-          bucket_id     INTEGER NOT NULL,
-          object_key    TEXT NOT NULL,
-          file_path     TEXT NOT NULL,
-          size          INTEGER NOT NULL,
-          content_type  TEXT,
-          checksum      TEXT,
-          created_at    INTEGER NOT NULL,
-          FOREIGN KEY(bucket_id) REFERENCES buckets(id),
-          UNIQUE(bucket_id, object_key)
-        );
-        `,
-	}
-
-	for _, stmt := range stmts {
-		if _, err := db.Exec(stmt); err != nil {
-			return err
-		}
+// Snapshot writes a consistent copy of the SQLite database d to path, which
+// must not exist yet. Writers carry on while it is taken.
+func Snapshot(ctx context.Context, d *sql.DB, path string) error {
+	if DialectOf(d) != SQLite {
+		return ErrSnapshotUnsupported
 	}
+	_, err := d.ExecContext(ctx, `VACUUM INTO ?`, path)
+	return err
+}
 
-	return nil
+// OpenSnapshot opens a copy written by Snapshot for reading.
+func OpenSnapshot(path string) (*sql.DB, error) {
+	return sql.Open("sqlite", (&url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}).String())
 }
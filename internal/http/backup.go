@@ -0,0 +1,405 @@
+package http
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"buck_It_Up/internal/db"
+	"buck_It_Up/internal/models"
+	"buck_It_Up/internal/storage"
+)
+
+// A backup is a gzipped tar archive holding, in this order, the manifest, a
+// snapshot of the database and every blob the snapshot references below
+// backupBlobDir. Blobs are archived as stored, so encrypted ones need the
+// same master keys after a restore.
+const (
+	backupVersion      = 1
+	backupManifestName = "manifest.json"
+	backupDatabaseName = "buckitup.db"
+	backupBlobDir      = "blobs/"
+)
+
+var (
+	errBackupRunning = errors.New("a backup is already running")
+	backupMu         sync.Mutex
+)
+
+// BackupManifest lists the blobs in a backup with their sizes. Missing lists
+// blobs the database references that were already gone when the backup was
+// taken.
+type BackupManifest struct {
+	Version   int          `json:"version"`
+	CreatedAt int64        `json:"created_at"`
+	Blobs     []BackupBlob `json:"blobs"`
+	Missing   []string     `json:"missing"`
+}
+
+type BackupBlob struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// heldDeletes keeps blobs from being deleted while a backup runs, as the
+// database snapshot it archives may still reference them. Their deletion is
+// queued instead and carried out once the backup is done.
+type heldDeletes struct {
+	mu       sync.Mutex
+	held     bool
+	keys     []string
+	prefixes []string
+}
+
+func (h *heldDeletes) hold() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.held = true
+}
+
+// queue records the blob under key, or every blob below prefix if isPrefix
+// is set, for deletion and reports whether deletions are held.
+func (h *heldDeletes) queue(key string, isPrefix bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.held {
+		return false
+	}
+	if isPrefix {
+		h.prefixes = append(h.prefixes, key)
+	} else {
+		h.keys = append(h.keys, key)
+	}
+	return true
+}
+
+func (h *heldDeletes) release() (keys, prefixes []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys, prefixes = h.keys, h.prefixes
+	h.held, h.keys, h.prefixes = false, nil, nil
+	return keys, prefixes
+}
+
+// runHeldDeletes deletes what was queued during a backup. A content
+// addressed blob may have been referenced again in the meantime, so only
+// blobs that are still unknown are deleted.
+func (r *Router) runHeldDeletes(ctx context.Context) {
+	keys, prefixes := r.deletes.release()
+	for _, prefix := range prefixes {
+		r.removeBlobs(ctx, prefix)
+	}
+	for _, key := range keys {
+		unlock := lockBlob(key)
+		known, err := r.blobRefs.IsKnown(ctx, key)
+		if err != nil {
+			log.Printf("remove blob %s: %v", key, err)
+		} else if !known {
+			r.removeBlob(key)
+		}
+		unlock()
+	}
+}
+
+// Backup writes a backup of the database and the blobs it references to w.
+// Nothing is written before the database snapshot has been taken, so if an
+// error is returned without anything written, w can still be used to report
+// it.
+func (r *Router) Backup(ctx context.Context, w io.Writer) (*BackupManifest, error) {
+	if db.DialectOf(r.db) != db.SQLite {
+		return nil, db.ErrSnapshotUnsupported
+	}
+	if !backupMu.TryLock() {
+		return nil, errBackupRunning
+	}
+	defer backupMu.Unlock()
+
+	r.deletes.hold()
+	defer r.runHeldDeletes(context.Background())
+
+	dir, err := os.MkdirTemp("", "buckitup-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, backupDatabaseName)
+	if err := db.Snapshot(ctx, r.db, snapshot); err != nil {
+		return nil, fmt.Errorf("snapshot database: %w", err)
+	}
+	manifest, err := r.backupManifest(ctx, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarEntry(tw, backupManifestName, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, backupDatabaseName, snapshot); err != nil {
+		return nil, err
+	}
+	for _, b := range manifest.Blobs {
+		if err := r.writeTarBlob(ctx, tw, b); err != nil {
+			return nil, fmt.Errorf("archive blob %s: %w", b.Key, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, gz.Close()
+}
+
+// backupManifest lists the blobs the database snapshot references with
+// their current sizes.
+func (r *Router) backupManifest(ctx context.Context, snapshot string) (*BackupManifest, error) {
+	snap, err := db.OpenSnapshot(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+	keys, prefixes, err := models.NewBlobStore(snap).ListKnown(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list blobs of snapshot: %w", err)
+	}
+
+	manifest := &BackupManifest{Version: backupVersion, CreatedAt: time.Now().Unix(), Blobs: []BackupBlob{}, Missing: []string{}}
+	for _, key := range keys {
+		info, err := r.blobs.Stat(ctx, key)
+		if errors.Is(err, storage.ErrNotExist) || errors.Is(err, storage.ErrInvalidKey) {
+			log.Printf("backup: blob %s is missing", key)
+			manifest.Missing = append(manifest.Missing, key)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest.Blobs = append(manifest.Blobs, BackupBlob{Key: key, Size: info.Size})
+	}
+	for _, prefix := range prefixes {
+		chunks, err := r.blobs.List(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("list blobs: %w", err)
+		}
+		for _, c := range chunks {
+			manifest.Blobs = append(manifest.Blobs, BackupBlob{Key: c.Key, Size: c.Size})
+		}
+	}
+	return manifest, nil
+}
+
+func (r *Router) writeTarBlob(ctx context.Context, tw *tar.Writer, b BackupBlob) error {
+	f, err := r.blobs.Get(ctx, b.Key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeTarEntry(tw, backupBlobDir+b.Key, b.Size, f)
+}
+
+func writeTarFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return writeTarEntry(tw, name, info.Size(), f)
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0o600,
+		Size:    size,
+		ModTime: time.Now(),
+		Format:  tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("%s changed size while it was archived", name)
+	}
+	return err
+}
+
+// Restore unpacks the backup read from archive into a new database at dbPath
+// and into blobs, which must not hold any bucket or content blobs yet. The
+// database only appears at dbPath once every blob of the manifest has been
+// restored and the archive's checksum verified; if restoring fails, the
+// blobs restored so far are removed again.
+func Restore(ctx context.Context, archive io.Reader, dbPath string, blobs storage.Backend) (manifest *BackupManifest, err error) {
+	if _, err := os.Stat(dbPath); err == nil {
+		return nil, fmt.Errorf("database %s already exists", dbPath)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, prefix := range []string{"buckets/", contentBlobPrefix} {
+		existing, err := blobs.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) > 0 {
+			return nil, fmt.Errorf("storage already holds blobs below %s", prefix)
+		}
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, prefix := range []string{"buckets/", contentBlobPrefix} {
+			if err := storage.DeletePrefix(context.WithoutCancel(ctx), blobs, prefix); err != nil {
+				log.Printf("restore: remove blobs %s: %v", prefix, err)
+			}
+		}
+	}()
+
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("read archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupManifestName {
+		return nil, fmt.Errorf("archive does not start with %s", backupManifestName)
+	}
+	manifest = &BackupManifest{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+	pending := make(map[string]int64, len(manifest.Blobs))
+	for _, b := range manifest.Blobs {
+		pending[b.Key] = b.Size
+	}
+
+	tmpPath := dbPath + ".restore"
+	defer os.Remove(tmpPath)
+	restoredDB := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read archive: %w", err)
+		}
+		switch {
+		case hdr.Name == backupDatabaseName:
+			if err := restoreFile(tmpPath, tr); err != nil {
+				return nil, fmt.Errorf("restore database: %w", err)
+			}
+			restoredDB = true
+		case strings.HasPrefix(hdr.Name, backupBlobDir):
+			key := strings.TrimPrefix(hdr.Name, backupBlobDir)
+			size, ok := pending[key]
+			if !ok {
+				return nil, fmt.Errorf("archive holds blob %s that is not in the manifest", key)
+			}
+			n, err := blobs.Put(ctx, key, tr)
+			if err != nil {
+				return nil, fmt.Errorf("restore blob %s: %w", key, err)
+			}
+			if n != size {
+				return nil, fmt.Errorf("blob %s has %d bytes instead of %d", key, n, size)
+			}
+			delete(pending, key)
+		default:
+			return nil, fmt.Errorf("unexpected archive entry %s", hdr.Name)
+		}
+	}
+	// Reading to the end makes gzip verify the checksum of the archive.
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return nil, fmt.Errorf("read archive: %w", err)
+	}
+	if !restoredDB {
+		return nil, fmt.Errorf("archive holds no %s", backupDatabaseName)
+	}
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("archive is missing %d blobs of the manifest", len(pending))
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func restoreFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// backupResponse sends the response headers with the first byte of the
+// archive, so that errors found before can still be answered with a status.
+type backupResponse struct {
+	w       nethttp.ResponseWriter
+	started bool
+}
+
+func (b *backupResponse) Write(p []byte) (int, error) {
+	if !b.started {
+		b.started = true
+		name := "buckitup-" + time.Now().UTC().Format("20060102-150405") + ".tar.gz"
+		b.w.Header().Set("Content-Type", "application/gzip")
+		b.w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	}
+	return b.w.Write(p)
+}
+
+// backupHandler streams a backup archive.
+func (r *Router) backupHandler(w nethttp.ResponseWriter, req *nethttp.Request) {
+	resp := &backupResponse{w: w}
+	manifest, err := r.Backup(req.Context(), resp)
+	if err == nil {
+		log.Printf("backup: archived %d blobs", len(manifest.Blobs))
+		return
+	}
+	log.Printf("backup: %v", err)
+	switch {
+	case resp.started:
+		// The archive is cut short, which its reader notices.
+		panic(nethttp.ErrAbortHandler)
+	case errors.Is(err, errBackupRunning):
+		nethttp.Error(w, err.Error(), nethttp.StatusConflict)
+	case errors.Is(err, db.ErrSnapshotUnsupported):
+		nethttp.Error(w, err.Error(), nethttp.StatusNotImplemented)
+	default:
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+	}
+}
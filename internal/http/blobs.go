@@ -0,0 +1,288 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"buck_It_Up/internal/checksum"
+	"buck_It_Up/internal/models"
+	"buck_It_Up/internal/secret"
+	"buck_It_Up/internal/storage"
+)
+
+// Blob keys mirror the old on-disk layout: everything a bucket stores lives
+// below "buckets/<id>/", objects in "objects/", multipart parts in
+// "multipart/<upload id>/" and tus data in "tus/<upload id>/".
+
+func bucketBlobPrefix(bucketID int64) string {
+	return "buckets/" + strconv.FormatInt(bucketID, 10) + "/"
+}
+
+func objectBlobKey(bucketID int64, name string) string {
+	return bucketBlobPrefix(bucketID) + "objects/" + name
+}
+
+// With deduplication enabled, object content is stored once per distinct
+// content under "sha256/<first two hex digits>/<hex digest>" and shared by
+// every object with that content; blob_refs counts the objects using it.
+const contentBlobPrefix = "sha256/"
+
+func contentBlobKey(sha256Hex string) string {
+	return contentBlobPrefix + sha256Hex[:2] + "/" + sha256Hex
+}
+
+func isContentBlobKey(key string) bool {
+	return strings.HasPrefix(key, contentBlobPrefix)
+}
+
+// dedupEnabled reports whether new object content is stored content
+// addressed. Objects stored before it was enabled keep their own blobs, and
+// content addressed blobs stay shared after it is disabled.
+func dedupEnabled() bool {
+	v, _ := strconv.ParseBool(os.Getenv("BUCKITUP_DEDUP"))
+	return v
+}
+
+// blobLocks serialise adding the first reference to a blob with removing it
+// after its last reference is gone, so a blob is never removed while a new
+// object starts to use it. Where an object key lock is needed as well, it is
+// taken first.
+var blobLocks [64]sync.Mutex
+
+func lockBlob(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &blobLocks[h.Sum32()%uint32(len(blobLocks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// bodyReader remembers the first error returned by the reader it wraps, so a
+// failed Put can tell a broken request body from a failing backend.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// putBlob streams body into the blob under key, compressed with encoding if
+// that is not empty and encrypted with dataKey if that is not nil, and
+// returns the size and digests of body. Errors reading body are wrapped in
+// errBodyRead.
+func (r *Router) putBlob(ctx context.Context, key string, body io.Reader, encoding string, dataKey []byte) (int64, checksum.Digests, error) {
+	hasher := checksum.NewHasher()
+	br := &bodyReader{r: body}
+	content := &countingReader{r: io.TeeReader(br, hasher)}
+	var stored io.Reader = content
+	if encoding == encodingGzip {
+		zr := gzipReader(content)
+		defer zr.Close()
+		stored = zr
+	}
+	if dataKey != nil {
+		var err error
+		if stored, err = secret.EncryptReader(dataKey, stored); err != nil {
+			return 0, checksum.Digests{}, err
+		}
+	}
+	if _, err := r.blobs.Put(ctx, key, stored); err != nil {
+		if br.err != nil {
+			return 0, checksum.Digests{}, fmt.Errorf("%w: %w", errBodyRead, br.err)
+		}
+		return 0, checksum.Digests{}, fmt.Errorf("write blob: %w", err)
+	}
+	return content.n, hasher.Sum(), nil
+}
+
+var (
+	errInvalidStoredPath = errors.New("invalid stored path")
+	errObjectCorrupt     = errors.New("object is marked corrupt")
+)
+
+// checkObjectBlobKey makes sure a stored blob key lies inside the objects of
+// the object's bucket or is content addressed.
+func checkObjectBlobKey(obj *models.Object) error {
+	if !strings.HasPrefix(obj.BlobKey, objectBlobKey(obj.BucketID, "")) && !isContentBlobKey(obj.BlobKey) {
+		return errInvalidStoredPath
+	}
+	return nil
+}
+
+// openObjectBlob opens the content of obj for reading, decrypting and
+// decompressing it as needed. customerKey is the key presented by the
+// request, if any.
+func (r *Router) openObjectBlob(ctx context.Context, obj *models.Object, customerKey []byte) (io.ReadSeekCloser, error) {
+	blob, err := r.openEncodedObjectBlob(ctx, obj, customerKey)
+	if err != nil || obj.Encoding == "" {
+		return blob, err
+	}
+	return newDecodingReader(blob, obj.Size), nil
+}
+
+// openEncodedObjectBlob opens the content of obj in the encoding it is
+// stored with, decrypting it if it is encrypted. Objects fsck marked corrupt
+// are not opened.
+func (r *Router) openEncodedObjectBlob(ctx context.Context, obj *models.Object, customerKey []byte) (io.ReadSeekCloser, error) {
+	if err := checkObjectBlobKey(obj); err != nil {
+		return nil, err
+	}
+	if obj.Corrupt != "" {
+		return nil, fmt.Errorf("%w: %s", errObjectCorrupt, obj.Corrupt)
+	}
+	var dataKey []byte
+	if obj.Encryption != "" {
+		var err error
+		if dataKey, err = r.objectDataKey(obj, customerKey); err != nil {
+			return nil, err
+		}
+	}
+	blob, err := r.blobs.Get(ctx, obj.BlobKey)
+	if err != nil || dataKey == nil {
+		return blob, err
+	}
+	plain, err := secret.DecryptReader(dataKey, blob)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return plain, nil
+}
+
+func writeOpenObjectError(w nethttp.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidStoredPath):
+		nethttp.Error(w, "invalid stored path", nethttp.StatusInternalServerError)
+	case errors.Is(err, storage.ErrNotExist):
+		nethttp.Error(w, "object file missing", nethttp.StatusInternalServerError)
+	case errors.Is(err, errCustomerKeyRequired):
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+	case errors.Is(err, errCustomerKeyMismatch):
+		nethttp.Error(w, err.Error(), nethttp.StatusForbidden)
+	case errors.Is(err, secret.ErrCorrupt), errors.Is(err, errObjectCorrupt):
+		nethttp.Error(w, "object content is corrupt", nethttp.StatusInternalServerError)
+	default:
+		log.Printf("open object: %v", err)
+		nethttp.Error(w, "failed to read object", nethttp.StatusInternalServerError)
+	}
+}
+
+// removeObjectBlob deletes the blob backing obj, whose row has been removed,
+// unless other objects still use it. Failures are only logged.
+func (r *Router) removeObjectBlob(obj *models.Object) {
+	if obj.BlobKey == "" {
+		return
+	}
+	if err := checkObjectBlobKey(obj); err != nil {
+		log.Printf("not removing object blob %s: %v", obj.BlobKey, err)
+		return
+	}
+	r.releaseBlob(context.Background(), obj.BlobKey)
+}
+
+// releaseBlob removes the blob under key if no object references it.
+func (r *Router) releaseBlob(ctx context.Context, key string) {
+	unlock := lockBlob(key)
+	defer unlock()
+	release, err := r.blobRefs.ReleaseBlob(ctx, key)
+	if err != nil {
+		log.Printf("release blob %s: %v", key, err)
+		return
+	}
+	if release {
+		r.removeBlob(key)
+	}
+}
+
+// ensureContentBlob makes sure the content addressed blob under key exists,
+// copying it from the staged blob if it does not. The caller holds the
+// blob's lock.
+func (r *Router) ensureContentBlob(ctx context.Context, key, staged string) error {
+	_, err := r.blobs.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotExist) {
+		err = storage.Copy(ctx, r.blobs, staged, key)
+	}
+	return err
+}
+
+// collectBlobs removes the blobs whose last reference went away without
+// the blob being removed, e.g. because the server stopped in between or
+// because their bucket was deleted.
+func (r *Router) collectBlobs(ctx context.Context) {
+	bStore := r.blobRefs
+	after := ""
+	for {
+		keys, err := bStore.ListUnreferenced(ctx, after, maxListKeys)
+		if err != nil {
+			log.Printf("list unreferenced blobs: %v", err)
+			return
+		}
+		for _, key := range keys {
+			r.releaseBlob(ctx, key)
+		}
+		if len(keys) < maxListKeys || ctx.Err() != nil {
+			return
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// removeBlob deletes a blob that is no longer needed. Failures are only
+// logged.
+func (r *Router) removeBlob(key string) {
+	if r.deletes.queue(key, false) {
+		return
+	}
+	if err := r.blobs.Delete(context.Background(), key); err != nil {
+		log.Printf("remove blob %s: %v", key, err)
+	}
+}
+
+// removeBlobs deletes every blob below prefix, such as the blobs of a deleted
+// bucket or an aborted upload. Failures are only logged.
+func (r *Router) removeBlobs(ctx context.Context, prefix string) {
+	if r.deletes.queue(prefix, true) {
+		return
+	}
+	if err := storage.DeletePrefix(ctx, r.blobs, prefix); err != nil {
+		log.Printf("remove blobs %s: %v", prefix, err)
+	}
+}
+
+const blobKeysSetting = "blob_keys_migrated"
+
+// MigrateBlobKeys rewrites the file paths recorded before content was kept
+// in a storage backend into blob keys. root is the data directory the paths
+// were created in. It only does work the first time it runs.
+func (r *Router) MigrateBlobKeys(ctx context.Context, root string) error {
+	settings := r.settings
+	if _, err := settings.GetSetting(ctx, blobKeysSetting); err != sql.ErrNoRows {
+		return err
+	}
+	stale, err := r.objects.MigrateFilePaths(ctx, filepath.ToSlash(filepath.Clean(root))+"/")
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		log.Printf("dropping unfinished tus upload %s from before the storage backend", key)
+		r.removeBlob(key)
+	}
+	return settings.SetSetting(ctx, blobKeysSetting, "1")
+}
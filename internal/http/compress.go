@@ -0,0 +1,178 @@
+package http
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+
+	"buck_It_Up/internal/models"
+)
+
+// Buckets with compression enabled store objects whose content type is
+// compressible gzip encoded. Size and the checksums of such objects describe
+// the uncompressed content, and reads decompress on the fly unless the
+// client accepts the stored encoding as it is.
+
+const encodingGzip = "gzip"
+
+// compressibleType reports whether content of the given type is text-like
+// and therefore worth compressing.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/xml", "application/javascript",
+		"application/x-javascript", "application/yaml", "application/x-yaml", "application/toml",
+		"application/sql", "application/graphql", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// storageEncoding returns the encoding a new object of the given content
+// type is stored with in bucket.
+func storageEncoding(bucket *models.Bucket, contentType string) string {
+	if bucket.Compression != "" && compressibleType(contentType) {
+		return bucket.Compression
+	}
+	return ""
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// gzipReader returns a reader of the content of r gzip compressed. Closing
+// it stops the compression early.
+func gzipReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// decodingReader decompresses a gzip encoded blob of size uncompressed
+// bytes. Seeking is cheap until the next read; a read after seeking back
+// starts decompressing from the beginning again, one after seeking forward
+// skips ahead. That is enough for ServeContent, which seeks at most once per
+// range.
+type decodingReader struct {
+	blob io.ReadSeekCloser
+	size int64
+	zr   *gzip.Reader
+	// pos is the position reads continue from and at is the position zr is
+	// at.
+	pos, at int64
+}
+
+func newDecodingReader(blob io.ReadSeekCloser, size int64) *decodingReader {
+	return &decodingReader{blob: blob, size: size}
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	if d.zr == nil || d.pos < d.at {
+		if err := d.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	if d.pos > d.at {
+		n, err := io.CopyN(io.Discard, d.zr, d.pos-d.at)
+		d.at += n
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+	}
+	n, err := d.zr.Read(p)
+	d.pos += int64(n)
+	d.at = d.pos
+	if err == io.EOF && d.pos < d.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (d *decodingReader) rewind() error {
+	if _, err := d.blob.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if d.zr == nil {
+		zr, err := gzip.NewReader(d.blob)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		d.zr = zr
+	} else if err := d.zr.Reset(d.blob); err != nil {
+		return unexpectedEOF(err)
+	}
+	d.at = 0
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *decodingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of object")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decodingReader) Close() error {
+	return d.blob.Close()
+}
+
+// acceptsEncoding reports whether the request's Accept-Encoding allows a
+// response with the given content coding.
+func acceptsEncoding(req *nethttp.Request, encoding string) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), encoding) {
+			continue
+		}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(v, 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,367 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	nethttp "net/http"
+	"strings"
+	"time"
+
+	"buck_It_Up/internal/models"
+	"buck_It_Up/internal/storage"
+)
+
+// Copies and moves never read the object through the server: the new object
+// shares the source blob if it is content addressed and otherwise gets a copy
+// made by the storage backend (a hard link with local storage). Its row is
+// written in a single transaction, together with the removal of the source
+// for moves.
+
+func validObjectKey(key string) bool {
+	return key != "" && !strings.Contains(key, "\x00")
+}
+
+// reservedKeyPrefixes are the first path segments the native API routes to
+// sub-resources of a bucket. PUT and DELETE /{bucketName}/{objectKey} cannot
+// reach keys below them, so the native API refuses to create such objects;
+// the S3 API has no such restriction.
+var reservedKeyPrefixes = []string{"tags/", "multipart/", "tus/"}
+
+// errReservedKey is returned for object keys under a reserved prefix.
+var errReservedKey = errors.New("object keys starting with tags/, multipart/ or tus/ are reserved")
+
+// checkNativeObjectKey validates a key written through the native API.
+func checkNativeObjectKey(key string) error {
+	if !validObjectKey(key) {
+		return errors.New("invalid object key")
+	}
+	for _, p := range reservedKeyPrefixes {
+		if strings.HasPrefix(key, p) {
+			return errReservedKey
+		}
+	}
+	return nil
+}
+
+// sourceBucket resolves the bucket named in the body of a copy or move
+// request, defaulting to the bucket of the path. Access keys belong to a
+// single bucket, so only the admin may use another bucket as the source.
+func (r *Router) sourceBucket(w nethttp.ResponseWriter, req *nethttp.Request, name string, dst *models.Bucket) (*models.Bucket, bool) {
+	if name == "" || name == dst.Name {
+		return dst, true
+	}
+	authCtx, _ := GetAuthContext(req.Context())
+	if authCtx == nil || authCtx.BucketID != 0 {
+		nethttp.Error(w, "access denied to source bucket", nethttp.StatusForbidden)
+		return nil, false
+	}
+	bucket, err := r.buckets.GetBucketByName(req.Context(), name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			nethttp.Error(w, "source bucket not found", nethttp.StatusNotFound)
+			return nil, false
+		}
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return nil, false
+	}
+	return bucket, true
+}
+
+// copyObjectBlob gives dst a blob of its own with the content of src.
+func (r *Router) copyObjectBlob(ctx context.Context, src *models.Object, dst *models.Bucket) (string, error) {
+	name, err := newObjectFileName()
+	if err != nil {
+		return "", err
+	}
+	key := objectBlobKey(dst.ID, name)
+	if err := storage.Copy(ctx, r.blobs, src.BlobKey, key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// transferObject copies the given version of srcKey (the current object if
+// versionID is empty) to dstKey in dst, along with its content type,
+// metadata and tags. With move set the source is removed in the same
+// transaction, leaving a delete marker if its bucket keeps versions; only
+// current objects can be moved. A missing source yields sql.ErrNoRows and an
+// unmet cond errPreconditionFailed.
+func (r *Router) transferObject(ctx context.Context, srcBucket *models.Bucket, srcKey, versionID string, dst *models.Bucket, dstKey string, cond writeCondition, move bool) (*models.Object, error) {
+	oStore := r.objects
+	markerID := models.NullVersionID
+	if move && srcBucket.Versioning {
+		var err error
+		if markerID, err = newVersionID(); err != nil {
+			return nil, err
+		}
+	}
+
+	unlock := lockObjectKeyPair(srcBucket.ID, srcKey, dst.ID, dstKey)
+	defer unlock()
+
+	src, err := r.getObjectVersion(ctx, srcBucket.ID, srcKey, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := oStore.LoadAttributes(ctx, src); err != nil {
+		return nil, err
+	}
+	if err := checkObjectBlobKey(src); err != nil {
+		return nil, err
+	}
+	// Content addressed blobs are shared by the copy; others are copied.
+	blobKey := src.BlobKey
+	shared := isContentBlobKey(blobKey)
+	unlockBlob := func() {}
+	if shared {
+		unlockBlob = lockBlob(blobKey)
+		_, err = r.blobs.Stat(ctx, blobKey)
+	} else {
+		blobKey, err = r.copyObjectBlob(ctx, src, dst)
+	}
+	discard := func() {
+		unlockBlob()
+		if !shared {
+			r.removeBlob(blobKey)
+		}
+	}
+	if err != nil {
+		discard()
+		if errors.Is(err, storage.ErrNotExist) {
+			return nil, sql.ErrNoRows
+		}
+		return nil, err
+	}
+
+	obj := *src
+	obj.ID = 0
+	obj.BucketID = dst.ID
+	obj.ObjectKey = dstKey
+	obj.BlobKey = blobKey
+	obj.VersionID = ""
+	obj.IsLatest = false
+	obj.CreatedAt = time.Now().Unix()
+	if dst.Versioning {
+		if obj.VersionID, err = newVersionID(); err != nil {
+			discard()
+			return nil, err
+		}
+	}
+
+	var replaced, removed *models.Object
+	if move {
+		replaced, removed, err = oStore.MoveObject(ctx, &obj, cond.check, src, markerID)
+	} else {
+		replaced, err = oStore.ReplaceObject(ctx, &obj, cond.check)
+	}
+	if err != nil {
+		discard()
+		return nil, err
+	}
+	unlockBlob()
+	if replaced != nil {
+		r.removeObjectBlob(replaced)
+	}
+	if removed != nil {
+		r.removeObjectBlob(removed)
+	}
+	return &obj, nil
+}
+
+func writeTransferError(w nethttp.ResponseWriter, err error) {
+	msg, status := transferErrorStatus(err)
+	nethttp.Error(w, msg, status)
+}
+
+// transferErrorStatus maps an error of transferObject to a message and an
+// HTTP status, logging errors that are not the client's fault.
+func transferErrorStatus(err error) (string, int) {
+	switch {
+	case err == sql.ErrNoRows:
+		return "source object not found", nethttp.StatusNotFound
+	case errors.Is(err, errPreconditionFailed):
+		return "precondition failed", nethttp.StatusPreconditionFailed
+	case errors.Is(err, errInvalidStoredPath):
+		return "invalid stored path", nethttp.StatusInternalServerError
+	case errors.Is(err, models.ErrObjectTooLarge):
+		return err.Error(), nethttp.StatusRequestEntityTooLarge
+	case errors.Is(err, models.ErrQuotaExceeded):
+		return err.Error(), nethttp.StatusInsufficientStorage
+	default:
+		log.Printf("transfer object: %v", err)
+		return "failed to copy object", nethttp.StatusInternalServerError
+	}
+}
+
+func writeTransferredObject(w nethttp.ResponseWriter, obj *models.Object) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+obj.Checksum+`"`)
+	if obj.VersionID != "" {
+		w.Header().Set("X-Version-Id", obj.VersionID)
+	}
+	w.WriteHeader(nethttp.StatusCreated)
+	_ = json.NewEncoder(w).Encode(obj)
+}
+
+// copyObjectHandler copies an object into the bucket of the path.
+func (r *Router) copyObjectHandler(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	var body struct {
+		SourceBucket   string `json:"source_bucket"`
+		SourceKey      string `json:"source_key"`
+		VersionID      string `json:"version_id"`
+		DestinationKey string `json:"destination_key"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		nethttp.Error(w, "invalid json", nethttp.StatusBadRequest)
+		return
+	}
+	srcKey := strings.TrimSpace(body.SourceKey)
+	dstKey := strings.TrimSpace(body.DestinationKey)
+	if !validObjectKey(srcKey) {
+		nethttp.Error(w, "invalid object key", nethttp.StatusBadRequest)
+		return
+	}
+	if err := checkNativeObjectKey(dstKey); err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+	srcBucket, ok := r.sourceBucket(w, req, body.SourceBucket, bucket)
+	if !ok {
+		return
+	}
+
+	obj, err := r.transferObject(req.Context(), srcBucket, srcKey, body.VersionID, bucket, dstKey, writeConditionFromRequest(req), false)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	writeTransferredObject(w, obj)
+}
+
+// moveObjectHandler renames an object, or with source_prefix every object
+// under a prefix, into the bucket of the path. Each object of a prefix is
+// moved in its own transaction; if one fails, the objects moved before it
+// stay moved.
+func (r *Router) moveObjectHandler(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	var body struct {
+		SourceBucket      string `json:"source_bucket"`
+		SourceKey         string `json:"source_key"`
+		DestinationKey    string `json:"destination_key"`
+		SourcePrefix      string `json:"source_prefix"`
+		DestinationPrefix string `json:"destination_prefix"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		nethttp.Error(w, "invalid json", nethttp.StatusBadRequest)
+		return
+	}
+	srcBucket, ok := r.sourceBucket(w, req, body.SourceBucket, bucket)
+	if !ok {
+		return
+	}
+	if body.SourcePrefix != "" || body.DestinationPrefix != "" {
+		r.movePrefix(w, req, srcBucket, body.SourcePrefix, bucket, body.DestinationPrefix)
+		return
+	}
+
+	srcKey := strings.TrimSpace(body.SourceKey)
+	dstKey := strings.TrimSpace(body.DestinationKey)
+	if !validObjectKey(srcKey) {
+		nethttp.Error(w, "invalid object key", nethttp.StatusBadRequest)
+		return
+	}
+	if err := checkNativeObjectKey(dstKey); err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+	if srcBucket.ID == bucket.ID && srcKey == dstKey {
+		nethttp.Error(w, "source and destination are the same", nethttp.StatusBadRequest)
+		return
+	}
+
+	obj, err := r.transferObject(req.Context(), srcBucket, srcKey, "", bucket, dstKey, writeConditionFromRequest(req), true)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	writeTransferredObject(w, obj)
+}
+
+func (r *Router) movePrefix(w nethttp.ResponseWriter, req *nethttp.Request, srcBucket *models.Bucket, srcPrefix string, dst *models.Bucket, dstPrefix string) {
+	if srcPrefix == "" || strings.Contains(srcPrefix, "\x00") || strings.Contains(dstPrefix, "\x00") {
+		nethttp.Error(w, "invalid prefix", nethttp.StatusBadRequest)
+		return
+	}
+	if srcBucket.ID == dst.ID && srcPrefix == dstPrefix {
+		nethttp.Error(w, "source and destination are the same", nethttp.StatusBadRequest)
+		return
+	}
+
+	// Collect the keys first so objects moved to a destination below the
+	// source prefix are not picked up again.
+	ctx := req.Context()
+	oStore := r.objects
+	var keys []string
+	opts := models.ListObjectsOptions{Prefix: srcPrefix, MaxKeys: maxListKeys}
+	for {
+		page, err := oStore.ListObjectsPage(ctx, srcBucket.ID, opts)
+		if err != nil {
+			nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+			return
+		}
+		for _, obj := range page.Objects {
+			keys = append(keys, obj.ObjectKey)
+		}
+		if !page.IsTruncated {
+			break
+		}
+		opts.StartAfter = page.Next
+	}
+	if len(keys) == 0 {
+		nethttp.NotFound(w, req)
+		return
+	}
+
+	for _, key := range keys {
+		if err := checkNativeObjectKey(dstPrefix + strings.TrimPrefix(key, srcPrefix)); err == errReservedKey {
+			nethttp.Error(w, fmt.Sprintf("destination key for %s: %v", key, err), nethttp.StatusBadRequest)
+			return
+		}
+	}
+
+	moved := 0
+	for _, key := range keys {
+		dstKey := dstPrefix + strings.TrimPrefix(key, srcPrefix)
+		if strings.TrimSpace(dstKey) == "" {
+			nethttp.Error(w, "invalid destination key for "+key, nethttp.StatusBadRequest)
+			return
+		}
+		if _, err := r.transferObject(ctx, srcBucket, key, "", dst, dstKey, writeCondition{}, true); err != nil {
+			if err == sql.ErrNoRows {
+				// Deleted or moved concurrently; nothing left to move.
+				continue
+			}
+			msg, status := transferErrorStatus(err)
+			nethttp.Error(w, fmt.Sprintf("failed to move %s after moving %d objects: %s", key, moved, msg), status)
+			return
+		}
+		moved++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusOK)
+	_ = json.NewEncoder(w).Encode(struct {
+		Moved int `json:"moved"`
+	}{moved})
+}
@@ -0,0 +1,287 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	nethttp "net/http"
+	"strconv"
+	"time"
+
+	"buck_It_Up/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxBatchDeleteKeys = 1000
+	// deleteJobChunk is the number of objects a delete job removes per
+	// transaction.
+	deleteJobChunk = 100
+)
+
+var (
+	errUnknownJobKind = errors.New("unknown job kind")
+	errBucketGone     = errors.New("bucket no longer exists")
+)
+
+type deleteTarget struct {
+	Key       string `json:"key"`
+	VersionID string `json:"version_id,omitempty"`
+}
+
+type deleteResult struct {
+	Key                   string `json:"key"`
+	VersionID             string `json:"version_id,omitempty"`
+	Deleted               bool   `json:"deleted"`
+	DeleteMarkerVersionID string `json:"delete_marker_version_id,omitempty"`
+	Error                 string `json:"error,omitempty"`
+
+	err error
+}
+
+// deleteObjects deletes each target like DELETE /{bucketName}/{key} would
+// and reports the outcome per key. A failed key does not stop the others.
+func (r *Router) deleteObjects(ctx context.Context, bucket *models.Bucket, targets []deleteTarget) []deleteResult {
+	results := make([]deleteResult, 0, len(targets))
+	for _, t := range targets {
+		res := deleteResult{Key: t.Key, VersionID: t.VersionID}
+		if !validObjectKey(t.Key) {
+			res.Error = "invalid object key"
+			results = append(results, res)
+			continue
+		}
+		res.DeleteMarkerVersionID, res.err = r.deleteObjectVersion(ctx, bucket, t.Key, t.VersionID)
+		switch {
+		case res.err == nil:
+			res.Deleted = true
+		case res.err == sql.ErrNoRows:
+			res.Error = "not found"
+		default:
+			log.Printf("delete object %q: %v", t.Key, res.err)
+			res.Error = "failed to delete object"
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// batchDeleteObjects deletes up to maxBatchDeleteKeys objects in one request.
+func (r *Router) batchDeleteObjects(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	var body struct {
+		Objects []deleteTarget `json:"objects"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		nethttp.Error(w, "invalid json", nethttp.StatusBadRequest)
+		return
+	}
+	if len(body.Objects) == 0 {
+		nethttp.Error(w, "no objects given", nethttp.StatusBadRequest)
+		return
+	}
+	if len(body.Objects) > maxBatchDeleteKeys {
+		nethttp.Error(w, "at most "+strconv.Itoa(maxBatchDeleteKeys)+" objects per request", nethttp.StatusBadRequest)
+		return
+	}
+
+	results := r.deleteObjects(req.Context(), bucket, body.Objects)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusOK)
+	_ = json.NewEncoder(w).Encode(struct {
+		Results []deleteResult `json:"results"`
+	}{results})
+}
+
+// deletePrefixHandler starts a background job that deletes every object
+// whose key starts with the given prefix; an empty prefix empties the bucket.
+func (r *Router) deletePrefixHandler(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	var body struct {
+		Prefix *string `json:"prefix"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		nethttp.Error(w, "invalid json", nethttp.StatusBadRequest)
+		return
+	}
+	if body.Prefix == nil {
+		nethttp.Error(w, "prefix is required", nethttp.StatusBadRequest)
+		return
+	}
+
+	id, err := newObjectFileName()
+	if err != nil {
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Unix()
+	job := &models.Job{
+		ID:        id,
+		BucketID:  bucket.ID,
+		Kind:      models.JobDeletePrefix,
+		Prefix:    *body.Prefix,
+		Status:    models.JobRunning,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Owner:     r.instanceID,
+	}
+	if err := r.jobs.CreateJob(req.Context(), job); err != nil {
+		log.Printf("create job: %v", err)
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	go r.runJob(context.Background(), job)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/"+bucket.Name+"/jobs/"+job.ID)
+	w.WriteHeader(nethttp.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+func (r *Router) getJob(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	job, err := r.jobs.GetJob(req.Context(), bucket.ID, chi.URLParam(req, "jobID"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			nethttp.NotFound(w, req)
+			return
+		}
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusOK)
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// ResumeJobs restarts the running jobs that no instance is working on: jobs
+// this instance ran before it was restarted, and jobs whose instance has
+// not recorded progress for jobStaleAfter. Jobs are idempotent, so they
+// simply start over.
+func (r *Router) ResumeJobs(ctx context.Context) {
+	jobs, err := r.jobs.ListRunningJobs(ctx)
+	if err != nil {
+		log.Printf("list running jobs: %v", err)
+		return
+	}
+	staleBefore := time.Now().Add(-jobStaleAfter).Unix()
+	for _, job := range jobs {
+		if _, running := r.runningJobs.Load(job.ID); running {
+			continue
+		}
+		claimed, err := r.jobs.ClaimJob(ctx, job, r.instanceID, staleBefore)
+		if err != nil {
+			log.Printf("claim job %s: %v", job.ID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		log.Printf("resuming job %s (%s)", job.ID, job.Kind)
+		go r.runJob(ctx, job)
+	}
+}
+
+func (r *Router) runJob(ctx context.Context, job *models.Job) {
+	if _, running := r.runningJobs.LoadOrStore(job.ID, true); running {
+		return
+	}
+	defer r.runningJobs.Delete(job.ID)
+
+	var err error
+	switch job.Kind {
+	case models.JobDeletePrefix:
+		err = r.runDeletePrefixJob(ctx, job)
+	default:
+		err = errUnknownJobKind
+	}
+	if errors.Is(err, models.ErrJobLost) {
+		log.Printf("job %s was taken over by another instance after %d objects", job.ID, job.Processed)
+		return
+	}
+
+	status, errMsg := models.JobSucceeded, ""
+	if err != nil {
+		log.Printf("job %s failed after %d objects: %v", job.ID, job.Processed, err)
+		status, errMsg = models.JobFailed, err.Error()
+	}
+	if err := r.jobs.FinishJob(ctx, job, status, errMsg); err != nil {
+		log.Printf("finish job %s: %v", job.ID, err)
+	}
+}
+
+func (r *Router) runDeletePrefixJob(ctx context.Context, job *models.Job) error {
+	bucket, err := r.buckets.GetBucketByID(ctx, job.BucketID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errBucketGone
+		}
+		return err
+	}
+
+	oStore := r.objects
+	jStore := r.jobs
+	opts := models.ListObjectsOptions{Prefix: job.Prefix, MaxKeys: maxListKeys}
+	for {
+		page, err := oStore.ListObjectsPage(ctx, bucket.ID, opts)
+		if err != nil {
+			return err
+		}
+		// Objects deleted or overwritten since they were listed are not
+		// counted.
+		n, err := r.removeObjects(ctx, bucket, page.Objects)
+		job.Processed += int64(n)
+		if err != nil {
+			return err
+		}
+		if err := jStore.UpdateProgress(ctx, job); err != nil {
+			return err
+		}
+		if !page.IsTruncated {
+			return nil
+		}
+		opts.StartAfter = page.Next
+	}
+}
+
+// removeObjects deletes objs from the bucket like DELETE without a version ID
+// would, deleteJobChunk objects per transaction. Objects that were deleted or
+// overwritten since they were listed are left alone. It returns the number
+// of objects deleted.
+func (r *Router) removeObjects(ctx context.Context, bucket *models.Bucket, objs []*models.Object) (int, error) {
+	oStore := r.objects
+	deleted := 0
+	for start := 0; start < len(objs); start += deleteJobChunk {
+		chunk := objs[start:min(start+deleteJobChunk, len(objs))]
+		markerIDs := make([]string, len(chunk))
+		for i := range chunk {
+			markerIDs[i] = models.NullVersionID
+			if bucket.Versioning {
+				var err error
+				if markerIDs[i], err = newVersionID(); err != nil {
+					return deleted, err
+				}
+			}
+		}
+		n, removed, err := oStore.RemoveCurrentObjects(ctx, chunk, markerIDs)
+		if err != nil {
+			return deleted, err
+		}
+		for _, obj := range removed {
+			r.removeObjectBlob(obj)
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
@@ -0,0 +1,196 @@
+package http
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+
+	"buck_It_Up/internal/models"
+	"buck_It_Up/internal/secret"
+)
+
+// With a master key configured every new object is encrypted at rest with a
+// data key of its own, which is stored in the object's row wrapped by the
+// master key. Uploads may instead bring a key of their own (SSE-C); the data
+// key is then wrapped by that key, which is not stored, and reads have to
+// present it again. The parts of unfinished multipart uploads and the data
+// of unfinished tus uploads are encrypted under a data key of the upload,
+// wrapped by the master key, until they are turned into an object.
+
+const (
+	sseCustomerHeaderPrefix   = "X-Server-Side-Encryption-Customer-"
+	s3SSECustomerHeaderPrefix = "X-Amz-Server-Side-Encryption-Customer-"
+)
+
+var (
+	errInvalidCustomerKey  = errors.New("invalid customer key")
+	errCustomerKeyRequired = errors.New("object is encrypted with a customer key")
+	errCustomerKeyMismatch = errors.New("customer key does not match")
+	// Customer keys are not kept, so an upload in several requests could
+	// not be completed without asking for the key again.
+	errCustomerKeyUnsupported = errors.New("customer keys are not supported for multipart and tus uploads")
+)
+
+// customerKeyFromHeaders reads a customer provided key from the
+// <prefix>Algorithm, <prefix>Key and <prefix>Key-MD5 headers. It returns nil
+// if the request does not carry one.
+func customerKeyFromHeaders(h nethttp.Header, prefix string) ([]byte, error) {
+	algorithm, encoded := h.Get(prefix+"Algorithm"), h.Get(prefix+"Key")
+	if algorithm == "" && encoded == "" {
+		return nil, nil
+	}
+	if algorithm != "AES256" {
+		return nil, errInvalidCustomerKey
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errInvalidCustomerKey
+	}
+	if sum := h.Get(prefix + "Key-MD5"); sum != "" && sum != customerKeyMD5(key) {
+		return nil, errInvalidCustomerKey
+	}
+	return key, nil
+}
+
+// hasCustomerKeyHeaders reports whether h carries any of the headers
+// customerKeyFromHeaders reads.
+func hasCustomerKeyHeaders(h nethttp.Header, prefix string) bool {
+	for _, name := range []string{"Algorithm", "Key", "Key-MD5"} {
+		if h.Get(prefix+name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectCustomerKey answers 400 to a request of a multipart or tus upload
+// that brings a customer key, rather than storing its data without it. It
+// reports whether it did.
+func rejectCustomerKey(w nethttp.ResponseWriter, req *nethttp.Request) bool {
+	if !hasCustomerKeyHeaders(req.Header, sseCustomerHeaderPrefix) {
+		return false
+	}
+	nethttp.Error(w, errCustomerKeyUnsupported.Error(), nethttp.StatusBadRequest)
+	return true
+}
+
+// s3RejectCustomerKey is rejectCustomerKey for the S3 multipart operations.
+func s3RejectCustomerKey(w nethttp.ResponseWriter, req *nethttp.Request) bool {
+	if !hasCustomerKeyHeaders(req.Header, s3SSECustomerHeaderPrefix) {
+		return false
+	}
+	writeS3Error(w, req, s3ErrInvalidArgument.withMessage("Customer keys are not supported for multipart uploads"))
+	return true
+}
+
+func customerKeyMD5(key []byte) string {
+	sum := md5.Sum(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// dataKey is the key a new object is encrypted with, together with the
+// values of the object's encryption columns.
+type dataKey struct {
+	key                        []byte
+	encryption, keyID, wrapped string
+}
+
+// newDataKey returns the key to encrypt a new object with: one wrapped by
+// customerKey if that is given and otherwise one wrapped by the master key.
+// It returns nil if the object is to be stored unencrypted.
+func (r *Router) newDataKey(customerKey []byte) (*dataKey, error) {
+	if customerKey == nil && r.keys == nil {
+		return nil, nil
+	}
+	key, err := secret.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	dk := &dataKey{key: key}
+	if customerKey != nil {
+		dk.encryption, dk.keyID = models.EncryptionCustomer, customerKeyMD5(customerKey)
+		dk.wrapped, err = secret.Seal(customerKey, key)
+	} else {
+		dk.encryption = models.EncryptionMaster
+		dk.keyID, dk.wrapped, err = r.keys.Wrap(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dk, nil
+}
+
+// objectDataKey unwraps the data key of an encrypted object. customerKey is
+// the key presented by the request, if any.
+func (r *Router) objectDataKey(obj *models.Object, customerKey []byte) ([]byte, error) {
+	switch obj.Encryption {
+	case models.EncryptionMaster:
+		if r.keys == nil {
+			return nil, fmt.Errorf("%w %s", secret.ErrUnknownMasterKey, obj.KeyID)
+		}
+		return r.keys.Unwrap(obj.KeyID, obj.DataKey)
+	case models.EncryptionCustomer:
+		if customerKey == nil {
+			return nil, errCustomerKeyRequired
+		}
+		if customerKeyMD5(customerKey) != obj.KeyID {
+			return nil, errCustomerKeyMismatch
+		}
+		return secret.Open(customerKey, obj.DataKey)
+	}
+	return nil, fmt.Errorf("unknown encryption %q", obj.Encryption)
+}
+
+// stagingDataKey unwraps the data key the staged data of an unfinished
+// upload is encrypted with, given the upload's encryption columns. It returns
+// nil if the data is stored unencrypted.
+func (r *Router) stagingDataKey(encryption, keyID, wrapped string) ([]byte, error) {
+	switch encryption {
+	case "":
+		return nil, nil
+	case models.EncryptionMaster:
+		if r.keys == nil {
+			return nil, fmt.Errorf("%w %s", secret.ErrUnknownMasterKey, keyID)
+		}
+		return r.keys.Unwrap(keyID, wrapped)
+	}
+	return nil, fmt.Errorf("unknown encryption %q", encryption)
+}
+
+// setS3EncryptionHeaders reports how obj is encrypted in an S3 response.
+func setS3EncryptionHeaders(h nethttp.Header, obj *models.Object) {
+	switch obj.Encryption {
+	case models.EncryptionMaster:
+		h.Set("x-amz-server-side-encryption", "AES256")
+	case models.EncryptionCustomer:
+		h.Set(s3SSECustomerHeaderPrefix+"Algorithm", "AES256")
+		h.Set(s3SSECustomerHeaderPrefix+"Key-MD5", obj.KeyID)
+	}
+}
+
+// s3CheckServerSideEncryption checks the encryption a PutObject or
+// CreateMultipartUpload asks for with x-amz-server-side-encryption, which
+// can only be the master key encryption every object gets anyway.
+func (r *Router) s3CheckServerSideEncryption(req *nethttp.Request) error {
+	switch req.Header.Get("X-Amz-Server-Side-Encryption") {
+	case "":
+		return nil
+	case "AES256":
+		if r.keys == nil {
+			return s3ErrInvalidArgument.withMessage("server-side encryption is not configured")
+		}
+		return nil
+	}
+	return s3ErrNotImplemented
+}
+
+// s3CustomerKey reads the SSE-C headers of an S3 request.
+func s3CustomerKey(req *nethttp.Request) ([]byte, error) {
+	key, err := customerKeyFromHeaders(req.Header, s3SSECustomerHeaderPrefix)
+	if err != nil {
+		return nil, s3ErrInvalidArgument.withMessage("The customer key, its algorithm or its MD5 is invalid")
+	}
+	return key, nil
+}
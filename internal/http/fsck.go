@@ -0,0 +1,255 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	nethttp "net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"buck_It_Up/internal/checksum"
+	"buck_It_Up/internal/models"
+	"buck_It_Up/internal/secret"
+	"buck_It_Up/internal/storage"
+)
+
+// fsckOrphanAge is how old an unreferenced blob has to be before fsck
+// reports it; younger ones may belong to uploads still in progress.
+const fsckOrphanAge = time.Hour
+
+var (
+	errFsckRunning = errors.New("fsck is already running")
+	fsckMu         sync.Mutex
+)
+
+// FsckReport is what Fsck found. Problems lists the objects and versions
+// whose blob is missing or does not match their size and checksums, and
+// Orphans the blobs nothing references. Objects encrypted with a customer
+// key, or under a master key that is not configured, can only be checked
+// for their blob's existence and are counted in Unverified.
+type FsckReport struct {
+	Objects    int            `json:"objects"`
+	Unverified int            `json:"unverified"`
+	Problems   []*FsckProblem `json:"problems"`
+	Orphans    []string       `json:"orphans"`
+	Repaired   bool           `json:"repaired"`
+}
+
+type FsckProblem struct {
+	BucketID  int64  `json:"bucket_id"`
+	ObjectKey string `json:"object_key"`
+	VersionID string `json:"version_id,omitempty"`
+	BlobKey   string `json:"blob_key"`
+	Problem   string `json:"problem"`
+}
+
+// fsckResult is the outcome of checking one blob.
+type fsckResult struct {
+	problem  string
+	verified bool
+}
+
+// Fsck checks every object and older version against its blob and looks for
+// blobs that nothing references. With repair set, objects with a problem are
+// marked corrupt, which stops them from being served, marks of objects found
+// intact again are cleared and orphaned blobs are deleted.
+func (r *Router) Fsck(ctx context.Context, repair bool) (*FsckReport, error) {
+	if !fsckMu.TryLock() {
+		return nil, errFsckRunning
+	}
+	defer fsckMu.Unlock()
+
+	report := &FsckReport{Problems: []*FsckProblem{}, Orphans: []string{}, Repaired: repair}
+	if err := r.fsckObjects(ctx, report, repair); err != nil {
+		return nil, err
+	}
+	if err := r.fsckOrphans(ctx, report, repair); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (r *Router) fsckObjects(ctx context.Context, report *FsckReport, repair bool) error {
+	oStore := r.objects
+	// Content addressed blobs are shared, so they are only read once.
+	shared := make(map[string]fsckResult)
+	for _, history := range []bool{false, true} {
+		var after int64
+		for {
+			objs, err := oStore.ListObjectRows(ctx, history, after, maxListKeys)
+			if err != nil {
+				return err
+			}
+			for _, o := range objs {
+				res, ok := shared[o.BlobKey]
+				if !ok {
+					if res, err = r.fsckObject(ctx, o); err != nil {
+						return fmt.Errorf("check object %q (bucket %d): %w", o.ObjectKey, o.BucketID, err)
+					}
+					if isContentBlobKey(o.BlobKey) {
+						shared[o.BlobKey] = res
+					}
+				}
+				report.Objects++
+				if res.problem == "" && !res.verified {
+					report.Unverified++
+				}
+				if repair && res.problem != o.Corrupt {
+					err := oStore.SetCorrupt(ctx, o, res.problem)
+					if errors.Is(err, sql.ErrNoRows) {
+						// Replaced or deleted in the meantime.
+						continue
+					}
+					if err != nil {
+						return err
+					}
+					if res.problem == "" {
+						log.Printf("fsck: object %q (bucket %d) is intact again", o.ObjectKey, o.BucketID)
+					}
+				}
+				if res.problem != "" {
+					report.Problems = append(report.Problems, &FsckProblem{
+						BucketID:  o.BucketID,
+						ObjectKey: o.ObjectKey,
+						VersionID: o.VersionID,
+						BlobKey:   o.BlobKey,
+						Problem:   res.problem,
+					})
+				}
+			}
+			if len(objs) < maxListKeys {
+				break
+			}
+			after = objs[len(objs)-1].ID
+		}
+	}
+	return nil
+}
+
+// fsckObject checks that the blob of o exists and that its content matches
+// the size and checksums of o. Errors are returned only if the check itself
+// failed.
+func (r *Router) fsckObject(ctx context.Context, o *models.Object) (fsckResult, error) {
+	if checkObjectBlobKey(o) != nil {
+		return fsckResult{problem: "invalid blob key"}, nil
+	}
+	info, err := r.blobs.Stat(ctx, o.BlobKey)
+	if errors.Is(err, storage.ErrNotExist) {
+		return fsckResult{problem: "missing"}, nil
+	}
+	if err != nil {
+		return fsckResult{}, err
+	}
+	if o.Encoding == "" && o.Encryption == "" && info.Size != o.Size {
+		return fsckResult{problem: "size mismatch"}, nil
+	}
+	if o.Encryption == models.EncryptionCustomer {
+		return fsckResult{}, nil
+	}
+
+	unmarked := *o
+	unmarked.Corrupt = ""
+	f, err := r.openObjectBlob(ctx, &unmarked, nil)
+	if errors.Is(err, secret.ErrUnknownMasterKey) {
+		log.Printf("fsck: cannot read object %q (bucket %d): %v", o.ObjectKey, o.BucketID, err)
+		return fsckResult{}, nil
+	}
+	if errors.Is(err, secret.ErrCorrupt) {
+		return fsckResult{problem: "unreadable: " + err.Error()}, nil
+	}
+	if err != nil {
+		return fsckResult{}, err
+	}
+	defer f.Close()
+
+	hasher := checksum.NewHasher()
+	n, err := io.Copy(hasher, f)
+	if err != nil {
+		return fsckResult{problem: "unreadable: " + err.Error()}, nil
+	}
+	if n != o.Size {
+		return fsckResult{problem: "size mismatch"}, nil
+	}
+	expected := checksum.Expected{SHA256: o.ChecksumSHA256, MD5: o.ChecksumMD5, CRC32C: o.ChecksumCRC32C}
+	if expected.SHA256 == "" {
+		expected.SHA256 = o.Checksum
+	}
+	if err := hasher.Sum().Verify(expected); err != nil {
+		return fsckResult{problem: err.Error()}, nil
+	}
+	return fsckResult{verified: true}, nil
+}
+
+func (r *Router) fsckOrphans(ctx context.Context, report *FsckReport, repair bool) error {
+	bStore := r.blobRefs
+	cutoff := time.Now().Add(-fsckOrphanAge)
+	for _, prefix := range []string{"buckets/", contentBlobPrefix} {
+		blobs, err := r.blobs.List(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("list blobs: %w", err)
+		}
+		for _, b := range blobs {
+			if b.ModTime.After(cutoff) {
+				continue
+			}
+			orphan, err := r.fsckOrphan(ctx, bStore, b.Key, repair)
+			if err != nil {
+				return err
+			}
+			if orphan {
+				report.Orphans = append(report.Orphans, b.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// fsckOrphan reports whether nothing references the blob under key, and
+// deletes it if so and repair is set. The blob's lock keeps a new object
+// from starting to use it in between.
+func (r *Router) fsckOrphan(ctx context.Context, bStore *models.BlobStore, key string, repair bool) (bool, error) {
+	unlock := lockBlob(key)
+	defer unlock()
+	known, err := bStore.IsKnown(ctx, key)
+	if err != nil || known {
+		return false, err
+	}
+	if repair && !r.deletes.queue(key, false) {
+		if err := r.blobs.Delete(ctx, key); err != nil {
+			return false, fmt.Errorf("delete orphaned blob %s: %w", key, err)
+		}
+		log.Printf("fsck: deleted orphaned blob %s", key)
+	}
+	return true, nil
+}
+
+// fsckHandler runs Fsck and returns its report. ?repair=true repairs what is
+// found.
+func (r *Router) fsckHandler(w nethttp.ResponseWriter, req *nethttp.Request) {
+	repair := false
+	if v := req.URL.Query().Get("repair"); v != "" {
+		var err error
+		if repair, err = strconv.ParseBool(v); err != nil {
+			nethttp.Error(w, "invalid repair", nethttp.StatusBadRequest)
+			return
+		}
+	}
+	report, err := r.Fsck(req.Context(), repair)
+	if errors.Is(err, errFsckRunning) {
+		nethttp.Error(w, err.Error(), nethttp.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("fsck: %v", err)
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
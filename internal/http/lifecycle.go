@@ -0,0 +1,257 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"buck_It_Up/internal/models"
+)
+
+const (
+	maxLifecycleRules        = 100
+	defaultLifecycleInterval = time.Hour
+)
+
+type lifecycleRuleRequest struct {
+	ID                        string `json:"id"`
+	Prefix                    string `json:"prefix"`
+	Enabled                   *bool  `json:"enabled"`
+	ExpirationDays            int    `json:"expiration_days"`
+	KeepNewest                int    `json:"keep_newest"`
+	AbortIncompleteUploadDays int    `json:"abort_incomplete_upload_days"`
+}
+
+// lifecycleRules validates the rules of a PATCH /{name} request. Rules
+// without an ID are numbered, and rules are enabled unless stated otherwise.
+func lifecycleRules(reqs []lifecycleRuleRequest) ([]*models.LifecycleRule, error) {
+	if len(reqs) > maxLifecycleRules {
+		return nil, fmt.Errorf("at most %d lifecycle rules per bucket", maxLifecycleRules)
+	}
+	rules := make([]*models.LifecycleRule, 0, len(reqs))
+	seen := make(map[string]bool, len(reqs))
+	for i, req := range reqs {
+		rule := &models.LifecycleRule{
+			ID:                        strings.TrimSpace(req.ID),
+			Prefix:                    req.Prefix,
+			Enabled:                   req.Enabled == nil || *req.Enabled,
+			ExpirationDays:            req.ExpirationDays,
+			KeepNewest:                req.KeepNewest,
+			AbortIncompleteUploadDays: req.AbortIncompleteUploadDays,
+		}
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		if seen[rule.ID] {
+			return nil, fmt.Errorf("duplicate lifecycle rule id %q", rule.ID)
+		}
+		seen[rule.ID] = true
+		if strings.Contains(rule.Prefix, "\x00") {
+			return nil, fmt.Errorf("invalid prefix in lifecycle rule %q", rule.ID)
+		}
+		if rule.ExpirationDays < 0 || rule.KeepNewest < 0 || rule.AbortIncompleteUploadDays < 0 {
+			return nil, fmt.Errorf("negative value in lifecycle rule %q", rule.ID)
+		}
+		if rule.ExpirationDays == 0 && rule.KeepNewest == 0 && rule.AbortIncompleteUploadDays == 0 {
+			return nil, fmt.Errorf("lifecycle rule %q has no action", rule.ID)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// LifecycleInterval returns how often lifecycle rules are applied,
+// configured via BUCKITUP_LIFECYCLE_INTERVAL (a Go duration such as "15m").
+func LifecycleInterval() time.Duration {
+	if v := os.Getenv("BUCKITUP_LIFECYCLE_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("invalid BUCKITUP_LIFECYCLE_INTERVAL %q, using %s", v, defaultLifecycleInterval)
+	}
+	return defaultLifecycleInterval
+}
+
+// RunLifecycleWorker applies the lifecycle rules of every bucket every
+// interval until ctx is done. Of several instances sharing the database only
+// the one holding the lifecycle lease does so.
+func (r *Router) RunLifecycleWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if r.holdLease(ctx, leaseLifecycle, 2*interval) {
+			r.ApplyLifecycleRules(ctx, time.Now())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ApplyLifecycleRules runs the enabled lifecycle rules of all buckets once,
+// as of now. A failing rule is logged and does not stop the others.
+func (r *Router) ApplyLifecycleRules(ctx context.Context, now time.Time) {
+	buckets, err := r.buckets.ListBuckets(ctx)
+	if err != nil {
+		log.Printf("lifecycle: list buckets: %v", err)
+		return
+	}
+	lStore := r.lifecycle
+	for _, bucket := range buckets {
+		rules, err := lStore.GetRules(ctx, bucket.ID)
+		if err != nil {
+			log.Printf("lifecycle: rules of bucket %s: %v", bucket.Name, err)
+			continue
+		}
+		for _, rule := range rules {
+			if !rule.Enabled {
+				continue
+			}
+			if err := r.applyLifecycleRule(ctx, bucket, rule, now); err != nil {
+				log.Printf("lifecycle: bucket %s rule %s: %v", bucket.Name, rule.ID, err)
+			}
+		}
+	}
+}
+
+func (r *Router) applyLifecycleRule(ctx context.Context, bucket *models.Bucket, rule *models.LifecycleRule, now time.Time) error {
+	var errs []error
+	if rule.ExpirationDays > 0 {
+		cutoff := now.AddDate(0, 0, -rule.ExpirationDays).Unix()
+		n, err := r.expireObjects(ctx, bucket, rule.Prefix, cutoff, 0)
+		if n > 0 {
+			log.Printf("lifecycle: bucket %s rule %s expired %d objects", bucket.Name, rule.ID, n)
+		}
+		errs = append(errs, err)
+		n, err = r.expireVersions(ctx, bucket, rule.Prefix, cutoff)
+		if n > 0 {
+			log.Printf("lifecycle: bucket %s rule %s removed %d older versions and delete markers", bucket.Name, rule.ID, n)
+		}
+		errs = append(errs, err)
+	}
+	if rule.KeepNewest > 0 {
+		n, err := r.expireObjects(ctx, bucket, rule.Prefix, 0, rule.KeepNewest)
+		if n > 0 {
+			log.Printf("lifecycle: bucket %s rule %s removed %d objects beyond the newest %d", bucket.Name, rule.ID, n, rule.KeepNewest)
+		}
+		errs = append(errs, err)
+	}
+	if rule.AbortIncompleteUploadDays > 0 {
+		cutoff := now.AddDate(0, 0, -rule.AbortIncompleteUploadDays).Unix()
+		errs = append(errs, r.abortIncompleteUploads(ctx, bucket, rule, cutoff))
+	}
+	return errors.Join(errs...)
+}
+
+// expireObjects deletes the objects under prefix that were created before
+// createdBefore (any time if 0), apart from the keep newest ones, like
+// DELETE without a version ID would. It returns the number deleted.
+func (r *Router) expireObjects(ctx context.Context, bucket *models.Bucket, prefix string, createdBefore int64, keep int) (int, error) {
+	oStore := r.objects
+	deleted := 0
+	for {
+		objs, err := oStore.ListObjectsByAge(ctx, bucket.ID, prefix, createdBefore, keep, maxListKeys)
+		if err != nil || len(objs) == 0 {
+			return deleted, err
+		}
+		n, err := r.removeObjects(ctx, bucket, objs)
+		deleted += n
+		if err != nil || n == 0 || len(objs) < maxListKeys {
+			return deleted, err
+		}
+	}
+}
+
+// expireVersions permanently removes the older versions under prefix that
+// were superseded before noncurrentBefore, then the delete markers that no
+// longer hide anything. Without it, expiring objects in a versioned bucket
+// would only pile up delete markers. It returns the number removed.
+func (r *Router) expireVersions(ctx context.Context, bucket *models.Bucket, prefix string, noncurrentBefore int64) (int, error) {
+	oStore := r.objects
+	n, err := r.removeVersions(ctx, bucket, func() ([]*models.Object, error) {
+		return oStore.ListNoncurrentVersions(ctx, bucket.ID, prefix, noncurrentBefore, maxListKeys)
+	})
+	if err != nil {
+		return n, err
+	}
+	m, err := r.removeVersions(ctx, bucket, func() ([]*models.Object, error) {
+		return oStore.ListExpiredDeleteMarkers(ctx, bucket.ID, prefix, maxListKeys)
+	})
+	return n + m, err
+}
+
+// removeVersions permanently removes the versions returned by list until it
+// comes back empty. It returns the number removed.
+func (r *Router) removeVersions(ctx context.Context, bucket *models.Bucket, list func() ([]*models.Object, error)) (int, error) {
+	removed := 0
+	for {
+		versions, err := list()
+		if err != nil || len(versions) == 0 {
+			return removed, err
+		}
+		n := 0
+		for _, v := range versions {
+			if _, err := r.deleteObjectVersion(ctx, bucket, v.ObjectKey, v.VersionID); err != nil {
+				if err == sql.ErrNoRows {
+					// Removed concurrently.
+					continue
+				}
+				return removed, err
+			}
+			n++
+		}
+		removed += n
+		if n == 0 || len(versions) < maxListKeys {
+			return removed, nil
+		}
+	}
+}
+
+// abortIncompleteUploads removes the multipart and tus uploads under the
+// rule's prefix that were started before cutoff. Tus uploads that are
+// receiving data right now are left for the next run.
+func (r *Router) abortIncompleteUploads(ctx context.Context, bucket *models.Bucket, rule *models.LifecycleRule, cutoff int64) error {
+	uploads, err := r.multipart.ListUploads(ctx, bucket.ID)
+	if err != nil {
+		return err
+	}
+	for _, u := range uploads {
+		if u.CreatedAt >= cutoff || !strings.HasPrefix(u.ObjectKey, rule.Prefix) {
+			continue
+		}
+		if err := r.removeMultipartUpload(ctx, u); err != nil {
+			log.Printf("lifecycle: abort upload %s: %v", u.UploadID, err)
+			continue
+		}
+		log.Printf("lifecycle: bucket %s rule %s aborted upload %s (key %q)", bucket.Name, rule.ID, u.UploadID, u.ObjectKey)
+	}
+
+	tusUploads, err := r.tus.ListUploads(ctx, bucket.ID)
+	if err != nil {
+		return err
+	}
+	for _, u := range tusUploads {
+		if u.CreatedAt >= cutoff || !strings.HasPrefix(u.ObjectKey, rule.Prefix) {
+			continue
+		}
+		unlock, ok := lockTusUpload(u.UploadID)
+		if !ok {
+			continue
+		}
+		err := r.removeTusUpload(ctx, u)
+		unlock()
+		if err != nil {
+			log.Printf("lifecycle: abort tus upload %s: %v", u.UploadID, err)
+			continue
+		}
+		log.Printf("lifecycle: bucket %s rule %s aborted tus upload %s (key %q)", bucket.Name, rule.ID, u.UploadID, u.ObjectKey)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package http
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	nethttp "net/http"
+	"strconv"
+
+	"buck_It_Up/internal/models"
+)
+
+const maxListKeys = 1000
+
+// listParams are the query parameters that switch LIST /{bucketName} from
+// returning every object to returning one page.
+var listParams = []string{"prefix", "delimiter", "start_after", "continuation_token", "max_keys", "tag"}
+
+func isPagedListRequest(req *nethttp.Request) bool {
+	q := req.URL.Query()
+	for _, p := range listParams {
+		if q.Has(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeContinuationToken turns the last entry of a page into an opaque token.
+func encodeContinuationToken(next string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(next))
+}
+
+func decodeContinuationToken(token string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	return string(b), err
+}
+
+func (r *Router) listObjectsPage(w nethttp.ResponseWriter, req *nethttp.Request, bucket *models.Bucket) {
+	q := req.URL.Query()
+	opts := models.ListObjectsOptions{
+		Prefix:     q.Get("prefix"),
+		Delimiter:  q.Get("delimiter"),
+		StartAfter: q.Get("start_after"),
+		MaxKeys:    maxListKeys,
+	}
+	if v := q.Get("max_keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			nethttp.Error(w, "invalid max_keys", nethttp.StatusBadRequest)
+			return
+		}
+		opts.MaxKeys = min(n, maxListKeys)
+	}
+	tags, err := parseTagFilters(q)
+	if err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+	opts.Tags = tags
+	if token := q.Get("continuation_token"); token != "" {
+		after, err := decodeContinuationToken(token)
+		if err != nil {
+			nethttp.Error(w, "invalid continuation token", nethttp.StatusBadRequest)
+			return
+		}
+		opts.StartAfter = after
+	}
+
+	page, err := r.objects.ListObjectsPage(req.Context(), bucket.ID, opts)
+	if err != nil {
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		*models.ObjectPage
+		NextContinuationToken string `json:"next_continuation_token,omitempty"`
+	}{
+		ObjectPage: page,
+	}
+	if page.IsTruncated {
+		resp.NextContinuationToken = encodeContinuationToken(page.Next)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusOK)
+	_ = json.NewEncoder(w).Encode(resp)
+}
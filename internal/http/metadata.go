@@ -0,0 +1,273 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+
+	"buck_It_Up/internal/models"
+)
+
+// Limits on user metadata and tags, matching those of S3.
+const (
+	maxObjectTags     = 10
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+	maxMetadataSize   = 2 << 10
+)
+
+var errMetadataTooLarge = errors.New("metadata too large")
+
+const (
+	metadataHeaderPrefix   = "X-Meta-"
+	s3MetadataHeaderPrefix = "X-Amz-Meta-"
+)
+
+// objectAttributes are the properties of an object chosen by the uploader
+// rather than derived from its content.
+type objectAttributes struct {
+	ContentType string
+	Metadata    map[string]string
+	Tags        map[string]string
+	// CustomerKey encrypts the object instead of the master key.
+	CustomerKey []byte
+}
+
+// metadataFromHeaders collects the headers starting with prefix as user
+// metadata. Names are lowercased since header names are case-insensitive.
+func metadataFromHeaders(h nethttp.Header, prefix string) map[string]string {
+	var meta map[string]string
+	for name, values := range h {
+		if len(name) <= len(prefix) || !strings.EqualFold(name[:len(prefix)], prefix) {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.ToLower(name[len(prefix):])] = strings.Join(values, ",")
+	}
+	return meta
+}
+
+func setMetadataHeaders(h nethttp.Header, prefix string, meta map[string]string) {
+	for name, value := range meta {
+		h.Set(prefix+name, value)
+	}
+}
+
+// normalizeMetadata lowercases metadata names given in a JSON body so they
+// survive the round trip through headers.
+func normalizeMetadata(meta map[string]string) map[string]string {
+	if len(meta) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(meta))
+	for name, value := range meta {
+		out[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	return out
+}
+
+// parseTagSet decodes tags given URL query encoded, as in
+// "env=prod&team=web".
+func parseTagSet(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, errors.New("invalid tags")
+	}
+	tags := make(map[string]string, len(values))
+	for name, v := range values {
+		if len(v) > 1 {
+			return nil, errors.New("duplicate tag " + name)
+		}
+		tags[name] = v[0]
+	}
+	return tags, nil
+}
+
+func validateMetadata(meta map[string]string) error {
+	size := 0
+	for name, value := range meta {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return errors.New("invalid metadata name")
+		}
+		size += len(name) + len(value)
+	}
+	if size > maxMetadataSize {
+		return errMetadataTooLarge
+	}
+	return nil
+}
+
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxObjectTags {
+		return errors.New("too many tags")
+	}
+	for name, value := range tags {
+		if name == "" || len(name) > maxTagKeyLength {
+			return errors.New("invalid tag key")
+		}
+		if len(value) > maxTagValueLength {
+			return errors.New("tag value too long")
+		}
+	}
+	return nil
+}
+
+func (a objectAttributes) validate() error {
+	if err := validateMetadata(a.Metadata); err != nil {
+		return err
+	}
+	return validateTags(a.Tags)
+}
+
+// attributesFromHeaders reads the content type, X-Meta-* headers, the
+// X-Tags header and a customer key of a request that carries the object
+// content as its body.
+func attributesFromHeaders(req *nethttp.Request) (objectAttributes, error) {
+	attrs := objectAttributes{
+		ContentType: strings.TrimSpace(req.Header.Get("Content-Type")),
+		Metadata:    metadataFromHeaders(req.Header, metadataHeaderPrefix),
+	}
+	var err error
+	if attrs.Tags, err = parseTagSet(req.Header.Get("X-Tags")); err != nil {
+		return attrs, err
+	}
+	if attrs.CustomerKey, err = customerKeyFromHeaders(req.Header, sseCustomerHeaderPrefix); err != nil {
+		return attrs, err
+	}
+	return attrs, attrs.validate()
+}
+
+// parseTagFilters reads the tag=name:value parameters of a listing request.
+func parseTagFilters(q url.Values) (map[string]string, error) {
+	var tags map[string]string
+	for _, f := range q["tag"] {
+		name, value, ok := strings.Cut(f, ":")
+		if !ok || name == "" {
+			return nil, errors.New("invalid tag filter")
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[name] = value
+	}
+	return tags, nil
+}
+
+// tagsTarget names the object version addressed by a tags request.
+type tagsTarget struct {
+	bucket    *models.Bucket
+	objectKey string
+	versionID string
+}
+
+func (r *Router) tagsTargetFromPath(w nethttp.ResponseWriter, req *nethttp.Request) (tagsTarget, bool) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return tagsTarget{}, false
+	}
+	objectKey := strings.TrimPrefix(req.URL.Path, "/"+bucket.Name+"/tags/")
+	objectKey = strings.TrimSpace(objectKey)
+	if objectKey == "" || strings.Contains(objectKey, "\x00") {
+		nethttp.Error(w, "invalid object key", nethttp.StatusBadRequest)
+		return tagsTarget{}, false
+	}
+	return tagsTarget{bucket, objectKey, req.URL.Query().Get("versionId")}, true
+}
+
+func writeTags(w nethttp.ResponseWriter, status int, tags map[string]string) {
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Tags map[string]string `json:"tags"`
+	}{tags})
+}
+
+func writeTagsError(w nethttp.ResponseWriter, req *nethttp.Request, err error) {
+	if err == sql.ErrNoRows {
+		nethttp.NotFound(w, req)
+		return
+	}
+	nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+}
+
+func (r *Router) getObjectTags(w nethttp.ResponseWriter, req *nethttp.Request) {
+	t, ok := r.tagsTargetFromPath(w, req)
+	if !ok {
+		return
+	}
+	ctx := req.Context()
+	obj, err := r.getObjectVersion(ctx, t.bucket.ID, t.objectKey, t.versionID)
+	if err == nil {
+		err = r.objects.LoadAttributes(ctx, obj)
+	}
+	if err != nil {
+		writeTagsError(w, req, err)
+		return
+	}
+	writeTags(w, nethttp.StatusOK, obj.Tags)
+}
+
+func (r *Router) putObjectTags(w nethttp.ResponseWriter, req *nethttp.Request) {
+	t, ok := r.tagsTargetFromPath(w, req)
+	if !ok {
+		return
+	}
+	var body struct {
+		Tags map[string]string `json:"tags"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		nethttp.Error(w, "invalid json", nethttp.StatusBadRequest)
+		return
+	}
+	if err := validateTags(body.Tags); err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+	if err := r.setObjectTags(req.Context(), t, body.Tags); err != nil {
+		writeTagsError(w, req, err)
+		return
+	}
+	writeTags(w, nethttp.StatusOK, body.Tags)
+}
+
+func (r *Router) deleteObjectTags(w nethttp.ResponseWriter, req *nethttp.Request) {
+	t, ok := r.tagsTargetFromPath(w, req)
+	if !ok {
+		return
+	}
+	if err := r.setObjectTags(req.Context(), t, nil); err != nil {
+		writeTagsError(w, req, err)
+		return
+	}
+	w.WriteHeader(nethttp.StatusNoContent)
+}
+
+// setObjectTags replaces the tags of the target version. The version is
+// looked up while holding the key's lock so a concurrent write or delete
+// cannot leave the tags attached to a version that is gone.
+func (r *Router) setObjectTags(ctx context.Context, t tagsTarget, tags map[string]string) error {
+	unlock := lockObjectKey(t.bucket.ID, t.objectKey)
+	defer unlock()
+	obj, err := r.getObjectVersion(ctx, t.bucket.ID, t.objectKey, t.versionID)
+	if err != nil {
+		return err
+	}
+	if err := r.objects.SetTags(ctx, obj, tags); err != nil {
+		log.Printf("set tags of %q: %v", t.objectKey, err)
+		return err
+	}
+	return nil
+}
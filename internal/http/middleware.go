@@ -80,7 +80,7 @@ func (r *Router) AuthMiddleware(level AuthLevel) func(nethttp.Handler) nethttp.H
 				return
 			}
 
-			akStore := models.NewAccessKeyStore(r.db)
+			akStore := r.accessKeys
 			ctx := req.Context()
 			accessKey, err := akStore.GetByKeyID(ctx, keyID)
 			if err != nil {
@@ -111,7 +111,7 @@ func (r *Router) AuthMiddleware(level AuthLevel) func(nethttp.Handler) nethttp.H
 			}
 
 			if bucketName != "" {
-				bStore := models.NewBucketStore(r.db)
+				bStore := r.buckets
 				bucket, err := bStore.GetBucketByName(ctx, bucketName)
 				if err != nil {
 					if err == sql.ErrNoRows {
@@ -0,0 +1,585 @@
+package http
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	nethttp "net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"buck_It_Up/internal/checksum"
+	"buck_It_Up/internal/models"
+	"buck_It_Up/internal/secret"
+	"buck_It_Up/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxPartNumber = 10000
+
+	// defaultUploadExpiry is how long an incomplete upload is kept before
+	// the sweeper aborts it.
+	defaultUploadExpiry = 24 * time.Hour
+	// completionStaleAfter is how long the completion of an upload may
+	// take before another request to complete it takes over.
+	completionStaleAfter = time.Hour
+)
+
+var (
+	errNoSuchUpload     = errors.New("no such upload")
+	errInvalidPart      = errors.New("invalid part")
+	errInvalidPartOrder = errors.New("parts must be listed in ascending order")
+)
+
+// completedPart is one entry of the part list sent to complete an upload.
+type completedPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+func newUploadID() (string, error) {
+	return newObjectFileName()
+}
+
+func (r *Router) createMultipartUpload(ctx context.Context, bucket *models.Bucket, objectKey string, attrs objectAttributes) (*models.MultipartUpload, error) {
+	uploadID, err := newUploadID()
+	if err != nil {
+		return nil, err
+	}
+	if attrs.ContentType == "" {
+		attrs.ContentType = "application/octet-stream"
+	}
+	u := &models.MultipartUpload{
+		UploadID:    uploadID,
+		BucketID:    bucket.ID,
+		ObjectKey:   objectKey,
+		ContentType: attrs.ContentType,
+		CreatedAt:   time.Now().Unix(),
+		Metadata:    attrs.Metadata,
+		Tags:        attrs.Tags,
+	}
+	dk, err := r.newDataKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	if dk != nil {
+		u.Encryption, u.KeyID, u.DataKey = dk.encryption, dk.keyID, dk.wrapped
+	}
+	id, err := r.multipart.CreateUpload(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	u.ID = id
+	return u, nil
+}
+
+func (r *Router) getMultipartUpload(ctx context.Context, bucket *models.Bucket, uploadID string) (*models.MultipartUpload, error) {
+	u, err := r.multipart.GetUpload(ctx, bucket.ID, uploadID)
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchUpload
+	}
+	return u, err
+}
+
+// uploadPart streams one part into the upload's staging directory, encrypted
+// with the upload's data key if it has one. The part ETag is the hex MD5 of
+// its content, as in S3. No part may be larger than the object the bucket's
+// quota would still accept.
+func (r *Router) uploadPart(ctx context.Context, bucket *models.Bucket, u *models.MultipartUpload, partNumber int, body io.Reader, expectedSize int64, expected checksum.Expected) (*models.UploadPart, error) {
+	if partNumber < 1 || partNumber > maxPartNumber {
+		return nil, errInvalidPart
+	}
+	limit, err := r.uploadLimit(ctx, bucket, u.ObjectKey)
+	if err != nil {
+		return nil, err
+	}
+	if expectedSize >= 0 {
+		if err := limit.check(expectedSize); err != nil {
+			return nil, err
+		}
+	}
+	if limit.max >= 0 {
+		body = io.LimitReader(body, limit.max+1)
+	}
+	dataKey, err := r.stagingDataKey(u.Encryption, u.KeyID, u.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	name, err := newObjectFileName()
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s%05d-%s", multipartBlobPrefix(u), partNumber, name)
+	size, digests, err := r.putBlob(ctx, key, body, "", dataKey)
+	if err != nil {
+		return nil, err
+	}
+	err = limit.check(size)
+	if err == nil && expectedSize >= 0 && size != expectedSize {
+		err = errLengthMismatch
+	}
+	if err == nil {
+		err = digests.Verify(expected)
+	}
+	if err != nil {
+		r.removeBlob(key)
+		return nil, err
+	}
+
+	part := &models.UploadPart{
+		UploadID:   u.UploadID,
+		PartNumber: partNumber,
+		BlobKey:    key,
+		Size:       size,
+		ETag:       digests.MD5,
+		CreatedAt:  time.Now().Unix(),
+	}
+	oldKey, err := r.multipart.PutPart(ctx, part)
+	if err != nil {
+		r.removeBlob(key)
+		if err == sql.ErrNoRows {
+			return nil, errNoSuchUpload
+		}
+		return nil, fmt.Errorf("store part: %w", err)
+	}
+	if oldKey != "" {
+		r.removeBlob(oldKey)
+	}
+	return part, nil
+}
+
+// completeMultipartUpload concatenates the listed parts into a new object and
+// removes the upload. It returns the object and the S3 style composite ETag:
+// the MD5 of the concatenated binary part MD5s followed by the part count.
+// While it runs no parts can be uploaded, and other requests to complete the
+// upload fail with models.ErrUploadCompleting.
+func (r *Router) completeMultipartUpload(ctx context.Context, bucket *models.Bucket, u *models.MultipartUpload, requested []completedPart, cond writeCondition) (*models.Object, string, error) {
+	if len(requested) == 0 {
+		return nil, "", errInvalidPart
+	}
+	now := time.Now()
+	started, err := r.multipart.StartCompletion(ctx, u.UploadID, now.Unix(), now.Add(-completionStaleAfter).Unix())
+	if err != nil {
+		return nil, "", err
+	}
+	if !started {
+		return nil, "", models.ErrUploadCompleting
+	}
+	obj, etag, err := r.assembleParts(ctx, bucket, u, requested, cond)
+	if err != nil {
+		if err := r.multipart.CancelCompletion(context.WithoutCancel(ctx), u.UploadID, now.Unix()); err != nil {
+			log.Printf("cancel completion of upload %s: %v", u.UploadID, err)
+		}
+		return nil, "", err
+	}
+
+	if err := r.removeMultipartUpload(ctx, u); err != nil {
+		log.Printf("remove completed upload %s: %v", u.UploadID, err)
+	}
+	return obj, etag, nil
+}
+
+// assembleParts stores the listed parts of the upload as its object.
+func (r *Router) assembleParts(ctx context.Context, bucket *models.Bucket, u *models.MultipartUpload, requested []completedPart, cond writeCondition) (*models.Object, string, error) {
+	stored, err := r.multipart.ListParts(ctx, u.UploadID)
+	if err != nil {
+		return nil, "", err
+	}
+	byNumber := make(map[int]*models.UploadPart, len(stored))
+	for _, p := range stored {
+		byNumber[p.PartNumber] = p
+	}
+
+	parts := make([]*models.UploadPart, 0, len(requested))
+	composite := md5.New()
+	var total int64
+	for i, want := range requested {
+		if i > 0 && want.PartNumber <= requested[i-1].PartNumber {
+			return nil, "", errInvalidPartOrder
+		}
+		p, ok := byNumber[want.PartNumber]
+		if !ok || strings.Trim(want.ETag, `"`) != p.ETag {
+			return nil, "", fmt.Errorf("%w: part %d", errInvalidPart, want.PartNumber)
+		}
+		sum, err := hex.DecodeString(p.ETag)
+		if err != nil {
+			return nil, "", err
+		}
+		composite.Write(sum)
+		total += p.Size
+		parts = append(parts, p)
+	}
+
+	dataKey, err := r.stagingDataKey(u.Encryption, u.KeyID, u.DataKey)
+	if err != nil {
+		return nil, "", err
+	}
+	body := &partsReader{ctx: ctx, blobs: r.blobs, parts: parts, dataKey: dataKey}
+	defer body.Close()
+	obj, err := r.storeObject(ctx, bucket, u.ObjectKey, objectAttributes{ContentType: u.ContentType, Metadata: u.Metadata, Tags: u.Tags}, body, total, checksum.Expected{}, cond)
+	if err != nil {
+		if body.err != nil {
+			// Not the client's fault, unlike other errors reading the body.
+			return nil, "", fmt.Errorf("read parts: %w", body.err)
+		}
+		return nil, "", err
+	}
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(composite.Sum(nil)), len(parts))
+	return obj, etag, nil
+}
+
+func multipartBlobPrefix(u *models.MultipartUpload) string {
+	return bucketBlobPrefix(u.BucketID) + "multipart/" + u.UploadID + "/"
+}
+
+// removeMultipartUpload deletes an upload's rows and part blobs.
+func (r *Router) removeMultipartUpload(ctx context.Context, u *models.MultipartUpload) error {
+	if err := r.multipart.DeleteUpload(ctx, u.UploadID); err != nil {
+		return err
+	}
+	return storage.DeletePrefix(ctx, r.blobs, multipartBlobPrefix(u))
+}
+
+// partsReader reads the blobs of the given parts one after another, opening
+// each only when it is reached so large uploads do not exhaust descriptors.
+// Parts are decrypted with dataKey if that is not nil. err records a failure
+// to read a part.
+type partsReader struct {
+	ctx     context.Context
+	blobs   storage.Backend
+	parts   []*models.UploadPart
+	dataKey []byte
+	cur     io.ReadCloser
+	err     error
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.cur == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+			f, err := p.blobs.Get(p.ctx, p.parts[0].BlobKey)
+			if err == nil && p.dataKey != nil {
+				blob := f
+				if f, err = secret.DecryptReader(p.dataKey, blob); err != nil {
+					blob.Close()
+				}
+			}
+			if err != nil {
+				p.err = err
+				return 0, err
+			}
+			p.cur = f
+			p.parts = p.parts[1:]
+		}
+		n, err := p.cur.Read(b)
+		if err == io.EOF {
+			p.cur.Close()
+			p.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if err != nil {
+			p.err = err
+		}
+		return n, err
+	}
+}
+
+func (p *partsReader) Close() error {
+	if p.cur != nil {
+		return p.cur.Close()
+	}
+	return nil
+}
+
+// SweepStaleUploads aborts multipart uploads started more than maxAge ago.
+func (r *Router) SweepStaleUploads(ctx context.Context, maxAge time.Duration) {
+	cutoff := time.Now().Add(-maxAge).Unix()
+	uploads, err := r.multipart.ListUploadsCreatedBefore(ctx, cutoff)
+	if err != nil {
+		log.Printf("sweep stale uploads: %v", err)
+		return
+	}
+	for _, u := range uploads {
+		if err := r.removeMultipartUpload(ctx, u); err != nil {
+			log.Printf("abort stale upload %s: %v", u.UploadID, err)
+			continue
+		}
+		log.Printf("aborted stale upload %s (bucket %d, key %q)", u.UploadID, u.BucketID, u.ObjectKey)
+	}
+}
+
+// RunUploadSweeper removes stale multipart and expired tus uploads, and
+// blobs nothing references any more, every interval until ctx is done. Of
+// several instances sharing the database only the one holding the sweeper
+// lease does so.
+func (r *Router) RunUploadSweeper(ctx context.Context, interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if r.holdLease(ctx, leaseUploadSweeper, 2*interval) {
+			r.SweepStaleUploads(ctx, maxAge)
+			r.sweepExpiredTusUploads(ctx)
+			r.collectBlobs(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// UploadExpiry returns how long incomplete multipart uploads are kept, and
+// how long tus uploads are kept after they last received data, configured via
+// BUCKITUP_UPLOAD_EXPIRY (a Go duration such as "36h").
+func UploadExpiry() time.Duration {
+	if v := os.Getenv("BUCKITUP_UPLOAD_EXPIRY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("invalid BUCKITUP_UPLOAD_EXPIRY %q, using %s", v, defaultUploadExpiry)
+	}
+	return defaultUploadExpiry
+}
+
+func (r *Router) writeMultipartError(w nethttp.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoSuchUpload):
+		nethttp.Error(w, "upload not found", nethttp.StatusNotFound)
+	case errors.Is(err, models.ErrUploadCompleting):
+		nethttp.Error(w, err.Error(), nethttp.StatusConflict)
+	case errors.Is(err, errInvalidPartOrder):
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+	case errors.Is(err, errInvalidPart):
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+	default:
+		r.writeStoreError(w, err)
+	}
+}
+
+// bucketFromPath looks up the bucket named by the bucketName path parameter
+// and writes an error response if that fails.
+func (r *Router) bucketFromPath(w nethttp.ResponseWriter, req *nethttp.Request) (*models.Bucket, bool) {
+	bucketName := chi.URLParam(req, "bucketName")
+	if bucketName == "" || strings.Contains(bucketName, "/") {
+		nethttp.Error(w, "invalid bucket name", nethttp.StatusBadRequest)
+		return nil, false
+	}
+	bucket, err := r.buckets.GetBucketByName(req.Context(), bucketName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			nethttp.NotFound(w, req)
+			return nil, false
+		}
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return nil, false
+	}
+	return bucket, true
+}
+
+func (r *Router) initiateMultipartUpload(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	if rejectCustomerKey(w, req) {
+		return
+	}
+
+	var body struct {
+		ObjectKey   string            `json:"object_key"`
+		ContentType string            `json:"content_type"`
+		Metadata    map[string]string `json:"metadata,omitempty"`
+		Tags        map[string]string `json:"tags,omitempty"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		nethttp.Error(w, "invalid json", nethttp.StatusBadRequest)
+		return
+	}
+	objectKey := strings.TrimSpace(body.ObjectKey)
+	if err := checkNativeObjectKey(objectKey); err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+	attrs := objectAttributes{
+		ContentType: strings.TrimSpace(body.ContentType),
+		Metadata:    normalizeMetadata(body.Metadata),
+		Tags:        body.Tags,
+	}
+	if err := attrs.validate(); err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+
+	u, err := r.createMultipartUpload(req.Context(), bucket, objectKey, attrs)
+	if err != nil {
+		nethttp.Error(w, "failed to create upload", nethttp.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusCreated)
+	_ = json.NewEncoder(w).Encode(u)
+}
+
+func (r *Router) listMultipartUploads(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	uploads, err := r.multipart.ListUploads(req.Context(), bucket.ID)
+	if err != nil {
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	if uploads == nil {
+		uploads = []*models.MultipartUpload{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusOK)
+	_ = json.NewEncoder(w).Encode(uploads)
+}
+
+func (r *Router) listUploadParts(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	ctx := req.Context()
+	u, err := r.getMultipartUpload(ctx, bucket, chi.URLParam(req, "uploadID"))
+	if err != nil {
+		r.writeMultipartError(w, err)
+		return
+	}
+	parts, err := r.multipart.ListParts(ctx, u.UploadID)
+	if err != nil {
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	if parts == nil {
+		parts = []*models.UploadPart{}
+	}
+
+	resp := struct {
+		*models.MultipartUpload
+		Parts []*models.UploadPart `json:"parts"`
+	}{
+		MultipartUpload: u,
+		Parts:           parts,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusOK)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (r *Router) putUploadPart(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	if rejectCustomerKey(w, req) {
+		return
+	}
+	partNumber, err := strconv.Atoi(chi.URLParam(req, "partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		nethttp.Error(w, "invalid part number", nethttp.StatusBadRequest)
+		return
+	}
+	expected, err := expectedChecksums(req)
+	if err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	u, err := r.getMultipartUpload(ctx, bucket, chi.URLParam(req, "uploadID"))
+	if err != nil {
+		r.writeMultipartError(w, err)
+		return
+	}
+	part, err := r.uploadPart(ctx, bucket, u, partNumber, req.Body, req.ContentLength, expected)
+	if err != nil {
+		r.writeMultipartError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+part.ETag+`"`)
+	w.WriteHeader(nethttp.StatusOK)
+	_ = json.NewEncoder(w).Encode(part)
+}
+
+func (r *Router) completeMultipartUploadHandler(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	if rejectCustomerKey(w, req) {
+		return
+	}
+	var body struct {
+		Parts []completedPart `json:"parts"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		nethttp.Error(w, "invalid json", nethttp.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	u, err := r.getMultipartUpload(ctx, bucket, chi.URLParam(req, "uploadID"))
+	if err != nil {
+		r.writeMultipartError(w, err)
+		return
+	}
+	obj, etag, err := r.completeMultipartUpload(ctx, bucket, u, body.Parts, writeConditionFromRequest(req))
+	if err != nil {
+		r.writeMultipartError(w, err)
+		return
+	}
+
+	resp := struct {
+		*models.Object
+		ETag string `json:"etag"`
+	}{
+		Object: obj,
+		ETag:   etag,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.WriteHeader(nethttp.StatusCreated)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (r *Router) abortMultipartUploadHandler(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	ctx := req.Context()
+	u, err := r.getMultipartUpload(ctx, bucket, chi.URLParam(req, "uploadID"))
+	if err != nil {
+		r.writeMultipartError(w, err)
+		return
+	}
+	if err := r.removeMultipartUpload(ctx, u); err != nil {
+		nethttp.Error(w, "failed to abort upload", nethttp.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(nethttp.StatusNoContent)
+}
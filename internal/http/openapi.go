@@ -49,9 +49,31 @@ func GetOpenAPISpec() []byte {
           "object_key": { "type": "string" },
           "content": { "type": "string" },
           "content_type": { "type": "string" },
-          "base64_encoded": { "type": "boolean" }
+          "base64_encoded": { "type": "boolean" },
+          "metadata": { "type": "object", "additionalProperties": { "type": "string" }, "description": "user metadata, at most 2 KiB" },
+          "tags": { "type": "object", "additionalProperties": { "type": "string" }, "description": "at most 10 tags" }
         },
         "required": ["object_key", "content"]
+      },
+      "BucketQuota": {
+        "type": "object",
+        "description": "0 means no limit",
+        "properties": {
+          "max_bytes": { "type": "integer", "description": "total size of the current objects and their older versions" },
+          "max_objects": { "type": "integer" },
+          "max_object_size": { "type": "integer" }
+        }
+      },
+      "LifecycleRule": {
+        "type": "object",
+        "properties": {
+          "id": { "type": "string", "description": "unique within the bucket; numbered if empty" },
+          "prefix": { "type": "string", "description": "keys the rule applies to; empty for the whole bucket" },
+          "enabled": { "type": "boolean", "default": true },
+          "expiration_days": { "type": "integer", "description": "delete objects written more than this many days ago, and older versions and delete markers that were superseded more than this many days ago" },
+          "keep_newest": { "type": "integer", "description": "delete all but the newest N objects" },
+          "abort_incomplete_upload_days": { "type": "integer", "description": "abort multipart and tus uploads started more than this many days ago" }
+        }
       }
     }
   },
@@ -127,18 +149,51 @@ func GetOpenAPISpec() []byte {
           { "name": "name", "in": "path", "required": true, "schema": { "type": "string" } }
         ],
         "responses": {
-          "200": { "description": "bucket" },
+          "200": { "description": "bucket, including its lifecycle_rules, quota and usage" },
+          "404": { "description": "not found" }
+        }
+      },
+      "patch": {
+        "summary": "Change bucket settings",
+        "parameters": [
+          { "name": "name", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "versioning": { "type": "boolean", "description": "keep replaced and deleted objects as older versions" },
+                  "lifecycle_rules": {
+                    "type": "array",
+                    "maxItems": 100,
+                    "items": { "$ref": "#/components/schemas/LifecycleRule" },
+                    "description": "replaces all lifecycle rules of the bucket"
+                  },
+                  "quota": { "$ref": "#/components/schemas/BucketQuota" },
+                  "compression": { "type": "string", "enum": ["", "gzip"], "description": "store new objects with a text-like content type gzip compressed; empty turns it off" }
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": { "description": "updated bucket" },
+          "400": { "description": "invalid lifecycle rules, quota or compression" },
           "404": { "description": "not found" }
         }
       },
       "delete": {
         "summary": "Delete bucket by name",
         "parameters": [
-          { "name": "name", "in": "path", "required": true, "schema": { "type": "string" } }
+          { "name": "name", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "force", "in": "query", "required": false, "schema": { "type": "boolean" }, "description": "also delete all objects, versions and unfinished uploads" }
         ],
         "responses": {
           "204": { "description": "deleted" },
-          "409": { "description": "bucket not empty" }
+          "409": { "description": "bucket not empty and force not set" }
         }
       }
     },
@@ -178,11 +233,243 @@ func GetOpenAPISpec() []byte {
     "/{bucketName}": {
       "get": {
         "summary": "List objects in a bucket",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "versions", "in": "query", "required": false, "schema": { "type": "boolean" }, "allowEmptyValue": true, "description": "list every version and delete marker, newest first per key" },
+          { "name": "prefix", "in": "query", "required": false, "schema": { "type": "string" }, "description": "only list keys starting with this prefix" },
+          { "name": "key_marker", "in": "query", "required": false, "schema": { "type": "string" }, "description": "with versions: next_key_marker of the previous page" },
+          { "name": "version_id_marker", "in": "query", "required": false, "schema": { "type": "string" }, "description": "with versions: next_version_id_marker of the previous page; requires key_marker" },
+          { "name": "delimiter", "in": "query", "required": false, "schema": { "type": "string" }, "example": "/", "description": "roll keys containing the delimiter after the prefix up into common_prefixes" },
+          { "name": "start_after", "in": "query", "required": false, "schema": { "type": "string" }, "description": "only list keys after this one" },
+          { "name": "continuation_token", "in": "query", "required": false, "schema": { "type": "string" }, "description": "next_continuation_token of the previous page" },
+          { "name": "max_keys", "in": "query", "required": false, "schema": { "type": "integer", "minimum": 1, "maximum": 1000, "default": 1000 } },
+          { "name": "tag", "in": "query", "required": false, "schema": { "type": "array", "items": { "type": "string" } }, "style": "form", "explode": true, "description": "name:value; only list objects carrying this tag" }
+        ],
+        "responses": {
+          "200": { "description": "array of all objects; with any of prefix, delimiter, start_after, continuation_token max_keys or tag an object with objects, common_prefixes, is_truncated and next_continuation_token. With versions, an array of all versions; with any of prefix, key_marker, version_id_marker or max_keys an object with versions, is_truncated, next_key_marker and next_version_id_marker" },
+          "400": { "description": "invalid max_keys, continuation token or tag filter, or version_id_marker without key_marker" }
+        }
+      }
+    },
+
+    "/{bucketName}/presign": {
+      "post": {
+        "summary": "Create a presigned URL for one object",
+        "description": "The returned URL grants GET (and HEAD) on /{bucketName}/content/{objectKey}, or PUT on /{bucketName}/{objectKey}, without an Authorization header until it expires. PUT links need a readWrite or all key.",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "method": { "type": "string", "enum": ["GET", "PUT"], "default": "GET" },
+                  "object_key": { "type": "string" },
+                  "expires_in": { "type": "integer", "default": 3600, "maximum": 604800, "description": "seconds" },
+                  "version_id": { "type": "string", "description": "GET only" },
+                  "content_type": { "type": "string", "description": "PUT only; required Content-Type of the upload" },
+                  "max_size": { "type": "integer", "description": "PUT only; largest accepted upload in bytes" }
+                },
+                "required": ["object_key"]
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": { "description": "url, method and expires_at" },
+          "400": { "description": "invalid request" },
+          "403": { "description": "the key may not create PUT links" }
+        }
+      }
+    },
+
+    "/{bucketName}/copy": {
+      "post": {
+        "summary": "Copy an object into a bucket",
+        "description": "Copies an object, or one version of it, to destination_key in {bucketName} along with its content type, metadata and tags. The content is linked or copied on the server. Only the admin may name a different source_bucket. If-Match / If-None-Match apply to the destination.",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "source_bucket": { "type": "string", "description": "defaults to {bucketName}" },
+                  "source_key": { "type": "string" },
+                  "version_id": { "type": "string" },
+                  "destination_key": { "type": "string" }
+                },
+                "required": ["source_key", "destination_key"]
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": { "description": "object created" },
+          "403": { "description": "no access to the source bucket" },
+          "404": { "description": "source not found" },
+          "412": { "description": "If-Match / If-None-Match precondition failed" },
+          "413": { "description": "object larger than the bucket's max_object_size" },
+          "507": { "description": "bucket quota exceeded" }
+        }
+      }
+    },
+
+    "/{bucketName}/move": {
+      "post": {
+        "summary": "Move or rename an object or a prefix",
+        "description": "Moves source_key to destination_key, or every object under source_prefix to destination_prefix, into {bucketName}. The source is removed like a DELETE, leaving a delete marker in buckets with versioning. Only the admin may name a different source_bucket.",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "source_bucket": { "type": "string", "description": "defaults to {bucketName}" },
+                  "source_key": { "type": "string" },
+                  "destination_key": { "type": "string" },
+                  "source_prefix": { "type": "string" },
+                  "destination_prefix": { "type": "string" }
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": { "description": "prefix moved; returns the number of objects moved" },
+          "201": { "description": "object moved" },
+          "400": { "description": "invalid request, or source and destination are the same" },
+          "403": { "description": "no access to the source bucket" },
+          "404": { "description": "source not found" },
+          "412": { "description": "If-Match / If-None-Match precondition failed" },
+          "413": { "description": "object larger than the bucket's max_object_size" },
+          "507": { "description": "bucket quota exceeded" }
+        }
+      }
+    },
+
+    "/{bucketName}/delete": {
+      "post": {
+        "summary": "Delete up to 1000 objects",
+        "description": "Each entry is deleted like DELETE /{bucketName}/{key}; the response lists the outcome per key.",
         "parameters": [
           { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } }
         ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "objects": {
+                    "type": "array",
+                    "maxItems": 1000,
+                    "items": {
+                      "type": "object",
+                      "properties": {
+                        "key": { "type": "string" },
+                        "version_id": { "type": "string" }
+                      },
+                      "required": ["key"]
+                    }
+                  }
+                },
+                "required": ["objects"]
+              }
+            }
+          }
+        },
         "responses": {
-          "200": { "description": "array of objects" }
+          "200": { "description": "results: key, version_id, deleted, delete_marker_version_id and error per entry" },
+          "400": { "description": "invalid request or too many objects" }
+        }
+      }
+    },
+
+    "/{bucketName}/delete-prefix": {
+      "post": {
+        "summary": "Delete all objects under a prefix in the background",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "prefix": { "type": "string", "description": "empty string for the whole bucket" }
+                },
+                "required": ["prefix"]
+              }
+            }
+          }
+        },
+        "responses": {
+          "202": { "description": "job started; the Location header points to its status" },
+          "400": { "description": "prefix missing" }
+        }
+      }
+    },
+
+    "/{bucketName}/jobs/{jobId}": {
+      "get": {
+        "summary": "Get the status of a background job",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "jobId", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": { "description": "id, kind, prefix, status (running, succeeded or failed), processed and error" },
+          "404": { "description": "job not found" }
+        }
+      }
+    },
+
+    "/presign/rotate": {
+      "post": {
+        "summary": "Revoke all presigned URLs",
+        "description": "Replaces the salt the presign signing key is derived from. Admin only.",
+        "responses": {
+          "204": { "description": "key rotated" }
+        }
+      }
+    },
+
+    "/fsck": {
+      "post": {
+        "summary": "Check objects against their stored content",
+        "description": "Checks that the content of every object and older version exists and matches its size and checksums, and looks for stored files nothing references (older than an hour). With repair, objects with a problem are marked corrupt and no longer served, marks of objects found intact again are cleared and unreferenced files are deleted. Admin only.",
+        "parameters": [
+          { "name": "repair", "in": "query", "required": false, "schema": { "type": "boolean" } }
+        ],
+        "responses": {
+          "200": { "description": "report: objects checked, unverified (encrypted with a customer key), problems and orphans" },
+          "409": { "description": "fsck is already running" }
+        }
+      }
+    },
+
+    "/backup": {
+      "post": {
+        "summary": "Back up the database and object content",
+        "description": "Streams a gzipped tar archive holding manifest.json, a snapshot of the SQLite database and every stored file it references, below blobs/. Files deleted while the backup runs are kept until it has finished. The server secret key and master keys are not included. Restore with buckitup restore. Admin only.",
+        "responses": {
+          "200": { "description": "backup archive", "content": { "application/gzip": { "schema": { "type": "string", "format": "binary" } } } },
+          "409": { "description": "a backup is already running" },
+          "501": { "description": "the metadata is kept in PostgreSQL" }
         }
       }
     },
@@ -203,7 +490,213 @@ func GetOpenAPISpec() []byte {
         },
         "responses": {
           "201": { "description": "object created" },
-          "409": { "description": "object already exists" }
+          "412": { "description": "If-Match / If-None-Match precondition failed" },
+          "413": { "description": "object larger than the bucket's max_object_size" },
+          "507": { "description": "bucket quota exceeded" }
+        }
+      }
+    },
+
+    "/{bucketName}/multipart": {
+      "post": {
+        "summary": "Start a multipart upload",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "object_key": { "type": "string" },
+                  "content_type": { "type": "string" },
+                  "metadata": { "type": "object", "additionalProperties": { "type": "string" } },
+                  "tags": { "type": "object", "additionalProperties": { "type": "string" } }
+                },
+                "required": ["object_key"]
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": { "description": "upload created; upload_id identifies it in the following requests" },
+          "400": { "description": "invalid object key or attributes, or X-Server-Side-Encryption-Customer-* headers, which multipart uploads do not support" }
+        }
+      },
+      "get": {
+        "summary": "List unfinished multipart uploads",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": { "description": "array of uploads" }
+        }
+      }
+    },
+
+    "/{bucketName}/multipart/{uploadId}": {
+      "get": {
+        "summary": "Get a multipart upload and its parts",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "uploadId", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": { "description": "upload with parts" },
+          "404": { "description": "upload not found" }
+        }
+      },
+      "delete": {
+        "summary": "Abort a multipart upload",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "uploadId", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "204": { "description": "aborted" },
+          "404": { "description": "upload not found" }
+        }
+      }
+    },
+
+    "/{bucketName}/multipart/{uploadId}/{partNumber}": {
+      "put": {
+        "summary": "Upload one part (raw body); uploading the same part number again replaces it",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "uploadId", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "partNumber", "in": "path", "required": true, "schema": { "type": "integer", "minimum": 1, "maximum": 10000 } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/octet-stream": {}
+          }
+        },
+        "responses": {
+          "200": { "description": "part stored; etag is the hex MD5 of the part" },
+          "400": { "description": "checksum mismatch, or X-Server-Side-Encryption-Customer-* headers" },
+          "404": { "description": "upload not found" },
+          "409": { "description": "the upload is being completed" }
+        }
+      }
+    },
+
+    "/{bucketName}/multipart/{uploadId}/complete": {
+      "post": {
+        "summary": "Assemble the listed parts into an object",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "uploadId", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "parts": {
+                    "type": "array",
+                    "items": {
+                      "type": "object",
+                      "properties": {
+                        "part_number": { "type": "integer" },
+                        "etag": { "type": "string" }
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": { "description": "object created" },
+          "400": { "description": "parts missing, out of order or with wrong etag, or X-Server-Side-Encryption-Customer-* headers" },
+          "404": { "description": "upload not found" },
+          "409": { "description": "the upload is already being completed" },
+          "412": { "description": "If-Match / If-None-Match precondition failed" }
+        }
+      }
+    },
+
+    "/{bucketName}/tus/": {
+      "options": {
+        "summary": "tus protocol discovery (versions and extensions)",
+        "security": [],
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "204": { "description": "Tus-Version and Tus-Extension headers" }
+        }
+      },
+      "post": {
+        "summary": "Create a tus resumable upload",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "Tus-Resumable", "in": "header", "required": true, "schema": { "type": "string", "example": "1.0.0" } },
+          { "name": "Upload-Length", "in": "header", "required": true, "schema": { "type": "integer" } },
+          { "name": "Upload-Metadata", "in": "header", "required": true, "schema": { "type": "string" }, "description": "Must contain object_key (or filename); content_type (or filetype) is optional" }
+        ],
+        "responses": {
+          "201": { "description": "upload created; its URL is in the Location header" },
+          "400": { "description": "invalid Upload-Length or Upload-Metadata, or X-Server-Side-Encryption-Customer-* headers, which tus uploads do not support" },
+          "412": { "description": "If-Match / If-None-Match precondition failed" }
+        }
+      }
+    },
+
+    "/{bucketName}/tus/{uploadId}": {
+      "head": {
+        "summary": "Get the offset of a tus upload",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "uploadId", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": { "description": "Upload-Offset and Upload-Length headers; an upload with all its data whose object could not be created before is finished first" },
+          "404": { "description": "upload not found" },
+          "413": { "description": "finishing the upload: object larger than the bucket's max_object_size; the upload was discarded" },
+          "500": { "description": "finishing the upload failed; it is kept and retried by the next HEAD or PATCH" },
+          "507": { "description": "finishing the upload: bucket quota exceeded; the upload was discarded" },
+          "410": { "description": "upload expired" }
+        }
+      },
+      "patch": {
+        "summary": "Append data to a tus upload; the object is created once the upload is complete",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "uploadId", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "Upload-Offset", "in": "header", "required": true, "schema": { "type": "integer" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/offset+octet-stream": {}
+          }
+        },
+        "responses": {
+          "204": { "description": "data appended; new offset in Upload-Offset. A PATCH without data at the final offset retries creating the object" },
+          "400": { "description": "invalid Upload-Offset, or X-Server-Side-Encryption-Customer-* headers" },
+          "409": { "description": "Upload-Offset does not match" },
+          "413": { "description": "finishing the upload: object larger than the bucket's max_object_size; the upload was discarded" },
+          "423": { "description": "another request is writing to this upload" },
+          "500": { "description": "writing or finishing the upload failed; a finished upload is kept so that the object can be created by a retry" },
+          "507": { "description": "finishing the upload: bucket quota exceeded; the upload was discarded" }
+        }
+      },
+      "delete": {
+        "summary": "Terminate a tus upload",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "uploadId", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "204": { "description": "terminated" }
         }
       }
     },
@@ -213,7 +706,8 @@ func GetOpenAPISpec() []byte {
         "summary": "Get object (metadata + base64 content)",
         "parameters": [
           { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
-          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" }, "description": "Object key; may include slashes" }
+          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" }, "description": "Object key; may include slashes" },
+          { "name": "versionId", "in": "query", "required": false, "schema": { "type": "string" }, "description": "read this version instead of the current one" }
         ],
         "responses": {
           "200": { "description": "object with base64 content" },
@@ -227,10 +721,64 @@ func GetOpenAPISpec() []byte {
         "summary": "Get object metadata only",
         "parameters": [
           { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
-          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" } }
+          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "versionId", "in": "query", "required": false, "schema": { "type": "string" }, "description": "read this version instead of the current one" }
+        ],
+        "responses": {
+          "200": { "description": "object metadata, including user metadata and tags" },
+          "404": { "description": "not found" }
+        }
+      }
+    },
+
+    "/{bucketName}/tags/{objectKey}": {
+      "get": {
+        "summary": "Get the tags of an object",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "versionId", "in": "query", "required": false, "schema": { "type": "string" } }
         ],
         "responses": {
-          "200": { "description": "object metadata" },
+          "200": { "description": "{\"tags\": {...}}" },
+          "404": { "description": "not found" }
+        }
+      },
+      "put": {
+        "summary": "Replace the tags of an object",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "versionId", "in": "query", "required": false, "schema": { "type": "string" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "tags": { "type": "object", "additionalProperties": { "type": "string" } }
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": { "description": "tags stored" },
+          "400": { "description": "more than 10 tags, or a key or value too long" },
+          "404": { "description": "not found" }
+        }
+      },
+      "delete": {
+        "summary": "Remove all tags of an object",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "versionId", "in": "query", "required": false, "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "204": { "description": "tags removed" },
           "404": { "description": "not found" }
         }
       }
@@ -239,23 +787,61 @@ func GetOpenAPISpec() []byte {
     "/{bucketName}/content/{objectKey}": {
       "get": {
         "summary": "Get object raw content (streamed)",
+        "description": "Supports Range requests (including multiple ranges), If-Range, If-None-Match and If-Modified-Since. The ETag is the object's checksum and Last-Modified its creation time. Objects stored compressed are sent as stored, with Content-Encoding and the ETag suffixed with -gzip, if Accept-Encoding allows it and no Range is given. HEAD is supported as well.",
         "parameters": [
           { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
-          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" } }
+          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "Range", "in": "header", "required": false, "schema": { "type": "string" }, "example": "bytes=0-1023" },
+          { "name": "If-None-Match", "in": "header", "required": false, "schema": { "type": "string" } },
+          { "name": "If-Modified-Since", "in": "header", "required": false, "schema": { "type": "string" } },
+          { "name": "versionId", "in": "query", "required": false, "schema": { "type": "string" }, "description": "read this version instead of the current one" },
+          { "name": "X-Server-Side-Encryption-Customer-Key", "in": "header", "required": false, "schema": { "type": "string" }, "description": "base64 key the object was uploaded with, together with X-Server-Side-Encryption-Customer-Algorithm: AES256" }
         ],
         "responses": {
           "200": { "description": "raw content" },
-          "404": { "description": "not found" }
+          "206": { "description": "partial content" },
+          "304": { "description": "not modified" },
+          "400": { "description": "object is encrypted with a customer key that was not given" },
+          "403": { "description": "customer key does not match" },
+          "404": { "description": "not found" },
+          "416": { "description": "range not satisfiable" }
         }
       }
     },
 
     "/{bucketName}/{objectKey}": {
+      "put": {
+        "summary": "Upload an object by streaming the raw request body",
+        "description": "The body is written to disk as it arrives. Content-Type is stored as the object's content type and Content-Length, when present, must match the body. An existing object with the same key is replaced atomically.",
+        "parameters": [
+          { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" }, "description": "Object key; may include slashes" },
+          { "name": "If-None-Match", "in": "header", "required": false, "schema": { "type": "string" }, "description": "* to only create the object if the key is free" },
+          { "name": "If-Match", "in": "header", "required": false, "schema": { "type": "string" }, "description": "only replace the object if its current ETag matches" },
+          { "name": "X-Tags", "in": "header", "required": false, "schema": { "type": "string" }, "description": "URL encoded tags, e.g. env=prod&team=web; X-Meta-* headers are stored as user metadata" },
+          { "name": "X-Server-Side-Encryption-Customer-Key", "in": "header", "required": false, "schema": { "type": "string" }, "description": "base64 of a 32 byte key to encrypt the object with instead of the master key, together with X-Server-Side-Encryption-Customer-Algorithm: AES256 and optionally X-Server-Side-Encryption-Customer-Key-MD5" }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/octet-stream": {}
+          }
+        },
+        "responses": {
+          "201": { "description": "object created" },
+          "400": { "description": "body could not be read or did not match Content-Length, or the key starts with the reserved prefix tags/, multipart/ or tus/" },
+          "412": { "description": "If-Match / If-None-Match precondition failed" },
+          "413": { "description": "object larger than the bucket's max_object_size" },
+          "507": { "description": "bucket quota exceeded" }
+        }
+      },
       "delete": {
         "summary": "Delete an object",
+        "description": "In a versioned bucket the object is hidden behind a delete marker unless versionId is given, which removes that version for good.",
         "parameters": [
           { "name": "bucketName", "in": "path", "required": true, "schema": { "type": "string" } },
-          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" } }
+          { "name": "objectKey", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "versionId", "in": "query", "required": false, "schema": { "type": "string" } }
         ],
         "responses": {
           "204": { "description": "deleted" },
@@ -0,0 +1,255 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	nethttp "net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"buck_It_Up/internal/models"
+)
+
+// Presigned URLs grant a single method on a single object until they expire,
+// without an access key. The URL's query carries the expiry, any constraints
+// and an HMAC-SHA256 signature over the method, path and the rest of the
+// query. The signing key is derived from the server key and a random salt
+// kept in the settings table; rotating the salt revokes every URL issued so
+// far.
+
+const (
+	presignSaltSetting   = "presign_salt"
+	defaultPresignExpiry = time.Hour
+)
+
+func newPresignSalt() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// presignKey returns the current signing key, creating the salt on first use.
+func (r *Router) presignKey(ctx context.Context) ([]byte, error) {
+	store := r.settings
+	salt, err := store.GetSetting(ctx, presignSaltSetting)
+	if err == sql.ErrNoRows {
+		if salt, err = newPresignSalt(); err != nil {
+			return nil, err
+		}
+		salt, err = store.InitSetting(ctx, presignSaltSetting, salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, r.secretKey)
+	mac.Write([]byte("presign:" + salt))
+	return mac.Sum(nil), nil
+}
+
+// presignSignature signs a request for path. HEAD requests use the signature
+// of GET. q must not contain the signature itself.
+func presignSignature(key []byte, method, path string, q url.Values) string {
+	if method == nethttp.MethodHead {
+		method = nethttp.MethodGet
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method + "\n" + path + "\n" + q.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// PresignedAuthMiddleware lets requests through that carry a valid presigned
+// URL signature instead of an Authorization header. All other requests are
+// checked by AuthMiddleware(level).
+func (r *Router) PresignedAuthMiddleware(level AuthLevel) func(nethttp.Handler) nethttp.Handler {
+	return func(next nethttp.Handler) nethttp.Handler {
+		authed := r.AuthMiddleware(level)(next)
+		return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, req *nethttp.Request) {
+			q := req.URL.Query()
+			if !q.Has("signature") || req.Header.Get("Authorization") != "" {
+				authed.ServeHTTP(w, req)
+				return
+			}
+
+			signature := q.Get("signature")
+			q.Del("signature")
+			expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+			if err != nil {
+				nethttp.Error(w, "invalid presigned url", nethttp.StatusForbidden)
+				return
+			}
+			ctx := req.Context()
+			key, err := r.presignKey(ctx)
+			if err != nil {
+				nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+				return
+			}
+			expected := presignSignature(key, req.Method, req.URL.Path, q)
+			if !hmac.Equal([]byte(signature), []byte(expected)) {
+				nethttp.Error(w, "invalid signature", nethttp.StatusForbidden)
+				return
+			}
+			if time.Now().Unix() > expires {
+				nethttp.Error(w, "presigned url expired", nethttp.StatusForbidden)
+				return
+			}
+
+			role := models.RoleReadOnly
+			if req.Method == nethttp.MethodPut {
+				role = models.RoleReadWrite
+				if ct := q.Get("content_type"); ct != "" && strings.TrimSpace(req.Header.Get("Content-Type")) != ct {
+					nethttp.Error(w, "content type does not match presigned url", nethttp.StatusForbidden)
+					return
+				}
+				if v := q.Get("max_size"); v != "" {
+					maxSize, _ := strconv.ParseInt(v, 10, 64)
+					if req.ContentLength > maxSize {
+						nethttp.Error(w, "content too large", nethttp.StatusRequestEntityTooLarge)
+						return
+					}
+					req.Body = nethttp.MaxBytesReader(w, req.Body, maxSize)
+				}
+			}
+
+			bucket, ok := r.bucketFromPath(w, req)
+			if !ok {
+				return
+			}
+			ctx = SetAuthContext(ctx, &AuthContext{
+				KeyID:    "presigned",
+				BucketID: bucket.ID,
+				Role:     role,
+			})
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+// createPresignedURL mints a presigned URL for an object in the bucket. Keys
+// may only hand out the access they have themselves.
+func (r *Router) createPresignedURL(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	var body struct {
+		Method      string `json:"method"`
+		ObjectKey   string `json:"object_key"`
+		ExpiresIn   int64  `json:"expires_in"`
+		VersionID   string `json:"version_id"`
+		ContentType string `json:"content_type"`
+		MaxSize     int64  `json:"max_size"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		nethttp.Error(w, "invalid json", nethttp.StatusBadRequest)
+		return
+	}
+	objectKey := strings.TrimSpace(body.ObjectKey)
+	if objectKey == "" || strings.Contains(objectKey, "\x00") {
+		nethttp.Error(w, "invalid object key", nethttp.StatusBadRequest)
+		return
+	}
+	expiresIn := defaultPresignExpiry
+	if body.ExpiresIn != 0 {
+		expiresIn = time.Duration(body.ExpiresIn) * time.Second
+	}
+	if expiresIn <= 0 || expiresIn > maxPresignExpiry {
+		nethttp.Error(w, "invalid expires_in", nethttp.StatusBadRequest)
+		return
+	}
+	expiresAt := time.Now().Add(expiresIn).Unix()
+
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expiresAt, 10))
+	method := strings.ToUpper(body.Method)
+	if method == "" {
+		method = nethttp.MethodGet
+	}
+	var path string
+	switch method {
+	case nethttp.MethodGet:
+		if body.ContentType != "" || body.MaxSize != 0 {
+			nethttp.Error(w, "content_type and max_size only apply to PUT", nethttp.StatusBadRequest)
+			return
+		}
+		path = "/" + bucket.Name + "/content/" + objectKey
+		if body.VersionID != "" {
+			q.Set("versionId", body.VersionID)
+		}
+	case nethttp.MethodPut:
+		authCtx, _ := GetAuthContext(req.Context())
+		if authCtx == nil || !hasPermission(authCtx.Role, AuthLevelReadWrite) {
+			nethttp.Error(w, "insufficient permissions", nethttp.StatusForbidden)
+			return
+		}
+		if body.VersionID != "" {
+			nethttp.Error(w, "version_id only applies to GET", nethttp.StatusBadRequest)
+			return
+		}
+		if err := checkNativeObjectKey(objectKey); err != nil {
+			nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+			return
+		}
+		if body.MaxSize < 0 {
+			nethttp.Error(w, "invalid max_size", nethttp.StatusBadRequest)
+			return
+		}
+		path = "/" + bucket.Name + "/" + objectKey
+		if ct := strings.TrimSpace(body.ContentType); ct != "" {
+			q.Set("content_type", ct)
+		}
+		if body.MaxSize > 0 {
+			q.Set("max_size", strconv.FormatInt(body.MaxSize, 10))
+		}
+	default:
+		nethttp.Error(w, "method must be GET or PUT", nethttp.StatusBadRequest)
+		return
+	}
+
+	key, err := r.presignKey(req.Context())
+	if err != nil {
+		log.Printf("load presign key: %v", err)
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	signature := presignSignature(key, method, path, q)
+	q.Set("signature", signature)
+
+	scheme := "http"
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: req.Host, Path: path, RawQuery: q.Encode()}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusOK)
+	_ = json.NewEncoder(w).Encode(struct {
+		URL       string `json:"url"`
+		Method    string `json:"method"`
+		ExpiresAt int64  `json:"expires_at"`
+	}{u.String(), method, expiresAt})
+}
+
+// rotatePresignKey replaces the salt of the presign key, which invalidates
+// every presigned URL issued so far.
+func (r *Router) rotatePresignKey(w nethttp.ResponseWriter, req *nethttp.Request) {
+	salt, err := newPresignSalt()
+	if err == nil {
+		err = r.settings.SetSetting(req.Context(), presignSaltSetting, salt)
+	}
+	if err != nil {
+		log.Printf("rotate presign key: %v", err)
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(nethttp.StatusNoContent)
+}
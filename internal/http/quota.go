@@ -0,0 +1,77 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+
+	"buck_It_Up/internal/models"
+)
+
+// Quotas are enforced when an object row is written (see
+// models.ObjectStore.ReplaceObject), after its content has been staged.
+// uploadLimit is only there to turn away bodies that cannot fit before they
+// fill the disk.
+
+// uploadLimit is the largest body a write may send, and the error reported
+// for larger ones. max is negative if there is no limit.
+type uploadLimit struct {
+	max int64
+	err error
+}
+
+func (l uploadLimit) check(size int64) error {
+	if l.max >= 0 && size > l.max {
+		return l.err
+	}
+	return nil
+}
+
+// uploadLimit works out how large an object written to objectKey may be
+// without breaking the quota of the bucket, counting the object it would
+// replace as freed unless the bucket keeps versions.
+func (r *Router) uploadLimit(ctx context.Context, bucket *models.Bucket, objectKey string) (uploadLimit, error) {
+	q := bucket.Quota
+	l := uploadLimit{max: -1}
+	if q.MaxObjectSize > 0 {
+		l = uploadLimit{q.MaxObjectSize, models.ErrObjectTooLarge}
+	}
+	if q.MaxBytes == 0 && q.MaxObjects == 0 {
+		return l, nil
+	}
+
+	usage, err := r.buckets.GetUsage(ctx, bucket.ID)
+	if err != nil {
+		return l, err
+	}
+	existing, err := r.objects.GetObject(ctx, bucket.ID, objectKey)
+	if err == sql.ErrNoRows {
+		existing = nil
+	} else if err != nil {
+		return l, err
+	}
+	if q.MaxObjects > 0 && existing == nil && usage.Objects >= q.MaxObjects {
+		return uploadLimit{0, models.ErrQuotaExceeded}, nil
+	}
+	if q.MaxBytes > 0 {
+		remaining := q.MaxBytes - usage.Bytes
+		if existing != nil && !bucket.Versioning {
+			remaining += existing.Size
+		}
+		remaining = max(remaining, 0)
+		if l.max < 0 || remaining < l.max {
+			l = uploadLimit{remaining, models.ErrQuotaExceeded}
+		}
+	}
+	return l, nil
+}
+
+// loadBucketDetails fills in the lifecycle rules and usage of b for
+// GET /{name} and PATCH /{name}.
+func (r *Router) loadBucketDetails(ctx context.Context, b *models.Bucket) error {
+	var err error
+	if b.LifecycleRules, err = r.lifecycle.GetRules(ctx, b.ID); err != nil {
+		return err
+	}
+	b.Usage, err = r.buckets.GetUsage(ctx, b.ID)
+	return err
+}
@@ -0,0 +1,237 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"buck_It_Up/internal/models"
+	"buck_It_Up/internal/storage"
+)
+
+// Blobs are written in full before the rows referencing them are committed,
+// so a crash can leave behind partially written blobs and blobs no row
+// references, but not rows referencing blobs that were never written. Rows
+// can still lose their blob if the storage loses data. Reconcile looks for
+// both at startup. As other instances sharing the database may be writing
+// meanwhile, blobs and partial writes younger than reconcileGracePeriod are
+// left alone.
+
+// Values of BUCKITUP_RECONCILE.
+const (
+	ReconcileRepair = "repair"
+	ReconcileReport = "report"
+	ReconcileOff    = "off"
+)
+
+// quarantinePrefix is where blobs that nothing references are moved to
+// instead of being deleted, in case they are still wanted.
+const quarantinePrefix = "quarantine/"
+
+const (
+	// reconcileGracePeriod is how old an unreferenced blob or a partial
+	// write has to be before Reconcile considers it left behind.
+	reconcileGracePeriod = time.Hour
+	// reconcileLeaseTTL bounds how long an instance that died while
+	// reconciling keeps the others from doing so.
+	reconcileLeaseTTL = time.Hour
+)
+
+// ReconcileMode returns what Reconcile does at startup, configured via
+// BUCKITUP_RECONCILE: "repair" (the default), "report" to only log what
+// is found, or "off".
+func ReconcileMode() string {
+	switch v := os.Getenv("BUCKITUP_RECONCILE"); v {
+	case "":
+		return ReconcileRepair
+	case ReconcileRepair, ReconcileReport, ReconcileOff:
+		return v
+	default:
+		log.Printf("invalid BUCKITUP_RECONCILE %q, using %s", v, ReconcileRepair)
+		return ReconcileRepair
+	}
+}
+
+// Reconcile brings the blobs and the database back in line after a crash.
+// Partially written blobs are removed, blobs that nothing references are
+// moved below quarantinePrefix, objects whose blob is missing are moved into
+// lost_objects and multipart parts whose blob is missing are forgotten.
+// Unless repair is set it only logs what it finds. It runs before requests
+// are served; of several instances starting at once only one reconciles,
+// the others skip it.
+func (r *Router) Reconcile(ctx context.Context, repair bool) error {
+	if !r.holdLease(ctx, leaseReconcile, reconcileLeaseTTL) {
+		log.Printf("reconcile: another instance is reconciling, skipping")
+		return nil
+	}
+	defer func() {
+		if err := r.leases.Release(ctx, leaseReconcile, r.instanceID); err != nil {
+			log.Printf("release lease %s: %v", leaseReconcile, err)
+		}
+	}()
+
+	cutoff := time.Now().Add(-reconcileGracePeriod)
+	if repair {
+		if tr, ok := r.blobs.(storage.TempRemover); ok {
+			n, err := tr.RemoveTemp(ctx, cutoff)
+			if err != nil {
+				return fmt.Errorf("remove partially written blobs: %w", err)
+			}
+			if n > 0 {
+				log.Printf("reconcile: removed %d partially written blobs", n)
+			}
+		}
+		r.collectBlobs(ctx)
+	}
+	if err := r.reconcileUnknownBlobs(ctx, repair, cutoff); err != nil {
+		return err
+	}
+	if err := r.reconcileObjects(ctx, repair); err != nil {
+		return err
+	}
+	return r.reconcileParts(ctx, repair)
+}
+
+func (r *Router) reconcileUnknownBlobs(ctx context.Context, repair bool, cutoff time.Time) error {
+	bStore := r.blobRefs
+	for _, prefix := range []string{"buckets/", contentBlobPrefix} {
+		blobs, err := r.blobs.List(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("list blobs: %w", err)
+		}
+		for _, b := range blobs {
+			if !b.ModTime.Before(cutoff) {
+				// Possibly written by an upload whose row is not
+				// committed yet.
+				continue
+			}
+			known, err := bStore.IsKnown(ctx, b.Key)
+			if err != nil {
+				return err
+			}
+			if known {
+				continue
+			}
+			if !repair {
+				log.Printf("reconcile: blob %s is not referenced", b.Key)
+				continue
+			}
+			if err := r.quarantineBlob(ctx, b.Key); err != nil {
+				return fmt.Errorf("quarantine blob %s: %w", b.Key, err)
+			}
+			log.Printf("reconcile: moved unreferenced blob %s to %s", b.Key, quarantinePrefix+b.Key)
+		}
+	}
+	return nil
+}
+
+func (r *Router) quarantineBlob(ctx context.Context, key string) error {
+	if err := storage.Copy(ctx, r.blobs, key, quarantinePrefix+key); err != nil {
+		return err
+	}
+	return r.blobs.Delete(ctx, key)
+}
+
+// blobMissing reports whether the blob under key is gone. Keys that are
+// empty or invalid never had one.
+func (r *Router) blobMissing(ctx context.Context, key string) (bool, error) {
+	if key == "" {
+		return true, nil
+	}
+	_, err := r.blobs.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotExist) || errors.Is(err, storage.ErrInvalidKey) {
+		return true, nil
+	}
+	return false, err
+}
+
+func (r *Router) reconcileObjects(ctx context.Context, repair bool) error {
+	oStore := r.objects
+	checked := 0
+	var missing []*models.Object
+	for _, history := range []bool{false, true} {
+		var after int64
+		for {
+			objs, err := oStore.ListObjectRows(ctx, history, after, maxListKeys)
+			if err != nil {
+				return err
+			}
+			for _, o := range objs {
+				gone, err := r.blobMissing(ctx, o.BlobKey)
+				if err != nil {
+					return fmt.Errorf("stat blob %s: %w", o.BlobKey, err)
+				}
+				if gone {
+					missing = append(missing, o)
+				}
+			}
+			checked += len(objs)
+			if len(objs) < maxListKeys {
+				break
+			}
+			after = objs[len(objs)-1].ID
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if len(missing) == checked {
+		// Rather a storage that is not mounted, or not the one the
+		// database was used with, than every object lost.
+		log.Printf("reconcile: none of the %d objects has its blob; leaving them alone", checked)
+		return nil
+	}
+
+	for _, o := range missing {
+		if !repair {
+			log.Printf("reconcile: blob %s of object %q (bucket %d) is missing", o.BlobKey, o.ObjectKey, o.BucketID)
+			continue
+		}
+		err := oStore.LoseObject(ctx, o, "blob missing")
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("record lost object %q: %w", o.ObjectKey, err)
+		}
+		log.Printf("reconcile: moved object %q (bucket %d) whose blob %s is missing to lost_objects", o.ObjectKey, o.BucketID, o.BlobKey)
+	}
+	return nil
+}
+
+func (r *Router) reconcileParts(ctx context.Context, repair bool) error {
+	mStore := r.multipart
+	uploads, err := mStore.ListUploadsCreatedBefore(ctx, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	for _, u := range uploads {
+		parts, err := mStore.ListParts(ctx, u.UploadID)
+		if err != nil {
+			return err
+		}
+		for _, p := range parts {
+			gone, err := r.blobMissing(ctx, p.BlobKey)
+			if err != nil {
+				return fmt.Errorf("stat blob %s: %w", p.BlobKey, err)
+			}
+			if !gone {
+				continue
+			}
+			if !repair {
+				log.Printf("reconcile: blob %s of part %d of upload %s is missing", p.BlobKey, p.PartNumber, u.UploadID)
+				continue
+			}
+			if err := mStore.DeletePart(ctx, u.UploadID, p.PartNumber, p.BlobKey); err != nil {
+				return err
+			}
+			log.Printf("reconcile: forgot part %d of upload %s whose blob %s is missing", p.PartNumber, u.UploadID, p.BlobKey)
+		}
+	}
+	return nil
+}
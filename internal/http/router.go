@@ -1,22 +1,33 @@
 package http
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
+	"log"
 	nethttp "net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"buck_It_Up/internal/checksum"
+	"buck_It_Up/internal/db"
 	"buck_It_Up/internal/models"
+	"buck_It_Up/internal/secret"
+	"buck_It_Up/internal/storage"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -24,7 +35,34 @@ import (
 
 type Router struct {
 	mux chi.Router
+	s3  chi.Router
 	db  *sql.DB
+	// The stores live as long as the router, so the statements they prepare
+	// are reused by every request.
+	accessKeys *models.AccessKeyStore
+	blobRefs   *models.BlobStore
+	buckets    *models.BucketStore
+	jobs       *models.JobStore
+	leases     *models.LeaseStore
+	lifecycle  *models.LifecycleStore
+	multipart  *models.MultipartStore
+	objects    *models.ObjectStore
+	settings   *models.SettingsStore
+	tus        *models.TusStore
+	// secretKey seals secrets that have to be recoverable, such as the
+	// access key secrets needed to verify AWS Signature V4 requests.
+	secretKey []byte
+	// blobs holds the content of objects and unfinished uploads.
+	blobs storage.Backend
+	// keys wraps the data keys of encrypted objects; nil if no master key
+	// is configured and new objects are stored unencrypted.
+	keys *secret.Keyring
+	// deletes holds back the deletion of blobs while a backup runs.
+	deletes heldDeletes
+	// instanceID names this instance to others sharing the database.
+	instanceID string
+	// runningJobs holds the IDs of the jobs running in this instance.
+	runningJobs sync.Map
 }
 
 const MethodList = "LIST"
@@ -33,63 +71,128 @@ func init() {
 	chi.RegisterMethod(MethodList)
 }
 
-func New(db *sql.DB) *Router {
-	r := &Router{mux: chi.NewRouter(), db: db}
+func New(db *sql.DB, secretKey []byte, blobs storage.Backend, keys *secret.Keyring) *Router {
+	r := &Router{
+		mux:        chi.NewRouter(),
+		db:         db,
+		accessKeys: models.NewAccessKeyStore(db),
+		blobRefs:   models.NewBlobStore(db),
+		buckets:    models.NewBucketStore(db),
+		jobs:       models.NewJobStore(db),
+		leases:     models.NewLeaseStore(db),
+		lifecycle:  models.NewLifecycleStore(db),
+		multipart:  models.NewMultipartStore(db),
+		objects:    models.NewObjectStore(db),
+		settings:   models.NewSettingsStore(db),
+		tus:        models.NewTusStore(db),
+		secretKey:  secretKey,
+		blobs:      blobs,
+		keys:       keys,
+		instanceID: InstanceID(),
+	}
+	r.s3 = r.newS3Router()
 
 	r.mux.Use(middleware.RequestID)
 	r.mux.Use(middleware.RealIP)
 	r.mux.Use(middleware.Logger)
 	r.mux.Use(middleware.Recoverer)
-	r.mux.Use(middleware.Compress(5))
-
-	//Misc routes - no auth required
-	r.mux.Get("/health", r.health)
-	r.mux.Get("/echo", r.echo)
-	r.mux.Get("/openapi.json", r.serveOpenAPI)
-	r.mux.Get("/swagger", r.serveSwaggerUI)
-
-	// UI - auth handled in browser
-	r.mux.Get("/ui/login", r.uiLogin)
-	r.mux.Get("/ui/dashboard", r.uiDashboard)
-	r.mux.Get("/ui/bucket/*", r.uiBucketView)
-	r.mux.Get("/ui/empty.svg", r.uiRandomEmptySVG)
-	r.mux.Get("/ui", func(w nethttp.ResponseWriter, req *nethttp.Request) {
-		nethttp.Redirect(w, req, "/ui/login", nethttp.StatusFound)
-	})
-	r.mux.Get("/ui/", func(w nethttp.ResponseWriter, req *nethttp.Request) {
-		nethttp.Redirect(w, req, "/ui/login", nethttp.StatusFound)
-	})
-
-	r.mux.Group(func(admin chi.Router) {
-		admin.Use(r.AuthMiddleware(AuthLevelAll))
-		admin.MethodFunc(MethodList, "/", r.listBuckets)
-		admin.Post("/", r.createBucket)
-		admin.Get("/{name}/access-keys", r.listAccessKeys)
-		admin.Post("/{name}/access-keys/recreate", r.recreateAccessKey)
-	})
-
-	r.mux.Group(func(readOnly chi.Router) {
-		readOnly.Use(r.AuthMiddleware(AuthLevelReadOnly))
-		readOnly.Get("/{name}", r.getBucketByName)
-	})
-
-	r.mux.Group(func(readOnly chi.Router) {
-		readOnly.Use(r.AuthMiddleware(AuthLevelReadOnly))
-		readOnly.MethodFunc(MethodList, "/{bucketName}", r.listBucketContent)
-		readOnly.Get("/{bucketName}/all/*", r.getObjectByKey)
-		readOnly.Get("/{bucketName}/metadata/*", r.getObjectByKeyOnlyMetadata)
-		readOnly.Get("/{bucketName}/content/*", r.getObjectByKeyOnlyContent)
+	r.mux.Use(r.dispatchS3)
+
+	// Raw object content is not run through the compression middleware so
+	// Content-Length and byte ranges refer to the object's bytes. Objects
+	// stored compressed are sent as stored to clients that accept it.
+	r.mux.Group(func(raw chi.Router) {
+		raw.Use(r.PresignedAuthMiddleware(AuthLevelReadOnly))
+		raw.Get("/{bucketName}/content/*", r.getObjectByKeyOnlyContent)
+		raw.Head("/{bucketName}/content/*", r.getObjectByKeyOnlyContent)
 	})
 
-	r.mux.Group(func(readWrite chi.Router) {
-		readWrite.Use(r.AuthMiddleware(AuthLevelReadWrite))
-		readWrite.Post("/{bucketName}/upload", r.uploadObjectToBucket)
-		readWrite.Delete("/{bucketName}/*", r.deleteObjectByKey)
+	// tus resumable uploads; OPTIONS is the unauthenticated discovery request.
+	r.mux.Options("/{bucketName}/tus/", r.tusOptions)
+	r.mux.Group(func(tus chi.Router) {
+		tus.Use(r.AuthMiddleware(AuthLevelReadWrite))
+		tus.Post("/{bucketName}/tus/", r.tusCreate)
+		tus.Head("/{bucketName}/tus/{uploadID}", r.tusHead)
+		tus.Patch("/{bucketName}/tus/{uploadID}", r.tusPatch)
+		tus.Delete("/{bucketName}/tus/{uploadID}", r.tusDelete)
 	})
 
-	r.mux.Group(func(all chi.Router) {
-		all.Use(r.AuthMiddleware(AuthLevelAll))
-		all.Delete("/{name}", r.deleteBucketByName)
+	r.mux.Group(func(api chi.Router) {
+		api.Use(middleware.Compress(5))
+
+		//Misc routes - no auth required
+		api.Get("/health", r.health)
+		api.Get("/echo", r.echo)
+		api.Get("/openapi.json", r.serveOpenAPI)
+		api.Get("/swagger", r.serveSwaggerUI)
+
+		// UI - auth handled in browser
+		api.Get("/ui/login", r.uiLogin)
+		api.Get("/ui/dashboard", r.uiDashboard)
+		api.Get("/ui/bucket/*", r.uiBucketView)
+		api.Get("/ui/empty.svg", r.uiRandomEmptySVG)
+		api.Get("/ui", func(w nethttp.ResponseWriter, req *nethttp.Request) {
+			nethttp.Redirect(w, req, "/ui/login", nethttp.StatusFound)
+		})
+		api.Get("/ui/", func(w nethttp.ResponseWriter, req *nethttp.Request) {
+			nethttp.Redirect(w, req, "/ui/login", nethttp.StatusFound)
+		})
+
+		api.Group(func(admin chi.Router) {
+			admin.Use(r.AuthMiddleware(AuthLevelAll))
+			admin.MethodFunc(MethodList, "/", r.listBuckets)
+			admin.Post("/", r.createBucket)
+			admin.Post("/presign/rotate", r.rotatePresignKey)
+			admin.Post("/fsck", r.fsckHandler)
+			admin.Post("/backup", r.backupHandler)
+			admin.Get("/{name}/access-keys", r.listAccessKeys)
+			admin.Post("/{name}/access-keys/recreate", r.recreateAccessKey)
+		})
+
+		api.Group(func(readOnly chi.Router) {
+			readOnly.Use(r.AuthMiddleware(AuthLevelReadOnly))
+			readOnly.Get("/{name}", r.getBucketByName)
+		})
+
+		api.Group(func(readOnly chi.Router) {
+			readOnly.Use(r.AuthMiddleware(AuthLevelReadOnly))
+			readOnly.MethodFunc(MethodList, "/{bucketName}", r.listBucketContent)
+			readOnly.Get("/{bucketName}/all/*", r.getObjectByKey)
+			readOnly.Get("/{bucketName}/metadata/*", r.getObjectByKeyOnlyMetadata)
+			readOnly.Get("/{bucketName}/tags/*", r.getObjectTags)
+			readOnly.Post("/{bucketName}/presign", r.createPresignedURL)
+		})
+
+		api.Group(func(readWrite chi.Router) {
+			readWrite.Use(r.AuthMiddleware(AuthLevelReadWrite))
+			readWrite.Post("/{bucketName}/upload", r.uploadObjectToBucket)
+			readWrite.Post("/{bucketName}/copy", r.copyObjectHandler)
+			readWrite.Post("/{bucketName}/move", r.moveObjectHandler)
+			readWrite.Post("/{bucketName}/delete", r.batchDeleteObjects)
+			readWrite.Post("/{bucketName}/delete-prefix", r.deletePrefixHandler)
+			readWrite.Get("/{bucketName}/jobs/{jobID}", r.getJob)
+			readWrite.Post("/{bucketName}/multipart", r.initiateMultipartUpload)
+			readWrite.Get("/{bucketName}/multipart", r.listMultipartUploads)
+			readWrite.Get("/{bucketName}/multipart/{uploadID}", r.listUploadParts)
+			readWrite.Put("/{bucketName}/multipart/{uploadID}/{partNumber}", r.putUploadPart)
+			readWrite.Post("/{bucketName}/multipart/{uploadID}/complete", r.completeMultipartUploadHandler)
+			readWrite.Delete("/{bucketName}/multipart/{uploadID}", r.abortMultipartUploadHandler)
+			readWrite.Put("/{bucketName}/tags/*", r.putObjectTags)
+			readWrite.Delete("/{bucketName}/tags/*", r.deleteObjectTags)
+			readWrite.Delete("/{bucketName}/*", r.deleteObjectByKey)
+		})
+
+		// Raw uploads can also be authorised by a presigned URL.
+		api.Group(func(upload chi.Router) {
+			upload.Use(r.PresignedAuthMiddleware(AuthLevelReadWrite))
+			upload.Put("/{bucketName}/*", r.putObject)
+		})
+
+		api.Group(func(all chi.Router) {
+			all.Use(r.AuthMiddleware(AuthLevelAll))
+			all.Patch("/{name}", r.updateBucket)
+			all.Delete("/{name}", r.deleteBucketByName)
+		})
 	})
 
 	return r
@@ -105,7 +208,19 @@ func (r *Router) listBucketContent(w nethttp.ResponseWriter, req *nethttp.Reques
 		nethttp.Error(w, "invalid bucket name", nethttp.StatusBadRequest)
 		return
 	}
-	store := models.NewObjectStore(r.db)
+	if req.URL.Query().Has("versions") || isPagedListRequest(req) {
+		bucket, ok := r.bucketFromPath(w, req)
+		if !ok {
+			return
+		}
+		if req.URL.Query().Has("versions") {
+			r.listObjectVersions(w, req, bucket)
+		} else {
+			r.listObjectsPage(w, req, bucket)
+		}
+		return
+	}
+	store := r.objects
 	ctx := req.Context()
 	c, err := store.ListObjectsByBucketName(ctx, bucketName)
 	if err != nil {
@@ -128,7 +243,7 @@ func (r *Router) getBucketByName(w nethttp.ResponseWriter, req *nethttp.Request)
 		return
 	}
 
-	store := models.NewBucketStore(r.db)
+	store := r.buckets
 	ctx := req.Context()
 	b, err := store.GetBucketByName(ctx, name)
 	if err != nil {
@@ -139,6 +254,10 @@ func (r *Router) getBucketByName(w nethttp.ResponseWriter, req *nethttp.Request)
 		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
 		return
 	}
+	if err := r.loadBucketDetails(ctx, b); err != nil {
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(nethttp.StatusOK)
@@ -146,13 +265,23 @@ func (r *Router) getBucketByName(w nethttp.ResponseWriter, req *nethttp.Request)
 }
 
 func (r *Router) listBuckets(w nethttp.ResponseWriter, req *nethttp.Request) {
-	store := models.NewBucketStore(r.db)
+	store := r.buckets
 	ctx := req.Context()
 	buckets, err := store.ListBuckets(ctx)
 	if err != nil {
 		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
 		return
 	}
+	usage, err := store.ListUsage(ctx)
+	if err != nil {
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	for _, b := range buckets {
+		if b.Usage = usage[b.ID]; b.Usage == nil {
+			b.Usage = &models.BucketUsage{}
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(nethttp.StatusOK)
 	_ = json.NewEncoder(w).Encode(buckets)
@@ -208,70 +337,94 @@ func (r *Router) createBucket(w nethttp.ResponseWriter, req *nethttp.Request) {
 		nethttp.Error(w, "invalid name", nethttp.StatusBadRequest)
 		return
 	}
-	store := models.NewBucketStore(r.db)
-	ctx := req.Context()
-	bucket := &models.Bucket{Name: name, CreatedAt: time.Now().Unix()}
-	bucketID, err := store.NewBucket(ctx, bucket)
+	bucket, accessKeys, err := r.createBucketWithKeys(req.Context(), name)
 	if err != nil {
-		errMsg := err.Error()
-		if strings.Contains(strings.ToLower(errMsg), "unique") {
+		if errors.Is(err, errBucketExists) {
 			nethttp.Error(w, "bucket exists", nethttp.StatusConflict)
 			return
 		}
-		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		log.Printf("create bucket: %v", err)
+		nethttp.Error(w, "failed to create bucket", nethttp.StatusInternalServerError)
 		return
 	}
+
+	response := struct {
+		*models.BucketResponse
+		AccessKeys []*models.AccessKeyWithSecretResponse `json:"access_keys"`
+	}{
+		BucketResponse: bucket.ToResponse(),
+		AccessKeys:     accessKeys,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusCreated)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+var errBucketExists = errors.New("bucket exists")
+
+// createBucketWithKeys creates a bucket together with one access key per role.
+// If any key cannot be created the bucket is removed again.
+func (r *Router) createBucketWithKeys(ctx context.Context, name string) (*models.Bucket, []*models.AccessKeyWithSecretResponse, error) {
+	store := r.buckets
+	bucket := &models.Bucket{Name: name, CreatedAt: time.Now().Unix()}
+	bucketID, err := store.NewBucket(ctx, bucket)
+	if err != nil {
+		if db.IsUniqueViolation(err) {
+			return nil, nil, errBucketExists
+		}
+		return nil, nil, err
+	}
 	bucket.ID = bucketID
 
-	akStore := models.NewAccessKeyStore(r.db)
 	roles := []models.AccessKeyRole{
 		models.RoleReadOnly,
 		models.RoleReadWrite,
 		models.RoleAll,
 	}
 
-	accessKeys := make([]*models.AccessKeyWithSecretResponse, 0, 3)
-
+	accessKeys := make([]*models.AccessKeyWithSecretResponse, 0, len(roles))
 	for _, role := range roles {
-		keyID, secret, err := r.generateAccessKey()
+		ak, secret, err := r.createAccessKey(ctx, bucketID, role)
 		if err != nil {
 			_ = store.DeleteBucketByName(ctx, name)
-			nethttp.Error(w, "failed to generate access keys", nethttp.StatusInternalServerError)
-			return
+			return nil, nil, fmt.Errorf("create %s access key: %w", role, err)
 		}
+		accessKeys = append(accessKeys, ak.ToResponseWithSecret(secret))
+	}
 
-		secretHash := hashSecret(secret)
+	return bucket, accessKeys, nil
+}
 
-		ak := &models.AccessKey{
-			BucketID:   bucketID,
-			KeyID:      keyID,
-			SecretHash: secretHash,
-			Role:       role,
-			CreatedAt:  time.Now().Unix(),
-		}
+// createAccessKey generates and stores a new key for the bucket and returns it
+// together with its plaintext secret.
+func (r *Router) createAccessKey(ctx context.Context, bucketID int64, role models.AccessKeyRole) (*models.AccessKey, string, error) {
+	keyID, keySecret, err := r.generateAccessKey()
+	if err != nil {
+		return nil, "", err
+	}
 
-		akID, err := akStore.CreateAccessKey(ctx, ak)
-		if err != nil {
-			_ = store.DeleteBucketByName(ctx, name)
-			nethttp.Error(w, "failed to create access keys", nethttp.StatusInternalServerError)
-			return
-		}
-		ak.ID = akID
+	sealed, err := secret.Seal(r.secretKey, []byte(keySecret))
+	if err != nil {
+		return nil, "", err
+	}
 
-		accessKeys = append(accessKeys, ak.ToResponseWithSecret(secret))
+	ak := &models.AccessKey{
+		BucketID:     bucketID,
+		KeyID:        keyID,
+		SecretHash:   hashSecret(keySecret),
+		SecretSealed: sealed,
+		Role:         role,
+		CreatedAt:    time.Now().Unix(),
 	}
 
-	response := struct {
-		*models.BucketResponse
-		AccessKeys []*models.AccessKeyWithSecretResponse `json:"access_keys"`
-	}{
-		BucketResponse: bucket.ToResponse(),
-		AccessKeys:     accessKeys,
+	akID, err := r.accessKeys.CreateAccessKey(ctx, ak)
+	if err != nil {
+		return nil, "", err
 	}
+	ak.ID = akID
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(nethttp.StatusCreated)
-	_ = json.NewEncoder(w).Encode(response)
+	return ak, keySecret, nil
 }
 
 func (r *Router) deleteBucketByName(w nethttp.ResponseWriter, req *nethttp.Request) {
@@ -280,9 +433,10 @@ func (r *Router) deleteBucketByName(w nethttp.ResponseWriter, req *nethttp.Reque
 		nethttp.Error(w, "invalid bucket name", nethttp.StatusBadRequest)
 		return
 	}
-	store := models.NewBucketStore(r.db)
+	store := r.buckets
 	ctx := req.Context()
-	if _, err := store.GetBucketByName(ctx, name); err != nil {
+	bucket, err := store.GetBucketByName(ctx, name)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			nethttp.NotFound(w, req)
 			return
@@ -290,9 +444,29 @@ func (r *Router) deleteBucketByName(w nethttp.ResponseWriter, req *nethttp.Reque
 		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
 		return
 	}
+	if req.URL.Query().Get("force") == "true" {
+		if err := store.DeleteBucketWithContents(ctx, bucket.ID); err != nil {
+			log.Printf("force delete bucket %s: %v", name, err)
+			nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+			return
+		}
+		ctx := context.WithoutCancel(ctx)
+		r.collectBlobs(ctx)
+		r.removeBlobs(ctx, bucketBlobPrefix(bucket.ID))
+		w.WriteHeader(nethttp.StatusNoContent)
+		return
+	}
+	empty, err := r.objects.IsBucketEmpty(ctx, bucket.ID)
+	if err != nil {
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	if !empty {
+		nethttp.Error(w, "bucket not empty", nethttp.StatusConflict)
+		return
+	}
 	if err := store.DeleteBucketByName(ctx, name); err != nil {
-		errMsg := strings.ToLower(err.Error())
-		if strings.Contains(errMsg, "constraint") {
+		if db.IsForeignKeyViolation(err) {
 			nethttp.Error(w, "bucket not empty", nethttp.StatusConflict)
 			return
 		}
@@ -316,7 +490,7 @@ func (r *Router) getObjectByKey(w nethttp.ResponseWriter, req *nethttp.Request)
 	}
 
 	ctx := req.Context()
-	bStore := models.NewBucketStore(r.db)
+	bStore := r.buckets
 	bucket, err := bStore.GetBucketByName(ctx, bucketName)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -326,11 +500,11 @@ func (r *Router) getObjectByKey(w nethttp.ResponseWriter, req *nethttp.Request)
 		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
 		return
 	}
-	fmt.Println("Found Bucket:", bucket)
 
-	oStore := models.NewObjectStore(r.db)
-	obj, err := oStore.GetObject(ctx, bucket.ID, objectKey)
-	fmt.Println("Object:", obj)
+	obj, err := r.getObjectVersion(ctx, bucket.ID, objectKey, req.URL.Query().Get("versionId"))
+	if err == nil {
+		err = r.objects.LoadAttributes(ctx, obj)
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			nethttp.NotFound(w, req)
@@ -340,24 +514,28 @@ func (r *Router) getObjectByKey(w nethttp.ResponseWriter, req *nethttp.Request)
 		return
 	}
 
-	contentPath := obj.FilePath
-	fmt.Println("Trying to read file at path:", contentPath)
-	expectedPrefix := filepath.Join("data", "buckets", strconv.FormatInt(bucket.ID, 10), "objects")
-	normalizedContentPath := filepath.Clean(contentPath)
-	normalizedExpectedPrefix := filepath.Clean(expectedPrefix)
-	if !strings.HasPrefix(normalizedContentPath, normalizedExpectedPrefix) {
-		nethttp.Error(w, "invalid stored path", nethttp.StatusInternalServerError)
+	customerKey, err := customerKeyFromHeaders(req.Header, sseCustomerHeaderPrefix)
+	if err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
 		return
 	}
-	data, err := os.ReadFile(contentPath)
+	f, err := r.openObjectBlob(ctx, obj, customerKey)
+	if err != nil {
+		writeOpenObjectError(w, err)
+		return
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
 	if err != nil {
-		if os.IsNotExist(err) {
-			nethttp.Error(w, "object file missing", nethttp.StatusInternalServerError)
-			return
-		}
 		nethttp.Error(w, "failed to read object", nethttp.StatusInternalServerError)
 		return
 	}
+	if verifyOnRead() {
+		if err := verifyObjectContent(obj, bytes.NewReader(data)); err != nil {
+			nethttp.Error(w, "object content is corrupt", nethttp.StatusInternalServerError)
+			return
+		}
+	}
 
 	resp := struct {
 		*models.Object `json:"object"`
@@ -386,7 +564,7 @@ func (r *Router) getObjectByKeyOnlyMetadata(w nethttp.ResponseWriter, req *netht
 	}
 
 	ctx := req.Context()
-	bStore := models.NewBucketStore(r.db)
+	bStore := r.buckets
 	bucket, err := bStore.GetBucketByName(ctx, bucketName)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -397,8 +575,10 @@ func (r *Router) getObjectByKeyOnlyMetadata(w nethttp.ResponseWriter, req *netht
 		return
 	}
 
-	oStore := models.NewObjectStore(r.db)
-	obj, err := oStore.GetObject(ctx, bucket.ID, objectKey)
+	obj, err := r.getObjectVersion(ctx, bucket.ID, objectKey, req.URL.Query().Get("versionId"))
+	if err == nil {
+		err = r.objects.LoadAttributes(ctx, obj)
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			nethttp.NotFound(w, req)
@@ -427,7 +607,7 @@ func (r *Router) getObjectByKeyOnlyContent(w nethttp.ResponseWriter, req *nethtt
 	}
 
 	ctx := req.Context()
-	bStore := models.NewBucketStore(r.db)
+	bStore := r.buckets
 	bucket, err := bStore.GetBucketByName(ctx, bucketName)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -438,8 +618,10 @@ func (r *Router) getObjectByKeyOnlyContent(w nethttp.ResponseWriter, req *nethtt
 		return
 	}
 
-	oStore := models.NewObjectStore(r.db)
-	obj, err := oStore.GetObject(ctx, bucket.ID, objectKey)
+	obj, err := r.getObjectVersion(ctx, bucket.ID, objectKey, req.URL.Query().Get("versionId"))
+	if err == nil {
+		err = r.objects.LoadAttributes(ctx, obj)
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			nethttp.NotFound(w, req)
@@ -449,22 +631,36 @@ func (r *Router) getObjectByKeyOnlyContent(w nethttp.ResponseWriter, req *nethtt
 		return
 	}
 
-	contentPath := obj.FilePath
-	expectedPrefix := filepath.Join("data", "buckets", strconv.FormatInt(bucket.ID, 10), "objects")
-	normalizedContentPath := filepath.Clean(contentPath)
-	normalizedExpectedPrefix := filepath.Clean(expectedPrefix)
-	if !strings.HasPrefix(normalizedContentPath, normalizedExpectedPrefix) {
-		nethttp.Error(w, "invalid stored path", nethttp.StatusInternalServerError)
+	customerKey, err := customerKeyFromHeaders(req.Header, sseCustomerHeaderPrefix)
+	if err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
 		return
 	}
-	data, err := os.ReadFile(contentPath)
+	raw, err := r.openEncodedObjectBlob(ctx, obj, customerKey)
 	if err != nil {
-		if os.IsNotExist(err) {
-			nethttp.Error(w, "object file missing", nethttp.StatusInternalServerError)
+		writeOpenObjectError(w, err)
+		return
+	}
+	defer raw.Close()
+	var f io.ReadSeeker = raw
+	if obj.Encoding != "" {
+		f = newDecodingReader(raw, obj.Size)
+	}
+
+	if verifyOnRead() {
+		err := verifyObjectContent(obj, f)
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		var mismatch *checksum.MismatchError
+		if errors.As(err, &mismatch) {
+			nethttp.Error(w, "object content is corrupt", nethttp.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			nethttp.Error(w, "failed to read object", nethttp.StatusInternalServerError)
 			return
 		}
-		nethttp.Error(w, "failed to read object", nethttp.StatusInternalServerError)
-		return
 	}
 
 	if obj.ContentType != "" {
@@ -472,8 +668,31 @@ func (r *Router) getObjectByKeyOnlyContent(w nethttp.ResponseWriter, req *nethtt
 	} else {
 		w.Header().Set("Content-Type", "application/octet-stream")
 	}
-	w.WriteHeader(nethttp.StatusOK)
-	_, _ = w.Write(data)
+	etag := obj.Checksum
+	if obj.Encoding != "" {
+		w.Header().Set("Vary", "Accept-Encoding")
+		// A compressed object is sent as stored when the client accepts
+		// its encoding, unless a range of the content is asked for.
+		if req.Header.Get("Range") == "" && acceptsEncoding(req, obj.Encoding) {
+			if _, err := raw.Seek(0, io.SeekStart); err != nil {
+				nethttp.Error(w, "failed to read object", nethttp.StatusInternalServerError)
+				return
+			}
+			f = raw
+			w.Header().Set("Content-Encoding", obj.Encoding)
+			etag += "-" + obj.Encoding
+		}
+	}
+	if obj.Checksum != "" {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+	if obj.VersionID != "" {
+		w.Header().Set("X-Version-Id", obj.VersionID)
+	}
+	setMetadataHeaders(w.Header(), metadataHeaderPrefix, obj.Metadata)
+	// ServeContent handles Range (including multi-range), If-Range,
+	// If-None-Match and If-Modified-Since using the headers set above.
+	nethttp.ServeContent(w, req, "", time.Unix(obj.CreatedAt, 0), f)
 }
 
 func (r *Router) uploadObjectToBucket(w nethttp.ResponseWriter, req *nethttp.Request) {
@@ -484,10 +703,12 @@ func (r *Router) uploadObjectToBucket(w nethttp.ResponseWriter, req *nethttp.Req
 	}
 
 	var body struct {
-		ObjectKey     string `json:"object_key"`
-		Content       string `json:"content"`
-		ContentType   string `json:"content_type"`
-		Base64Encoded bool   `json:"base64_encoded,omitempty"`
+		ObjectKey     string            `json:"object_key"`
+		Content       string            `json:"content"`
+		ContentType   string            `json:"content_type"`
+		Base64Encoded bool              `json:"base64_encoded,omitempty"`
+		Metadata      map[string]string `json:"metadata,omitempty"`
+		Tags          map[string]string `json:"tags,omitempty"`
 	}
 	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
 		nethttp.Error(w, "invalid json", nethttp.StatusBadRequest)
@@ -495,13 +716,13 @@ func (r *Router) uploadObjectToBucket(w nethttp.ResponseWriter, req *nethttp.Req
 	}
 
 	objectKey := strings.TrimSpace(body.ObjectKey)
-	if objectKey == "" || strings.Contains(objectKey, "\x00") {
-		nethttp.Error(w, "invalid object key", nethttp.StatusBadRequest)
+	if err := checkNativeObjectKey(objectKey); err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
 		return
 	}
 
 	ctx := req.Context()
-	bStore := models.NewBucketStore(r.db)
+	bStore := r.buckets
 	bucket, err := bStore.GetBucketByName(ctx, bucketName)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -522,61 +743,87 @@ func (r *Router) uploadObjectToBucket(w nethttp.ResponseWriter, req *nethttp.Req
 	} else {
 		contentBytes = []byte(body.Content)
 	}
-	contentType := strings.TrimSpace(body.ContentType)
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	attrs := objectAttributes{
+		ContentType: strings.TrimSpace(body.ContentType),
+		Metadata:    normalizeMetadata(body.Metadata),
+		Tags:        body.Tags,
+	}
+	if err := attrs.validate(); err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+	if attrs.CustomerKey, err = customerKeyFromHeaders(req.Header, sseCustomerHeaderPrefix); err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
 	}
 
-	checksum := fmt.Sprintf("%d", len(contentBytes))
+	expected, err := expectedChecksums(req)
+	if err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
 
-	obj := &models.Object{
-		BucketID:    bucket.ID,
-		ObjectKey:   objectKey,
-		FilePath:    "",
-		Size:        int64(len(contentBytes)),
-		ContentType: contentType,
-		Checksum:    checksum,
-		CreatedAt:   time.Now().Unix(),
+	obj, err := r.storeObject(ctx, bucket, objectKey, attrs, bytes.NewReader(contentBytes), int64(len(contentBytes)), expected, writeConditionFromRequest(req))
+	if err != nil {
+		r.writeStoreError(w, err)
+		return
 	}
 
-	oStore := models.NewObjectStore(r.db)
-	objectID, err := oStore.PutObject(ctx, obj)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusCreated)
+	_ = json.NewEncoder(w).Encode(obj)
+}
+
+// putObject stores the raw request body under the object key taken from the
+// path. The body is streamed to disk, so uploads are not limited by memory.
+func (r *Router) putObject(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucketName := chi.URLParam(req, "bucketName")
+	if bucketName == "" || strings.Contains(bucketName, "/") {
+		nethttp.Error(w, "invalid bucket name", nethttp.StatusBadRequest)
+		return
+	}
+	objectKey := strings.TrimPrefix(req.URL.Path, "/"+bucketName+"/")
+	objectKey = strings.TrimSpace(objectKey)
+	if err := checkNativeObjectKey(objectKey); err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	bStore := r.buckets
+	bucket, err := bStore.GetBucketByName(ctx, bucketName)
 	if err != nil {
-		errMsg := strings.ToLower(err.Error())
-		if strings.Contains(errMsg, "unique") {
-			nethttp.Error(w, "object already exists", nethttp.StatusConflict)
+		if err == sql.ErrNoRows {
+			nethttp.NotFound(w, req)
 			return
 		}
-		nethttp.Error(w, "failed to create object", nethttp.StatusInternalServerError)
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
 		return
 	}
 
-	obj.ID = objectID
-
-	bucketDir, err := r.ensureBucketObjectsDir(bucket.ID)
+	attrs, err := attributesFromHeaders(req)
 	if err != nil {
-		_ = oStore.DeleteObject(ctx, bucket.ID, objectKey)
-		nethttp.Error(w, "failed to create storage directory", nethttp.StatusInternalServerError)
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
 		return
 	}
 
-	filePath := filepath.Join(bucketDir, strconv.FormatInt(objectID, 10))
-
-	if err := os.WriteFile(filePath, contentBytes, 0o644); err != nil {
-		_ = oStore.DeleteObject(ctx, bucket.ID, objectKey)
-		nethttp.Error(w, "failed to write object file", nethttp.StatusInternalServerError)
+	expected, err := expectedChecksums(req)
+	if err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
 		return
 	}
 
-	obj.FilePath = filePath
-	if err := r.updateObjectFilePath(ctx, objectID, filePath); err != nil {
-		_ = os.Remove(filePath)
-		_ = oStore.DeleteObject(ctx, bucket.ID, objectKey)
-		nethttp.Error(w, "failed to update object metadata", nethttp.StatusInternalServerError)
+	obj, err := r.storeObject(ctx, bucket, objectKey, attrs, req.Body, req.ContentLength, expected, writeConditionFromRequest(req))
+	if err != nil {
+		r.writeStoreError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+obj.Checksum+`"`)
+	if obj.VersionID != "" {
+		w.Header().Set("X-Version-Id", obj.VersionID)
+	}
 	w.WriteHeader(nethttp.StatusCreated)
 	_ = json.NewEncoder(w).Encode(obj)
 }
@@ -595,7 +842,7 @@ func (r *Router) deleteObjectByKey(w nethttp.ResponseWriter, req *nethttp.Reques
 	}
 
 	ctx := req.Context()
-	bStore := models.NewBucketStore(r.db)
+	bStore := r.buckets
 	bucket, err := bStore.GetBucketByName(ctx, bucketName)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -606,37 +853,21 @@ func (r *Router) deleteObjectByKey(w nethttp.ResponseWriter, req *nethttp.Reques
 		return
 	}
 
-	oStore := models.NewObjectStore(r.db)
-	obj, err := oStore.GetObject(ctx, bucket.ID, objectKey)
+	markerID, err := r.deleteObjectVersion(ctx, bucket, objectKey, req.URL.Query().Get("versionId"))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			nethttp.NotFound(w, req)
 			return
 		}
-		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
-		return
-	}
-
-	if obj.FilePath != "" {
-		expectedPrefix := filepath.Join("data", "buckets", strconv.FormatInt(bucket.ID, 10), "objects")
-		normalizedContentPath := filepath.Clean(obj.FilePath)
-		normalizedExpectedPrefix := filepath.Clean(expectedPrefix)
-		if !strings.HasPrefix(normalizedContentPath, normalizedExpectedPrefix) {
-			nethttp.Error(w, "invalid stored path", nethttp.StatusInternalServerError)
-			return
-		}
-
-		if err := os.Remove(obj.FilePath); err != nil && !os.IsNotExist(err) {
-			nethttp.Error(w, "failed to delete object file", nethttp.StatusInternalServerError)
-			return
-		}
-	}
-
-	if err := oStore.DeleteObject(ctx, bucket.ID, objectKey); err != nil {
+		log.Printf("delete object %q: %v", objectKey, err)
 		nethttp.Error(w, "failed to delete object", nethttp.StatusInternalServerError)
 		return
 	}
 
+	if markerID != "" {
+		w.Header().Set("X-Version-Id", markerID)
+		w.Header().Set("X-Delete-Marker", "true")
+	}
 	w.WriteHeader(nethttp.StatusNoContent)
 }
 
@@ -648,7 +879,7 @@ func (r *Router) listAccessKeys(w nethttp.ResponseWriter, req *nethttp.Request)
 	}
 
 	ctx := req.Context()
-	bStore := models.NewBucketStore(r.db)
+	bStore := r.buckets
 	bucket, err := bStore.GetBucketByName(ctx, name)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -659,7 +890,7 @@ func (r *Router) listAccessKeys(w nethttp.ResponseWriter, req *nethttp.Request)
 		return
 	}
 
-	akStore := models.NewAccessKeyStore(r.db)
+	akStore := r.accessKeys
 	accessKeys, err := akStore.ListAccessKeysByBucketID(ctx, bucket.ID)
 	if err != nil {
 		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
@@ -697,7 +928,7 @@ func (r *Router) recreateAccessKey(w nethttp.ResponseWriter, req *nethttp.Reques
 	}
 
 	ctx := req.Context()
-	bStore := models.NewBucketStore(r.db)
+	bStore := r.buckets
 	bucket, err := bStore.GetBucketByName(ctx, name)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -708,57 +939,320 @@ func (r *Router) recreateAccessKey(w nethttp.ResponseWriter, req *nethttp.Reques
 		return
 	}
 
-	akStore := models.NewAccessKeyStore(r.db)
+	akStore := r.accessKeys
 
 	if err := akStore.DeleteAccessKeyByBucketAndRole(ctx, bucket.ID, body.Role); err != nil {
 		nethttp.Error(w, "failed to delete old access key", nethttp.StatusInternalServerError)
 		return
 	}
 
-	keyID, secret, err := r.generateAccessKey()
+	ak, secret, err := r.createAccessKey(ctx, bucket.ID, body.Role)
 	if err != nil {
-		nethttp.Error(w, "failed to generate access key", nethttp.StatusInternalServerError)
+		nethttp.Error(w, "failed to create access key", nethttp.StatusInternalServerError)
 		return
 	}
 
-	secretHash := hashSecret(secret)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusCreated)
+	_ = json.NewEncoder(w).Encode(ak.ToResponseWithSecret(secret))
+}
+
+var (
+	errPreconditionFailed = errors.New("precondition failed")
+	errLengthMismatch     = errors.New("content length mismatch")
+	errBodyRead           = errors.New("failed to read request body")
+)
 
-	ak := &models.AccessKey{
-		BucketID:   bucket.ID,
-		KeyID:      keyID,
-		SecretHash: secretHash,
-		Role:       body.Role,
-		CreatedAt:  time.Now().Unix(),
+// writeCondition holds the If-Match / If-None-Match preconditions of a
+// write. The zero value overwrites unconditionally.
+type writeCondition struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+func writeConditionFromRequest(req *nethttp.Request) writeCondition {
+	return writeCondition{
+		IfMatch:     strings.TrimSpace(req.Header.Get("If-Match")),
+		IfNoneMatch: strings.TrimSpace(req.Header.Get("If-None-Match")),
 	}
+}
+
+// check returns errPreconditionFailed if the object currently stored under
+// the key (nil if there is none) does not satisfy c.
+func (c writeCondition) check(existing *models.Object) error {
+	if c.IfMatch != "" && (existing == nil || !etagListMatches(c.IfMatch, existing)) {
+		return errPreconditionFailed
+	}
+	if c.IfNoneMatch != "" && existing != nil && etagListMatches(c.IfNoneMatch, existing) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// etagListMatches reports whether header, "*" or a list of entity tags,
+// matches obj. Both the SHA-256 ETag of the native API and the MD5 ETag
+// reported to S3 clients are accepted.
+func etagListMatches(header string, obj *models.Object) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+		if tag != "" && (tag == obj.Checksum || tag == obj.ChecksumMD5) {
+			return true
+		}
+	}
+	return false
+}
+
+// objectLocks serialises the check-and-swap step of concurrent writes to the
+// same key, so they queue up instead of failing on a busy database.
+var objectLocks [64]sync.Mutex
+
+func lockObjectKey(bucketID int64, objectKey string) func() {
+	mu := &objectLocks[objectLockIndex(bucketID, objectKey)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func objectLockIndex(bucketID int64, objectKey string) int {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d/%s", bucketID, objectKey)
+	return int(h.Sum32() % uint32(len(objectLocks)))
+}
 
-	akID, err := akStore.CreateAccessKey(ctx, ak)
+// lockObjectKeyPair locks two keys, possibly in different buckets, in a fixed
+// order so that concurrent copies between the same keys cannot deadlock.
+func lockObjectKeyPair(bucketA int64, keyA string, bucketB int64, keyB string) func() {
+	a, b := objectLockIndex(bucketA, keyA), objectLockIndex(bucketB, keyB)
+	if a == b {
+		objectLocks[a].Lock()
+		return objectLocks[a].Unlock
+	}
+	if a > b {
+		a, b = b, a
+	}
+	objectLocks[a].Lock()
+	objectLocks[b].Lock()
+	return func() {
+		objectLocks[b].Unlock()
+		objectLocks[a].Unlock()
+	}
+}
+
+// storeObject streams body into a new blob while computing size and digests
+// and only then inserts the objects row, or swaps the blob of an existing
+// object with the same key and removes the old blob unless the bucket keeps
+// it as an older version. With deduplication enabled the content ends up in
+// the content addressed blob for its digest, which may exist already. If the
+// bucket compresses objects of the content type, the blob is compressed.
+// attrs are expected to be validated already; an empty content type is
+// stored as application/octet-stream. expectedSize is
+// ignored when negative; a digest that does not match expected yields a
+// *checksum.MismatchError and an unmet cond yields errPreconditionFailed.
+func (r *Router) storeObject(ctx context.Context, bucket *models.Bucket, objectKey string, attrs objectAttributes, body io.Reader, expectedSize int64, expected checksum.Expected, cond writeCondition) (*models.Object, error) {
+	oStore := r.objects
+	limit, err := r.uploadLimit(ctx, bucket, objectKey)
 	if err != nil {
-		nethttp.Error(w, "failed to create access key", nethttp.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	if expectedSize >= 0 {
+		if err := limit.check(expectedSize); err != nil {
+			return nil, err
+		}
+	}
+	if limit.max >= 0 {
+		body = io.LimitReader(body, limit.max+1)
+	}
+	if cond != (writeCondition{}) {
+		// Fail early, before reading the body; the check is repeated
+		// atomically when the row is written.
+		existing, err := oStore.GetObject(ctx, bucket.ID, objectKey)
+		if err == sql.ErrNoRows {
+			existing = nil
+		} else if err != nil {
+			return nil, err
+		}
+		if err := cond.check(existing); err != nil {
+			return nil, err
+		}
 	}
-	ak.ID = akID
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(nethttp.StatusCreated)
-	_ = json.NewEncoder(w).Encode(ak.ToResponseWithSecret(secret))
+	name, err := newObjectFileName()
+	if err != nil {
+		return nil, err
+	}
+	blobKey := objectBlobKey(bucket.ID, name)
+	encoding := storageEncoding(bucket, attrs.ContentType)
+	dk, err := r.newDataKey(attrs.CustomerKey)
+	if err != nil {
+		return nil, err
+	}
+	var key []byte
+	if dk != nil {
+		key = dk.key
+	}
+	size, digests, err := r.putBlob(ctx, blobKey, body, encoding, key)
+	if err != nil {
+		return nil, err
+	}
+	err = limit.check(size)
+	if err == nil && expectedSize >= 0 && size != expectedSize {
+		err = errLengthMismatch
+	}
+	if err == nil {
+		err = digests.Verify(expected)
+	}
+	if err != nil {
+		r.removeBlob(blobKey)
+		return nil, err
+	}
+
+	if attrs.ContentType == "" {
+		attrs.ContentType = "application/octet-stream"
+	}
+
+	staged := blobKey
+	// Encrypted objects have a data key of their own, so their content
+	// cannot be shared.
+	if dedupEnabled() && dk == nil {
+		blobKey = contentBlobKey(digests.SHA256)
+		if encoding != "" {
+			// The same content stored compressed is a different blob.
+			blobKey += "." + encoding
+		}
+		defer r.removeBlob(staged)
+	}
+
+	obj := &models.Object{
+		BucketID:       bucket.ID,
+		ObjectKey:      objectKey,
+		BlobKey:        blobKey,
+		Size:           size,
+		ContentType:    attrs.ContentType,
+		Checksum:       digests.SHA256,
+		ChecksumSHA256: digests.SHA256,
+		ChecksumMD5:    digests.MD5,
+		ChecksumCRC32C: digests.CRC32C,
+		Encoding:       encoding,
+		CreatedAt:      time.Now().Unix(),
+		Metadata:       attrs.Metadata,
+		Tags:           attrs.Tags,
+	}
+	if dk != nil {
+		obj.Encryption, obj.KeyID, obj.DataKey = dk.encryption, dk.keyID, dk.wrapped
+	}
+	if bucket.Versioning {
+		if obj.VersionID, err = newVersionID(); err != nil {
+			r.removeBlob(staged)
+			return nil, err
+		}
+	}
+
+	unlock := lockObjectKey(bucket.ID, objectKey)
+	var previous *models.Object
+	if blobKey != staged {
+		unlockBlob := lockBlob(blobKey)
+		err = r.ensureContentBlob(ctx, blobKey, staged)
+		if err == nil {
+			previous, err = oStore.ReplaceObject(ctx, obj, cond.check)
+		}
+		unlockBlob()
+	} else {
+		previous, err = oStore.ReplaceObject(ctx, obj, cond.check)
+	}
+	unlock()
+	if err != nil {
+		r.releaseBlob(context.WithoutCancel(ctx), blobKey)
+		if errors.Is(err, errPreconditionFailed) || errors.Is(err, models.ErrObjectTooLarge) || errors.Is(err, models.ErrQuotaExceeded) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("insert object: %w", err)
+	}
+
+	if previous != nil {
+		r.removeObjectBlob(previous)
+	}
+
+	return obj, nil
+}
+
+// writeStoreError maps an error returned by storeObject to an HTTP response.
+func (r *Router) writeStoreError(w nethttp.ResponseWriter, err error) {
+	var mismatch *checksum.MismatchError
+	var tooLarge *nethttp.MaxBytesError
+	switch {
+	case errors.As(err, &mismatch):
+		nethttp.Error(w, mismatch.Error(), nethttp.StatusBadRequest)
+	case errors.As(err, &tooLarge):
+		// A presigned PUT whose body outgrew its max_size.
+		nethttp.Error(w, "content too large", nethttp.StatusRequestEntityTooLarge)
+	case errors.Is(err, errPreconditionFailed):
+		nethttp.Error(w, "precondition failed", nethttp.StatusPreconditionFailed)
+	case errors.Is(err, errLengthMismatch):
+		nethttp.Error(w, "content length mismatch", nethttp.StatusBadRequest)
+	case errors.Is(err, errBodyRead):
+		nethttp.Error(w, "failed to read request body", nethttp.StatusBadRequest)
+	case errors.Is(err, models.ErrObjectTooLarge):
+		nethttp.Error(w, err.Error(), nethttp.StatusRequestEntityTooLarge)
+	case errors.Is(err, models.ErrQuotaExceeded):
+		nethttp.Error(w, err.Error(), nethttp.StatusInsufficientStorage)
+	default:
+		log.Printf("store object: %v", err)
+		nethttp.Error(w, "failed to store object", nethttp.StatusInternalServerError)
+	}
 }
 
-func (r *Router) ensureBucketObjectsDir(bucketID int64) (string, error) {
-	dataRoot := "data"
-	if dr := os.Getenv("BUCKITUP_DATA_PATH"); dr != "" {
-		dataRoot = dr
+// expectedChecksums reads the digests a client may send along with an upload:
+// Content-MD5 (base64, RFC 1864), X-Checksum-Sha256 and X-Checksum-Crc32c
+// (hex or base64).
+func expectedChecksums(req *nethttp.Request) (checksum.Expected, error) {
+	var exp checksum.Expected
+	var err error
+	if exp.MD5, err = checksum.Normalize(req.Header.Get("Content-MD5"), md5.Size); err != nil {
+		return exp, fmt.Errorf("invalid Content-MD5 header")
+	}
+	if exp.SHA256, err = checksum.Normalize(req.Header.Get("X-Checksum-Sha256"), sha256.Size); err != nil {
+		return exp, fmt.Errorf("invalid X-Checksum-Sha256 header")
 	}
-	p := filepath.Join(dataRoot, "buckets", strconv.FormatInt(bucketID, 10), "objects")
-	return p, os.MkdirAll(p, 0o755)
+	if exp.CRC32C, err = checksum.Normalize(req.Header.Get("X-Checksum-Crc32c"), crc32.Size); err != nil {
+		return exp, fmt.Errorf("invalid X-Checksum-Crc32c header")
+	}
+	return exp, nil
 }
 
-func (r *Router) updateObjectFilePath(ctx context.Context, objectID int64, filePath string) error {
-	_, err := r.db.ExecContext(ctx, `
-		UPDATE objects
-		SET file_path = ?
-		WHERE id = ?
-	`, filePath, objectID)
-	return err
+// verifyOnRead reports whether object content should be checked against its
+// stored SHA-256 before it is served.
+func verifyOnRead() bool {
+	v, _ := strconv.ParseBool(os.Getenv("BUCKITUP_VERIFY_ON_READ"))
+	return v
+}
+
+// verifyObjectContent hashes content and compares it with the object's stored
+// SHA-256. Objects stored before digests were recorded are not checked.
+func verifyObjectContent(obj *models.Object, content io.Reader) error {
+	if obj.ChecksumSHA256 == "" {
+		return nil
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, content); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hasher.Sum(nil)); got != obj.ChecksumSHA256 {
+		log.Printf("object %d (bucket %d, key %q) is corrupt: sha256 %s, expected %s",
+			obj.ID, obj.BucketID, obj.ObjectKey, got, obj.ChecksumSHA256)
+		return &checksum.MismatchError{Algorithm: "sha256"}
+	}
+	return nil
+}
+
+func newObjectFileName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func (r *Router) generateAccessKey() (keyID string, secret string, err error) {
@@ -0,0 +1,785 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	nethttp "net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"buck_It_Up/internal/checksum"
+	"buck_It_Up/internal/db"
+	"buck_It_Up/internal/models"
+	"buck_It_Up/internal/secret"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The S3 compatibility layer serves path-style requests signed with AWS
+// Signature V4. Requests are routed here instead of the native API whenever
+// they carry SigV4 credentials, so S3 clients can use the server root as
+// their endpoint.
+
+const (
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MaxKeys   = 1000
+)
+
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *s3Error) withMessage(msg string) *s3Error {
+	return &s3Error{Status: e.Status, Code: e.Code, Message: msg}
+}
+
+var (
+	s3ErrAccessDenied          = &s3Error{nethttp.StatusForbidden, "AccessDenied", "Access Denied"}
+	s3ErrAuthorizationHeader   = &s3Error{nethttp.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	s3ErrAuthorizationQuery    = &s3Error{nethttp.StatusBadRequest, "AuthorizationQueryParametersError", "The presigned URL query parameters are invalid"}
+	s3ErrBadDigest             = &s3Error{nethttp.StatusBadRequest, "BadDigest", "The content did not match the supplied checksum"}
+	s3ErrBucketAlreadyExists   = &s3Error{nethttp.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists"}
+	s3ErrBucketNotEmpty        = &s3Error{nethttp.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"}
+	s3ErrContentSHA256Mismatch = &s3Error{nethttp.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 does not match the payload"}
+	s3ErrEntityTooLarge        = &s3Error{nethttp.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum object size of the bucket"}
+	s3ErrIncompleteBody        = &s3Error{nethttp.StatusBadRequest, "IncompleteBody", "The request body was shorter than announced"}
+	s3ErrInternal              = &s3Error{nethttp.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	s3ErrInvalidAccessKeyID    = &s3Error{nethttp.StatusForbidden, "InvalidAccessKeyId", "The access key ID does not exist"}
+	s3ErrInvalidArgument       = &s3Error{nethttp.StatusBadRequest, "InvalidArgument", "Invalid argument"}
+	s3ErrInvalidBucketName     = &s3Error{nethttp.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid"}
+	s3ErrInvalidDigest         = &s3Error{nethttp.StatusBadRequest, "InvalidDigest", "The supplied checksum is invalid"}
+	s3ErrInvalidPart           = &s3Error{nethttp.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	s3ErrInvalidPartOrder      = &s3Error{nethttp.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	s3ErrInvalidTag            = &s3Error{nethttp.StatusBadRequest, "InvalidTag", "The tag provided was not a valid tag"}
+	s3ErrMalformedXML          = &s3Error{nethttp.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed"}
+	s3ErrMetadataTooLarge      = &s3Error{nethttp.StatusBadRequest, "MetadataTooLarge", "Your metadata headers exceed the maximum allowed metadata size"}
+	s3ErrMethodNotAllowed      = &s3Error{nethttp.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource"}
+	s3ErrNoSuchBucket          = &s3Error{nethttp.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	s3ErrNoSuchKey             = &s3Error{nethttp.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	s3ErrNoSuchUpload          = &s3Error{nethttp.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	s3ErrNoSuchVersion         = &s3Error{nethttp.StatusNotFound, "NoSuchVersion", "The specified version does not exist"}
+	s3ErrNotImplemented        = &s3Error{nethttp.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented"}
+	s3ErrOperationAborted      = &s3Error{nethttp.StatusConflict, "OperationAborted", "A conflicting operation is currently in progress against this resource. Please try again."}
+	s3ErrPreconditionFailed    = &s3Error{nethttp.StatusPreconditionFailed, "PreconditionFailed", "At least one of the preconditions you specified did not hold"}
+	s3ErrQuotaExceeded         = &s3Error{nethttp.StatusInsufficientStorage, "QuotaExceeded", "The bucket quota has been exceeded"}
+	s3ErrRequestTimeTooSkewed  = &s3Error{nethttp.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	s3ErrSignatureDoesNotMatch = &s3Error{nethttp.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+)
+
+type s3ContextKey string
+
+const s3SignatureKey s3ContextKey = "s3sig"
+
+// s3Signature is what the auth middleware leaves in the request context for
+// handlers that need to verify streamed chunk signatures.
+type s3Signature struct {
+	req *sigV4Request
+	key []byte
+}
+
+func (r *Router) newS3Router() chi.Router {
+	s3 := chi.NewRouter()
+	s3.Use(r.s3Auth)
+
+	s3.Get("/", r.s3ListBuckets)
+	s3.Head("/{bucket}", r.s3HeadBucket)
+	s3.Get("/{bucket}", r.s3GetBucket)
+	s3.Put("/{bucket}", r.s3CreateBucket)
+	s3.Post("/{bucket}", r.s3PostBucket)
+	s3.Delete("/{bucket}", r.s3DeleteBucket)
+	s3.Head("/{bucket}/*", r.s3GetObject)
+	s3.Get("/{bucket}/*", r.s3GetObject)
+	s3.Put("/{bucket}/*", r.s3PutObject)
+	s3.Post("/{bucket}/*", r.s3PostObject)
+	s3.Delete("/{bucket}/*", r.s3DeleteObject)
+
+	s3.NotFound(func(w nethttp.ResponseWriter, req *nethttp.Request) {
+		writeS3Error(w, req, s3ErrNotImplemented)
+	})
+	s3.MethodNotAllowed(func(w nethttp.ResponseWriter, req *nethttp.Request) {
+		writeS3Error(w, req, s3ErrMethodNotAllowed)
+	})
+	return s3
+}
+
+// dispatchS3 hands requests signed with AWS Signature V4 to the S3 router.
+func (r *Router) dispatchS3(next nethttp.Handler) nethttp.Handler {
+	return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, req *nethttp.Request) {
+		if !isSigV4Request(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		// Drop the routing context of the main router so the S3 router
+		// starts matching from the full path.
+		ctx := context.WithValue(req.Context(), chi.RouteCtxKey, nil)
+		r.s3.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func (r *Router) s3Auth(next nethttp.Handler) nethttp.Handler {
+	return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, req *nethttp.Request) {
+		sig, err := parseSigV4(req)
+		if err != nil {
+			writeS3Error(w, req, err)
+			return
+		}
+		if err := sig.checkTime(time.Now()); err != nil {
+			writeS3Error(w, req, err)
+			return
+		}
+
+		ctx := req.Context()
+		authCtx, keySecret, err := r.s3Credentials(ctx, sig.AccessKey)
+		if err != nil {
+			writeS3Error(w, req, err)
+			return
+		}
+		if !sig.verify(req, keySecret) {
+			writeS3Error(w, req, s3ErrSignatureDoesNotMatch)
+			return
+		}
+
+		ctx = SetAuthContext(ctx, authCtx)
+		ctx = context.WithValue(ctx, s3SignatureKey, &s3Signature{req: sig, key: sig.signingKey(keySecret)})
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// s3Credentials looks up the secret for an access key ID. The admin password
+// can be used as the secret of the access key ID "admin".
+func (r *Router) s3Credentials(ctx context.Context, keyID string) (*AuthContext, string, error) {
+	if keyID == "admin" {
+		adminPassword := os.Getenv("BUCKITUP_ADMIN_PASSWORD")
+		if adminPassword == "" {
+			return nil, "", s3ErrInvalidAccessKeyID
+		}
+		return &AuthContext{KeyID: "admin", BucketID: 0, Role: models.RoleAll}, adminPassword, nil
+	}
+
+	akStore := r.accessKeys
+	ak, err := akStore.GetByKeyID(ctx, keyID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", s3ErrInvalidAccessKeyID
+		}
+		return nil, "", s3ErrInternal
+	}
+	if ak.SecretSealed == "" {
+		return nil, "", s3ErrInvalidAccessKeyID.withMessage("this access key was created before S3 support; recreate it to use the S3 API")
+	}
+	plain, err := secret.Open(r.secretKey, ak.SecretSealed)
+	if err != nil {
+		log.Printf("unseal secret of access key %s: %v", ak.KeyID, err)
+		return nil, "", s3ErrInternal
+	}
+	return &AuthContext{KeyID: ak.KeyID, BucketID: ak.BucketID, Role: ak.Role}, string(plain), nil
+}
+
+// s3Bucket loads the bucket named in the path and checks that the caller may
+// access it at the given level.
+func (r *Router) s3Bucket(req *nethttp.Request, level AuthLevel) (*models.Bucket, error) {
+	authCtx, ok := GetAuthContext(req.Context())
+	if !ok || !hasPermission(authCtx.Role, level) {
+		return nil, s3ErrAccessDenied
+	}
+
+	name := chi.URLParam(req, "bucket")
+	if name == "" {
+		return nil, s3ErrInvalidBucketName
+	}
+	bucket, err := r.buckets.GetBucketByName(req.Context(), name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, s3ErrNoSuchBucket
+		}
+		return nil, s3ErrInternal
+	}
+	if authCtx.BucketID != 0 && authCtx.BucketID != bucket.ID {
+		return nil, s3ErrAccessDenied
+	}
+	return bucket, nil
+}
+
+func isS3Admin(req *nethttp.Request) bool {
+	authCtx, ok := GetAuthContext(req.Context())
+	return ok && authCtx.BucketID == 0 && authCtx.Role == models.RoleAll
+}
+
+func s3ObjectKey(req *nethttp.Request) string {
+	return strings.TrimPrefix(req.URL.Path, "/"+chi.URLParam(req, "bucket")+"/")
+}
+
+// s3ETag is the ETag reported to S3 clients. Many of them expect the MD5 of
+// the content for single part uploads, so it is preferred when known.
+func s3ETag(obj *models.Object) string {
+	if obj.ChecksumMD5 != "" {
+		return `"` + obj.ChecksumMD5 + `"`
+	}
+	return `"` + obj.Checksum + `"`
+}
+
+func s3Time(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+type s3BucketEntry struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name        `xml:"ListAllMyBucketsResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Owner   s3Owner         `xml:"Owner"`
+	Buckets []s3BucketEntry `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+func (r *Router) s3ListBuckets(w nethttp.ResponseWriter, req *nethttp.Request) {
+	authCtx, ok := GetAuthContext(req.Context())
+	if !ok {
+		writeS3Error(w, req, s3ErrAccessDenied)
+		return
+	}
+	buckets, err := r.buckets.ListBuckets(req.Context())
+	if err != nil {
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+
+	result := s3ListAllMyBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{ID: authCtx.KeyID, DisplayName: authCtx.KeyID},
+	}
+	for _, b := range buckets {
+		if authCtx.BucketID != 0 && authCtx.BucketID != b.ID {
+			continue
+		}
+		result.Buckets = append(result.Buckets, s3BucketEntry{Name: b.Name, CreationDate: s3Time(b.CreatedAt)})
+	}
+	writeS3XML(w, nethttp.StatusOK, result)
+}
+
+func (r *Router) s3HeadBucket(w nethttp.ResponseWriter, req *nethttp.Request) {
+	if _, err := r.s3Bucket(req, AuthLevelReadOnly); err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	w.WriteHeader(nethttp.StatusOK)
+}
+
+func (r *Router) s3CreateBucket(w nethttp.ResponseWriter, req *nethttp.Request) {
+	if req.URL.Query().Has("versioning") {
+		r.s3PutBucketVersioning(w, req)
+		return
+	}
+	if !isS3Admin(req) {
+		writeS3Error(w, req, s3ErrAccessDenied)
+		return
+	}
+	name := chi.URLParam(req, "bucket")
+	if name == "" || strings.Contains(name, "/") {
+		writeS3Error(w, req, s3ErrInvalidBucketName)
+		return
+	}
+	if _, _, err := r.createBucketWithKeys(req.Context(), name); err != nil {
+		if errors.Is(err, errBucketExists) {
+			writeS3Error(w, req, s3ErrBucketAlreadyExists)
+			return
+		}
+		log.Printf("s3 create bucket: %v", err)
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+	w.Header().Set("Location", "/"+name)
+	w.WriteHeader(nethttp.StatusOK)
+}
+
+func (r *Router) s3DeleteBucket(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, err := r.s3Bucket(req, AuthLevelAll)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	ctx := req.Context()
+	empty, err := r.objects.IsBucketEmpty(ctx, bucket.ID)
+	if err != nil {
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+	if !empty {
+		writeS3Error(w, req, s3ErrBucketNotEmpty)
+		return
+	}
+	if err := r.buckets.DeleteBucketByName(ctx, bucket.Name); err != nil {
+		if db.IsForeignKeyViolation(err) {
+			writeS3Error(w, req, s3ErrBucketNotEmpty)
+			return
+		}
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+	w.WriteHeader(nethttp.StatusNoContent)
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Marker                *string          `xml:"Marker,omitempty"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	KeyCount              *int             `xml:"KeyCount,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Value   string   `xml:",chardata"`
+}
+
+func (r *Router) s3GetBucket(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, err := r.s3Bucket(req, AuthLevelReadOnly)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+
+	q := req.URL.Query()
+	if _, ok := q["location"]; ok {
+		writeS3XML(w, nethttp.StatusOK, s3LocationConstraint{Xmlns: s3Namespace})
+		return
+	}
+	if _, ok := q["uploads"]; ok {
+		r.s3ListMultipartUploads(w, req, bucket)
+		return
+	}
+	if _, ok := q["versioning"]; ok {
+		s3GetBucketVersioning(w, bucket)
+		return
+	}
+	if _, ok := q["versions"]; ok {
+		r.s3ListObjectVersions(w, req, bucket)
+		return
+	}
+	for _, sub := range []string{"acl", "policy", "lifecycle", "tagging", "cors", "website"} {
+		if _, ok := q[sub]; ok {
+			writeS3Error(w, req, s3ErrNotImplemented)
+			return
+		}
+	}
+
+	maxKeys := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeS3Error(w, req, s3ErrInvalidArgument.withMessage("invalid max-keys"))
+			return
+		}
+		maxKeys = min(n, s3MaxKeys)
+	}
+
+	v2 := q.Get("list-type") == "2"
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	encodeKeys := q.Get("encoding-type") == "url"
+
+	result := s3ListBucketResult{
+		Xmlns:     s3Namespace,
+		Name:      bucket.Name,
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+	if encodeKeys {
+		result.EncodingType = "url"
+	}
+
+	var after string
+	if v2 {
+		result.StartAfter = q.Get("start-after")
+		result.ContinuationToken = q.Get("continuation-token")
+		after = result.StartAfter
+		if result.ContinuationToken != "" {
+			decoded, err := decodeContinuationToken(result.ContinuationToken)
+			if err != nil {
+				writeS3Error(w, req, s3ErrInvalidArgument.withMessage("invalid continuation token"))
+				return
+			}
+			after = decoded
+		}
+	} else {
+		marker := q.Get("marker")
+		result.Marker = &marker
+		after = marker
+	}
+
+	page, err := r.objects.ListObjectsPage(req.Context(), bucket.ID, models.ListObjectsOptions{
+		Prefix:     prefix,
+		Delimiter:  delimiter,
+		StartAfter: after,
+		MaxKeys:    maxKeys,
+	})
+	if err != nil {
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+
+	encode := func(s string) string {
+		if encodeKeys {
+			return uriEncode(s, false)
+		}
+		return s
+	}
+
+	for _, obj := range page.Objects {
+		result.Contents = append(result.Contents, s3Object{
+			Key:          encode(obj.ObjectKey),
+			LastModified: s3Time(obj.CreatedAt),
+			ETag:         s3ETag(obj),
+			Size:         obj.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, p := range page.CommonPrefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(p)})
+	}
+	result.IsTruncated = page.IsTruncated
+
+	if v2 {
+		count := len(page.Objects) + len(page.CommonPrefixes)
+		result.KeyCount = &count
+		if result.IsTruncated {
+			result.NextContinuationToken = encodeContinuationToken(page.Next)
+		}
+	} else if result.IsTruncated && delimiter != "" {
+		result.NextMarker = encode(page.Next)
+	}
+
+	writeS3XML(w, nethttp.StatusOK, result)
+}
+
+func (r *Router) s3GetObject(w nethttp.ResponseWriter, req *nethttp.Request) {
+	key := s3ObjectKey(req)
+	if key == "" {
+		if req.Method == nethttp.MethodHead {
+			r.s3HeadBucket(w, req)
+			return
+		}
+		r.s3GetBucket(w, req)
+		return
+	}
+	if req.Method == nethttp.MethodGet && req.URL.Query().Has("uploadId") {
+		r.s3ListParts(w, req)
+		return
+	}
+	if req.Method == nethttp.MethodGet && req.URL.Query().Has("tagging") {
+		r.s3GetObjectTagging(w, req)
+		return
+	}
+	bucket, err := r.s3Bucket(req, AuthLevelReadOnly)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+
+	versionID := req.URL.Query().Get("versionId")
+	obj, err := r.getObjectVersion(req.Context(), bucket.ID, key, versionID)
+	if err == nil {
+		err = r.objects.LoadAttributes(req.Context(), obj)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			if versionID != "" {
+				writeS3Error(w, req, s3ErrNoSuchVersion)
+				return
+			}
+			writeS3Error(w, req, s3ErrNoSuchKey)
+			return
+		}
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+
+	customerKey, err := s3CustomerKey(req)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	f, err := r.openObjectBlob(req.Context(), obj, customerKey)
+	switch {
+	case errors.Is(err, errCustomerKeyRequired):
+		writeS3Error(w, req, s3ErrInvalidArgument.withMessage("The object was stored using a form of server-side encryption; the customer key must be provided to read it"))
+		return
+	case errors.Is(err, errCustomerKeyMismatch):
+		writeS3Error(w, req, s3ErrAccessDenied)
+		return
+	case err != nil:
+		log.Printf("s3 open object %d: %v", obj.ID, err)
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+	defer f.Close()
+
+	contentType := obj.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", s3ETag(obj))
+	if obj.VersionID != "" {
+		w.Header().Set("x-amz-version-id", obj.VersionID)
+	}
+	setS3AttributeHeaders(w.Header(), obj)
+	setS3EncryptionHeaders(w.Header(), obj)
+	nethttp.ServeContent(w, req, "", time.Unix(obj.CreatedAt, 0), f)
+}
+
+func (r *Router) s3PutObject(w nethttp.ResponseWriter, req *nethttp.Request) {
+	key := s3ObjectKey(req)
+	if key == "" {
+		r.s3CreateBucket(w, req)
+		return
+	}
+	if req.Header.Get("X-Amz-Copy-Source") != "" {
+		writeS3Error(w, req, s3ErrNotImplemented)
+		return
+	}
+	if req.URL.Query().Has("uploadId") {
+		r.s3UploadPart(w, req)
+		return
+	}
+	if req.URL.Query().Has("tagging") {
+		r.s3PutObjectTagging(w, req)
+		return
+	}
+	bucket, err := r.s3Bucket(req, AuthLevelReadWrite)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+
+	expected, err := s3ExpectedChecksums(req)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+
+	body, size, err := s3PayloadReader(req, &expected)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+
+	attrs, err := s3Attributes(req)
+	if err == nil {
+		err = r.s3CheckServerSideEncryption(req)
+	}
+	if err == nil {
+		attrs.CustomerKey, err = s3CustomerKey(req)
+	}
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+
+	obj, err := r.storeObject(req.Context(), bucket, key, attrs, body, size, expected, writeConditionFromRequest(req))
+	if err != nil {
+		writeS3Error(w, req, s3StoreError(err, req))
+		return
+	}
+
+	w.Header().Set("ETag", s3ETag(obj))
+	if obj.VersionID != "" {
+		w.Header().Set("x-amz-version-id", obj.VersionID)
+	}
+	setS3EncryptionHeaders(w.Header(), obj)
+	w.WriteHeader(nethttp.StatusOK)
+}
+
+// s3ExpectedChecksums collects the digests announced by Content-MD5 and the
+// x-amz-checksum-* headers.
+func s3ExpectedChecksums(req *nethttp.Request) (checksum.Expected, error) {
+	expected, err := expectedChecksums(req)
+	if err != nil {
+		return expected, s3ErrInvalidDigest
+	}
+	if v := req.Header.Get("X-Amz-Checksum-Sha256"); v != "" && expected.SHA256 == "" {
+		if expected.SHA256, err = checksum.Normalize(v, 32); err != nil {
+			return expected, s3ErrInvalidDigest
+		}
+	}
+	if v := req.Header.Get("X-Amz-Checksum-Crc32c"); v != "" && expected.CRC32C == "" {
+		if expected.CRC32C, err = checksum.Normalize(v, 4); err != nil {
+			return expected, s3ErrInvalidDigest
+		}
+	}
+	return expected, nil
+}
+
+// s3PayloadReader returns the decoded request body and its expected length
+// according to the x-amz-content-sha256 mode the client signed with.
+func s3PayloadReader(req *nethttp.Request, expected *checksum.Expected) (io.Reader, int64, error) {
+	sig, _ := req.Context().Value(s3SignatureKey).(*s3Signature)
+	if sig == nil {
+		return nil, 0, s3ErrAccessDenied
+	}
+
+	switch mode := sig.req.PayloadHash; mode {
+	case unsignedPayload:
+		return req.Body, req.ContentLength, nil
+	case streamingPayload, streamingUnsignedTrlr:
+		decoded, err := strconv.ParseInt(req.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			decoded = -1
+		}
+		return newChunkedReader(req.Body, sig.req, sig.key, req.Header.Get("X-Amz-Trailer")), decoded, nil
+	default:
+		if len(mode) != 64 {
+			return nil, 0, s3ErrNotImplemented.withMessage("unsupported x-amz-content-sha256 mode " + mode)
+		}
+		if expected.SHA256 != "" && expected.SHA256 != mode {
+			return nil, 0, s3ErrContentSHA256Mismatch
+		}
+		expected.SHA256 = mode
+		return req.Body, req.ContentLength, nil
+	}
+}
+
+func s3StoreError(err error, req *nethttp.Request) error {
+	var s3err *s3Error
+	var mismatch *checksum.MismatchError
+	switch {
+	case errors.As(err, &s3err):
+		return s3err
+	case errors.As(err, &mismatch):
+		sig, _ := req.Context().Value(s3SignatureKey).(*s3Signature)
+		if mismatch.Algorithm == "sha256" && sig != nil && sig.req.PayloadHash != unsignedPayload {
+			return s3ErrContentSHA256Mismatch
+		}
+		return s3ErrBadDigest
+	case errors.Is(err, errPreconditionFailed):
+		return s3ErrPreconditionFailed
+	case errors.Is(err, errLengthMismatch), errors.Is(err, errBodyRead):
+		return s3ErrIncompleteBody
+	case errors.Is(err, models.ErrObjectTooLarge):
+		return s3ErrEntityTooLarge
+	case errors.Is(err, models.ErrQuotaExceeded):
+		return s3ErrQuotaExceeded
+	default:
+		log.Printf("s3 store object: %v", err)
+		return s3ErrInternal
+	}
+}
+
+func (r *Router) s3DeleteObject(w nethttp.ResponseWriter, req *nethttp.Request) {
+	key := s3ObjectKey(req)
+	if key == "" {
+		r.s3DeleteBucket(w, req)
+		return
+	}
+	if req.URL.Query().Has("uploadId") {
+		r.s3AbortMultipartUpload(w, req)
+		return
+	}
+	if req.URL.Query().Has("tagging") {
+		r.s3DeleteObjectTagging(w, req)
+		return
+	}
+	bucket, err := r.s3Bucket(req, AuthLevelReadWrite)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+
+	versionID := req.URL.Query().Get("versionId")
+	markerID, err := r.deleteObjectVersion(req.Context(), bucket, key, versionID)
+	// S3 reports success for keys that do not exist.
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("s3 delete object %q: %v", key, err)
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+	if markerID != "" {
+		w.Header().Set("x-amz-version-id", markerID)
+		w.Header().Set("x-amz-delete-marker", "true")
+	} else if versionID != "" {
+		w.Header().Set("x-amz-version-id", versionID)
+	}
+	w.WriteHeader(nethttp.StatusNoContent)
+}
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+func writeS3Error(w nethttp.ResponseWriter, req *nethttp.Request, err error) {
+	var s3err *s3Error
+	if !errors.As(err, &s3err) {
+		log.Printf("s3: %v", err)
+		s3err = s3ErrInternal
+	}
+	if req.Method == nethttp.MethodHead {
+		w.WriteHeader(s3err.Status)
+		return
+	}
+	writeS3XML(w, s3err.Status, s3ErrorResponse{
+		Code:      s3err.Code,
+		Message:   s3err.Message,
+		Resource:  req.URL.Path,
+		RequestID: w.Header().Get("X-Request-Id"),
+	})
+}
+
+func writeS3XML(w nethttp.ResponseWriter, status int, v any) {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(out)
+}
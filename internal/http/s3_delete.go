@@ -0,0 +1,95 @@
+package http
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"io"
+	nethttp "net/http"
+)
+
+type s3DeleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool     `xml:"Quiet"`
+	Objects []struct {
+		Key       string `xml:"Key"`
+		VersionID string `xml:"VersionId"`
+	} `xml:"Object"`
+}
+
+type s3DeletedObject struct {
+	Key                   string `xml:"Key"`
+	VersionID             string `xml:"VersionId,omitempty"`
+	DeleteMarker          bool   `xml:"DeleteMarker,omitempty"`
+	DeleteMarkerVersionID string `xml:"DeleteMarkerVersionId,omitempty"`
+}
+
+type s3DeleteError struct {
+	Key       string `xml:"Key"`
+	VersionID string `xml:"VersionId,omitempty"`
+	Code      string `xml:"Code"`
+	Message   string `xml:"Message"`
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name          `xml:"DeleteResult"`
+	Xmlns   string            `xml:"xmlns,attr,omitempty"`
+	Deleted []s3DeletedObject `xml:"Deleted"`
+	Errors  []s3DeleteError   `xml:"Error"`
+}
+
+func (r *Router) s3PostBucket(w nethttp.ResponseWriter, req *nethttp.Request) {
+	if !req.URL.Query().Has("delete") {
+		writeS3Error(w, req, s3ErrNotImplemented)
+		return
+	}
+	r.s3DeleteObjects(w, req)
+}
+
+// s3DeleteObjects implements DeleteObjects. As with DeleteObject, keys that
+// do not exist are reported as deleted.
+func (r *Router) s3DeleteObjects(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, err := r.s3Bucket(req, AuthLevelReadWrite)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	var body s3DeleteRequest
+	if err := xml.NewDecoder(io.LimitReader(req.Body, 2<<20)).Decode(&body); err != nil {
+		writeS3Error(w, req, s3ErrMalformedXML)
+		return
+	}
+	if len(body.Objects) == 0 || len(body.Objects) > maxBatchDeleteKeys {
+		writeS3Error(w, req, s3ErrMalformedXML)
+		return
+	}
+
+	targets := make([]deleteTarget, len(body.Objects))
+	for i, o := range body.Objects {
+		targets[i] = deleteTarget{Key: o.Key, VersionID: o.VersionID}
+	}
+	result := s3DeleteResult{Xmlns: s3Namespace}
+	for _, res := range r.deleteObjects(req.Context(), bucket, targets) {
+		if res.Deleted || res.err == sql.ErrNoRows {
+			if !body.Quiet {
+				result.Deleted = append(result.Deleted, s3DeletedObject{
+					Key:                   res.Key,
+					VersionID:             res.VersionID,
+					DeleteMarker:          res.DeleteMarkerVersionID != "",
+					DeleteMarkerVersionID: res.DeleteMarkerVersionID,
+				})
+			}
+			continue
+		}
+		code, message := s3ErrInternal.Code, s3ErrInternal.Message
+		if res.err == nil {
+			code, message = s3ErrInvalidArgument.Code, res.Error
+		}
+		result.Errors = append(result.Errors, s3DeleteError{
+			Key:       res.Key,
+			VersionID: res.VersionID,
+			Code:      code,
+			Message:   message,
+		})
+	}
+	writeS3XML(w, nethttp.StatusOK, result)
+}
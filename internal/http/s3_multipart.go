@@ -0,0 +1,325 @@
+package http
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+
+	"buck_It_Up/internal/models"
+)
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+type s3Part struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type s3ListPartsResult struct {
+	XMLName              xml.Name `xml:"ListPartsResult"`
+	Xmlns                string   `xml:"xmlns,attr"`
+	Bucket               string   `xml:"Bucket"`
+	Key                  string   `xml:"Key"`
+	UploadID             string   `xml:"UploadId"`
+	PartNumberMarker     int      `xml:"PartNumberMarker"`
+	NextPartNumberMarker int      `xml:"NextPartNumberMarker"`
+	MaxParts             int      `xml:"MaxParts"`
+	IsTruncated          bool     `xml:"IsTruncated"`
+	Parts                []s3Part `xml:"Part"`
+}
+
+type s3Upload struct {
+	Key       string `xml:"Key"`
+	UploadID  string `xml:"UploadId"`
+	Initiated string `xml:"Initiated"`
+}
+
+type s3ListMultipartUploadsResult struct {
+	XMLName     xml.Name   `xml:"ListMultipartUploadsResult"`
+	Xmlns       string     `xml:"xmlns,attr"`
+	Bucket      string     `xml:"Bucket"`
+	Prefix      string     `xml:"Prefix"`
+	MaxUploads  int        `xml:"MaxUploads"`
+	IsTruncated bool       `xml:"IsTruncated"`
+	Uploads     []s3Upload `xml:"Upload"`
+}
+
+// s3MultipartError maps errors from the multipart helpers to S3 errors.
+func s3MultipartError(err error, req *nethttp.Request) error {
+	switch {
+	case errors.Is(err, errNoSuchUpload):
+		return s3ErrNoSuchUpload
+	case errors.Is(err, models.ErrUploadCompleting):
+		return s3ErrOperationAborted
+	case errors.Is(err, errInvalidPartOrder):
+		return s3ErrInvalidPartOrder
+	case errors.Is(err, errInvalidPart):
+		return s3ErrInvalidPart
+	default:
+		return s3StoreError(err, req)
+	}
+}
+
+// s3PostObject handles CreateMultipartUpload (?uploads) and
+// CompleteMultipartUpload (?uploadId=).
+func (r *Router) s3PostObject(w nethttp.ResponseWriter, req *nethttp.Request) {
+	if s3ObjectKey(req) == "" {
+		r.s3PostBucket(w, req)
+		return
+	}
+	q := req.URL.Query()
+	switch {
+	case q.Has("uploads"):
+		r.s3CreateMultipartUpload(w, req)
+	case q.Has("uploadId"):
+		r.s3CompleteMultipartUpload(w, req)
+	default:
+		writeS3Error(w, req, s3ErrNotImplemented)
+	}
+}
+
+func (r *Router) s3CreateMultipartUpload(w nethttp.ResponseWriter, req *nethttp.Request) {
+	key := s3ObjectKey(req)
+	bucket, err := r.s3Bucket(req, AuthLevelReadWrite)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	if key == "" || strings.Contains(key, "\x00") {
+		writeS3Error(w, req, s3ErrInvalidArgument.withMessage("invalid object key"))
+		return
+	}
+
+	attrs, err := s3Attributes(req)
+	if err == nil {
+		err = r.s3CheckServerSideEncryption(req)
+	}
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	if s3RejectCustomerKey(w, req) {
+		return
+	}
+
+	u, err := r.createMultipartUpload(req.Context(), bucket, key, attrs)
+	if err != nil {
+		log.Printf("s3 create multipart upload: %v", err)
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+	writeS3XML(w, nethttp.StatusOK, s3InitiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket.Name,
+		Key:      key,
+		UploadID: u.UploadID,
+	})
+}
+
+// s3MultipartUpload resolves the bucket and the upload named by the uploadId
+// query parameter, making sure the upload belongs to the key in the path.
+func (r *Router) s3MultipartUpload(req *nethttp.Request, level AuthLevel) (*models.Bucket, *models.MultipartUpload, error) {
+	bucket, err := r.s3Bucket(req, level)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := r.getMultipartUpload(req.Context(), bucket, req.URL.Query().Get("uploadId"))
+	if err != nil {
+		return nil, nil, s3MultipartError(err, req)
+	}
+	if u.ObjectKey != s3ObjectKey(req) {
+		return nil, nil, s3ErrNoSuchUpload
+	}
+	return bucket, u, nil
+}
+
+func (r *Router) s3UploadPart(w nethttp.ResponseWriter, req *nethttp.Request) {
+	partNumber, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		writeS3Error(w, req, s3ErrInvalidArgument.withMessage("part number must be an integer between 1 and 10000"))
+		return
+	}
+	bucket, u, err := r.s3MultipartUpload(req, AuthLevelReadWrite)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	if s3RejectCustomerKey(w, req) {
+		return
+	}
+
+	expected, err := s3ExpectedChecksums(req)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	body, size, err := s3PayloadReader(req, &expected)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+
+	part, err := r.uploadPart(req.Context(), bucket, u, partNumber, body, size, expected)
+	if err != nil {
+		writeS3Error(w, req, s3MultipartError(err, req))
+		return
+	}
+	w.Header().Set("ETag", `"`+part.ETag+`"`)
+	w.WriteHeader(nethttp.StatusOK)
+}
+
+func (r *Router) s3CompleteMultipartUpload(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, u, err := r.s3MultipartUpload(req, AuthLevelReadWrite)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	if s3RejectCustomerKey(w, req) {
+		return
+	}
+
+	var body s3CompleteMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil {
+		writeS3Error(w, req, s3ErrMalformedXML)
+		return
+	}
+	parts := make([]completedPart, len(body.Parts))
+	for i, p := range body.Parts {
+		parts[i] = completedPart{PartNumber: p.PartNumber, ETag: p.ETag}
+	}
+
+	_, etag, err := r.completeMultipartUpload(req.Context(), bucket, u, parts, writeConditionFromRequest(req))
+	if err != nil {
+		writeS3Error(w, req, s3MultipartError(err, req))
+		return
+	}
+	writeS3XML(w, nethttp.StatusOK, s3CompleteMultipartUploadResult{
+		Xmlns:  s3Namespace,
+		Bucket: bucket.Name,
+		Key:    u.ObjectKey,
+		ETag:   `"` + etag + `"`,
+	})
+}
+
+func (r *Router) s3AbortMultipartUpload(w nethttp.ResponseWriter, req *nethttp.Request) {
+	_, u, err := r.s3MultipartUpload(req, AuthLevelReadWrite)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	if err := r.removeMultipartUpload(req.Context(), u); err != nil {
+		log.Printf("s3 abort multipart upload %s: %v", u.UploadID, err)
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+	w.WriteHeader(nethttp.StatusNoContent)
+}
+
+func (r *Router) s3ListParts(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, u, err := r.s3MultipartUpload(req, AuthLevelReadOnly)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	q := req.URL.Query()
+	maxParts := s3MaxKeys
+	if v := q.Get("max-parts"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeS3Error(w, req, s3ErrInvalidArgument.withMessage("invalid max-parts"))
+			return
+		}
+		maxParts = min(n, s3MaxKeys)
+	}
+	marker, _ := strconv.Atoi(q.Get("part-number-marker"))
+
+	parts, err := r.multipart.ListParts(req.Context(), u.UploadID)
+	if err != nil {
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+
+	result := s3ListPartsResult{
+		Xmlns:            s3Namespace,
+		Bucket:           bucket.Name,
+		Key:              u.ObjectKey,
+		UploadID:         u.UploadID,
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+	}
+	for _, p := range parts {
+		if p.PartNumber <= marker {
+			continue
+		}
+		if len(result.Parts) == maxParts {
+			result.IsTruncated = true
+			break
+		}
+		result.Parts = append(result.Parts, s3Part{
+			PartNumber:   p.PartNumber,
+			LastModified: s3Time(p.CreatedAt),
+			ETag:         `"` + p.ETag + `"`,
+			Size:         p.Size,
+		})
+		result.NextPartNumberMarker = p.PartNumber
+	}
+	writeS3XML(w, nethttp.StatusOK, result)
+}
+
+func (r *Router) s3ListMultipartUploads(w nethttp.ResponseWriter, req *nethttp.Request, bucket *models.Bucket) {
+	uploads, err := r.multipart.ListUploads(req.Context(), bucket.ID)
+	if err != nil {
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+
+	prefix := req.URL.Query().Get("prefix")
+	result := s3ListMultipartUploadsResult{
+		Xmlns:      s3Namespace,
+		Bucket:     bucket.Name,
+		Prefix:     prefix,
+		MaxUploads: s3MaxKeys,
+	}
+	for _, u := range uploads {
+		if !strings.HasPrefix(u.ObjectKey, prefix) {
+			continue
+		}
+		if len(result.Uploads) == s3MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+		result.Uploads = append(result.Uploads, s3Upload{
+			Key:       u.ObjectKey,
+			UploadID:  u.UploadID,
+			Initiated: s3Time(u.CreatedAt),
+		})
+	}
+	writeS3XML(w, nethttp.StatusOK, result)
+}
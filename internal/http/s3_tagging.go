@@ -0,0 +1,151 @@
+package http
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"io"
+	nethttp "net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"buck_It_Up/internal/models"
+)
+
+type s3Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type s3Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	TagSet  []s3Tag  `xml:"TagSet>Tag"`
+}
+
+// s3Attributes reads the content type, x-amz-meta-* headers and the
+// x-amz-tagging header of PutObject and CreateMultipartUpload.
+func s3Attributes(req *nethttp.Request) (objectAttributes, error) {
+	attrs := objectAttributes{
+		ContentType: strings.TrimSpace(req.Header.Get("Content-Type")),
+		Metadata:    metadataFromHeaders(req.Header, s3MetadataHeaderPrefix),
+	}
+	if err := validateMetadata(attrs.Metadata); err != nil {
+		if err == errMetadataTooLarge {
+			return attrs, s3ErrMetadataTooLarge
+		}
+		return attrs, s3ErrInvalidArgument.withMessage(err.Error())
+	}
+	tags, err := parseTagSet(req.Header.Get("X-Amz-Tagging"))
+	if err == nil {
+		err = validateTags(tags)
+	}
+	if err != nil {
+		return attrs, s3ErrInvalidTag.withMessage(err.Error())
+	}
+	attrs.Tags = tags
+	return attrs, nil
+}
+
+// setS3AttributeHeaders adds the user metadata and tag count of obj to a
+// GetObject or HeadObject response.
+func setS3AttributeHeaders(h nethttp.Header, obj *models.Object) {
+	setMetadataHeaders(h, s3MetadataHeaderPrefix, obj.Metadata)
+	if len(obj.Tags) > 0 {
+		h.Set("x-amz-tagging-count", strconv.Itoa(len(obj.Tags)))
+	}
+}
+
+func s3TagsTarget(req *nethttp.Request, bucket *models.Bucket) tagsTarget {
+	return tagsTarget{bucket, s3ObjectKey(req), req.URL.Query().Get("versionId")}
+}
+
+func s3TaggingError(err error, t tagsTarget) error {
+	if err == sql.ErrNoRows {
+		if t.versionID != "" {
+			return s3ErrNoSuchVersion
+		}
+		return s3ErrNoSuchKey
+	}
+	return s3ErrInternal
+}
+
+func (r *Router) s3GetObjectTagging(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, err := r.s3Bucket(req, AuthLevelReadOnly)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	t := s3TagsTarget(req, bucket)
+	ctx := req.Context()
+	obj, err := r.getObjectVersion(ctx, bucket.ID, t.objectKey, t.versionID)
+	if err == nil {
+		err = r.objects.LoadAttributes(ctx, obj)
+	}
+	if err != nil {
+		writeS3Error(w, req, s3TaggingError(err, t))
+		return
+	}
+
+	result := s3Tagging{Xmlns: s3Namespace, TagSet: []s3Tag{}}
+	for key, value := range obj.Tags {
+		result.TagSet = append(result.TagSet, s3Tag{key, value})
+	}
+	sort.Slice(result.TagSet, func(i, j int) bool { return result.TagSet[i].Key < result.TagSet[j].Key })
+	if obj.VersionID != "" {
+		w.Header().Set("x-amz-version-id", obj.VersionID)
+	}
+	writeS3XML(w, nethttp.StatusOK, result)
+}
+
+func (r *Router) s3PutObjectTagging(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, err := r.s3Bucket(req, AuthLevelReadWrite)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	var body s3Tagging
+	if err := xml.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil {
+		writeS3Error(w, req, s3ErrMalformedXML)
+		return
+	}
+	tags := make(map[string]string, len(body.TagSet))
+	for _, tag := range body.TagSet {
+		if _, dup := tags[tag.Key]; dup {
+			writeS3Error(w, req, s3ErrInvalidTag.withMessage("duplicate tag "+tag.Key))
+			return
+		}
+		tags[tag.Key] = tag.Value
+	}
+	if err := validateTags(tags); err != nil {
+		writeS3Error(w, req, s3ErrInvalidTag.withMessage(err.Error()))
+		return
+	}
+
+	t := s3TagsTarget(req, bucket)
+	if err := r.setObjectTags(req.Context(), t, tags); err != nil {
+		writeS3Error(w, req, s3TaggingError(err, t))
+		return
+	}
+	if t.versionID != "" {
+		w.Header().Set("x-amz-version-id", t.versionID)
+	}
+	w.WriteHeader(nethttp.StatusOK)
+}
+
+func (r *Router) s3DeleteObjectTagging(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, err := r.s3Bucket(req, AuthLevelReadWrite)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	t := s3TagsTarget(req, bucket)
+	if err := r.setObjectTags(req.Context(), t, nil); err != nil {
+		writeS3Error(w, req, s3TaggingError(err, t))
+		return
+	}
+	if t.versionID != "" {
+		w.Header().Set("x-amz-version-id", t.versionID)
+	}
+	w.WriteHeader(nethttp.StatusNoContent)
+}
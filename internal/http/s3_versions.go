@@ -0,0 +1,150 @@
+package http
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	nethttp "net/http"
+	"strconv"
+
+	"buck_It_Up/internal/models"
+)
+
+type s3VersioningConfiguration struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	Status  string   `xml:"Status,omitempty"`
+}
+
+type s3ObjectVersion struct {
+	XMLName      xml.Name `xml:"Version"`
+	Key          string   `xml:"Key"`
+	VersionID    string   `xml:"VersionId"`
+	IsLatest     bool     `xml:"IsLatest"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+	Size         int64    `xml:"Size"`
+	StorageClass string   `xml:"StorageClass"`
+}
+
+type s3DeleteMarkerEntry struct {
+	XMLName      xml.Name `xml:"DeleteMarker"`
+	Key          string   `xml:"Key"`
+	VersionID    string   `xml:"VersionId"`
+	IsLatest     bool     `xml:"IsLatest"`
+	LastModified string   `xml:"LastModified"`
+}
+
+type s3ListVersionsResult struct {
+	XMLName             xml.Name `xml:"ListVersionsResult"`
+	Xmlns               string   `xml:"xmlns,attr"`
+	Name                string   `xml:"Name"`
+	Prefix              string   `xml:"Prefix"`
+	KeyMarker           string   `xml:"KeyMarker"`
+	VersionIDMarker     string   `xml:"VersionIdMarker"`
+	NextKeyMarker       string   `xml:"NextKeyMarker,omitempty"`
+	NextVersionIDMarker string   `xml:"NextVersionIdMarker,omitempty"`
+	MaxKeys             int      `xml:"MaxKeys"`
+	IsTruncated         bool     `xml:"IsTruncated"`
+	// Versions holds *s3ObjectVersion and *s3DeleteMarkerEntry values so
+	// both are encoded in the order they were listed.
+	Versions []any
+}
+
+func s3GetBucketVersioning(w nethttp.ResponseWriter, bucket *models.Bucket) {
+	result := s3VersioningConfiguration{Xmlns: s3Namespace}
+	if bucket.Versioning {
+		result.Status = "Enabled"
+	}
+	writeS3XML(w, nethttp.StatusOK, result)
+}
+
+func (r *Router) s3PutBucketVersioning(w nethttp.ResponseWriter, req *nethttp.Request) {
+	bucket, err := r.s3Bucket(req, AuthLevelAll)
+	if err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	var body s3VersioningConfiguration
+	if err := xml.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil {
+		writeS3Error(w, req, s3ErrMalformedXML)
+		return
+	}
+	var enabled bool
+	switch body.Status {
+	case "Enabled":
+		enabled = true
+	case "Suspended":
+	default:
+		writeS3Error(w, req, s3ErrMalformedXML)
+		return
+	}
+	if err := r.buckets.SetVersioning(req.Context(), bucket.ID, enabled); err != nil {
+		log.Printf("s3 put bucket versioning: %v", err)
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+	w.WriteHeader(nethttp.StatusOK)
+}
+
+func (r *Router) s3ListObjectVersions(w nethttp.ResponseWriter, req *nethttp.Request, bucket *models.Bucket) {
+	q := req.URL.Query()
+	maxKeys := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeS3Error(w, req, s3ErrInvalidArgument.withMessage("invalid max-keys"))
+			return
+		}
+		maxKeys = min(n, s3MaxKeys)
+	}
+
+	opts := models.ListVersionsOptions{
+		Prefix:          q.Get("prefix"),
+		KeyMarker:       q.Get("key-marker"),
+		VersionIDMarker: q.Get("version-id-marker"),
+		MaxKeys:         maxKeys,
+	}
+	if opts.VersionIDMarker != "" && opts.KeyMarker == "" {
+		writeS3Error(w, req, s3ErrInvalidArgument.withMessage("A version-id marker cannot be specified without a key marker."))
+		return
+	}
+	page, err := r.objects.ListVersionsPage(req.Context(), bucket.ID, opts)
+	if err != nil {
+		writeS3Error(w, req, s3ErrInternal)
+		return
+	}
+
+	result := s3ListVersionsResult{
+		Xmlns:               s3Namespace,
+		Name:                bucket.Name,
+		Prefix:              opts.Prefix,
+		KeyMarker:           opts.KeyMarker,
+		VersionIDMarker:     opts.VersionIDMarker,
+		NextKeyMarker:       page.NextKeyMarker,
+		NextVersionIDMarker: page.NextVersionIDMarker,
+		MaxKeys:             maxKeys,
+		IsTruncated:         page.IsTruncated,
+	}
+	for _, v := range page.Versions {
+		if v.IsDeleteMarker {
+			result.Versions = append(result.Versions, &s3DeleteMarkerEntry{
+				Key:          v.ObjectKey,
+				VersionID:    v.VersionID,
+				IsLatest:     v.IsLatest,
+				LastModified: s3Time(v.CreatedAt),
+			})
+		} else {
+			result.Versions = append(result.Versions, &s3ObjectVersion{
+				Key:          v.ObjectKey,
+				VersionID:    v.VersionID,
+				IsLatest:     v.IsLatest,
+				LastModified: s3Time(v.CreatedAt),
+				ETag:         s3ETag(v),
+				Size:         v.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+	}
+	writeS3XML(w, nethttp.StatusOK, result)
+}
@@ -0,0 +1,545 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"buck_It_Up/internal/checksum"
+	"buck_It_Up/internal/models"
+	"buck_It_Up/internal/secret"
+	"buck_It_Up/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Resumable uploads following the tus 1.0 core protocol with the creation,
+// expiration and termination extensions (https://tus.io/protocols/resumable-upload).
+
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,expiration,termination"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// tusLocks holds one mutex per upload ID so that two PATCH requests for the
+// same upload never append to its file at the same time.
+var tusLocks sync.Map
+
+func lockTusUpload(uploadID string) (func(), bool) {
+	v, _ := tusLocks.LoadOrStore(uploadID, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs
+// of a key and an optional base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+func setTusHeaders(w nethttp.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// checkTusResumable rejects requests made with a protocol version we do not
+// speak, as required for every request except OPTIONS.
+func checkTusResumable(w nethttp.ResponseWriter, req *nethttp.Request) bool {
+	setTusHeaders(w)
+	if req.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		nethttp.Error(w, "unsupported tus version", nethttp.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func (r *Router) tusOptions(w nethttp.ResponseWriter, req *nethttp.Request) {
+	setTusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.WriteHeader(nethttp.StatusNoContent)
+}
+
+func (r *Router) tusCreate(w nethttp.ResponseWriter, req *nethttp.Request) {
+	if !checkTusResumable(w, req) {
+		return
+	}
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return
+	}
+	if rejectCustomerKey(w, req) {
+		return
+	}
+
+	if req.Header.Get("Upload-Defer-Length") != "" {
+		nethttp.Error(w, "deferred upload length is not supported", nethttp.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		nethttp.Error(w, "invalid Upload-Length", nethttp.StatusBadRequest)
+		return
+	}
+	rawMeta := req.Header.Get("Upload-Metadata")
+	meta, err := parseTusMetadata(rawMeta)
+	if err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+
+	objectKey := strings.TrimSpace(meta["object_key"])
+	if objectKey == "" {
+		objectKey = strings.TrimSpace(meta["filename"])
+	}
+	if err := checkNativeObjectKey(objectKey); err != nil {
+		nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+		return
+	}
+	contentType := strings.TrimSpace(meta["content_type"])
+	if contentType == "" {
+		contentType = strings.TrimSpace(meta["filetype"])
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	ctx := req.Context()
+	limit, err := r.uploadLimit(ctx, bucket, objectKey)
+	if err == nil {
+		err = limit.check(length)
+	}
+	if err != nil {
+		r.writeStoreError(w, err)
+		return
+	}
+	uploadID, err := newUploadID()
+	if err != nil {
+		nethttp.Error(w, "failed to create upload", nethttp.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	u := &models.TusUpload{
+		UploadID:    uploadID,
+		BucketID:    bucket.ID,
+		ObjectKey:   objectKey,
+		ContentType: contentType,
+		BlobKey:     bucketBlobPrefix(bucket.ID) + "tus/" + uploadID + "/",
+		Length:      length,
+		Metadata:    rawMeta,
+		CreatedAt:   now.Unix(),
+		ExpiresAt:   now.Add(UploadExpiry()).Unix(),
+	}
+	dk, err := r.newDataKey(nil)
+	if err != nil {
+		nethttp.Error(w, "failed to create upload", nethttp.StatusInternalServerError)
+		return
+	}
+	if dk != nil {
+		u.Encryption, u.KeyID, u.DataKey = dk.encryption, dk.keyID, dk.wrapped
+	}
+	if u.ID, err = r.tus.CreateUpload(ctx, u); err != nil {
+		nethttp.Error(w, "failed to create upload", nethttp.StatusInternalServerError)
+		return
+	}
+
+	if length == 0 {
+		if _, err := r.finishTusUpload(ctx, bucket, u); err != nil {
+			r.writeStoreError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/"+bucket.Name+"/tus/"+uploadID)
+	w.Header().Set("Upload-Expires", time.Unix(u.ExpiresAt, 0).UTC().Format(nethttp.TimeFormat))
+	w.WriteHeader(nethttp.StatusCreated)
+}
+
+// tusUpload looks up the upload named in the path, answering 404 for unknown
+// and 410 for expired uploads.
+func (r *Router) tusUpload(w nethttp.ResponseWriter, req *nethttp.Request) (*models.Bucket, *models.TusUpload, bool) {
+	bucket, ok := r.bucketFromPath(w, req)
+	if !ok {
+		return nil, nil, false
+	}
+	u, err := r.tus.GetUpload(req.Context(), bucket.ID, chi.URLParam(req, "uploadID"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			nethttp.NotFound(w, req)
+			return nil, nil, false
+		}
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if time.Now().Unix() > u.ExpiresAt {
+		nethttp.Error(w, "upload expired", nethttp.StatusGone)
+		return nil, nil, false
+	}
+	return bucket, u, true
+}
+
+func (r *Router) tusHead(w nethttp.ResponseWriter, req *nethttp.Request) {
+	if !checkTusResumable(w, req) {
+		return
+	}
+	bucket, u, ok := r.tusUpload(w, req)
+	if !ok {
+		return
+	}
+
+	// A client resuming an upload whose data all arrived would take it as
+	// done, so retry creating the object if that failed before. An upload
+	// another request holds is left to that request.
+	if u.Offset == u.Length {
+		if unlock, ok := lockTusUpload(u.UploadID); ok {
+			defer unlock()
+			if !r.retryTusFinish(w, req, bucket, u) {
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	w.Header().Set("Upload-Expires", time.Unix(u.ExpiresAt, 0).UTC().Format(nethttp.TimeFormat))
+	w.WriteHeader(nethttp.StatusOK)
+}
+
+// retryTusFinish creates the object of an upload whose data all arrived but
+// whose object could not be created, unless another request did so first. It
+// reports whether the upload is finished; otherwise it has written the error.
+// The caller holds the upload's lock.
+func (r *Router) retryTusFinish(w nethttp.ResponseWriter, req *nethttp.Request, bucket *models.Bucket, u *models.TusUpload) bool {
+	ctx := req.Context()
+	u, err := r.tus.GetUpload(ctx, bucket.ID, u.UploadID)
+	if err == sql.ErrNoRows {
+		return true
+	}
+	if err != nil {
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return false
+	}
+	if _, err := r.finishTusUpload(ctx, bucket, u); err != nil {
+		r.writeStoreError(w, err)
+		return false
+	}
+	return true
+}
+
+func (r *Router) tusPatch(w nethttp.ResponseWriter, req *nethttp.Request) {
+	if !checkTusResumable(w, req) {
+		return
+	}
+	if req.Header.Get("Content-Type") != tusContentType {
+		nethttp.Error(w, "content type must be "+tusContentType, nethttp.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		nethttp.Error(w, "invalid Upload-Offset", nethttp.StatusBadRequest)
+		return
+	}
+
+	bucket, u, ok := r.tusUpload(w, req)
+	if !ok {
+		return
+	}
+	if rejectCustomerKey(w, req) {
+		return
+	}
+	unlock, ok := lockTusUpload(u.UploadID)
+	if !ok {
+		nethttp.Error(w, "upload is busy", nethttp.StatusLocked)
+		return
+	}
+	defer unlock()
+
+	// Re-read the offset now that we hold the lock.
+	ctx := req.Context()
+	u, err = r.tus.GetUpload(ctx, bucket.ID, u.UploadID)
+	if err != nil {
+		nethttp.NotFound(w, req)
+		return
+	}
+	if offset != u.Offset {
+		nethttp.Error(w, "Upload-Offset does not match", nethttp.StatusConflict)
+		return
+	}
+	if u.Offset == u.Length {
+		// All data arrived before but the object could not be created;
+		// a PATCH without data retries.
+		if !r.retryTusFinish(w, req, bucket, u) {
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		w.Header().Set("Upload-Expires", time.Unix(u.ExpiresAt, 0).UTC().Format(nethttp.TimeFormat))
+		w.WriteHeader(nethttp.StatusNoContent)
+		return
+	}
+
+	// Each request stores what it receives as a chunk named after its
+	// offset, encrypted with the upload's data key if it has one. A chunk
+	// left by a write that failed before its offset could be recorded is
+	// replaced by the next write at that offset.
+	//
+	// Keep whatever arrived even if the client goes away mid request, so it
+	// can resume from there.
+	dataKey, err := r.stagingDataKey(u.Encryption, u.KeyID, u.DataKey)
+	if err != nil {
+		log.Printf("tus upload %s: %v", u.UploadID, err)
+		nethttp.Error(w, "failed to write upload", nethttp.StatusInternalServerError)
+		return
+	}
+	body := &partialReader{r: io.LimitReader(req.Body, u.Length-u.Offset)}
+	received := &countingReader{r: body}
+	var stored io.Reader = received
+	if dataKey != nil {
+		if stored, err = secret.EncryptReader(dataKey, received); err != nil {
+			log.Printf("tus upload %s: %v", u.UploadID, err)
+			nethttp.Error(w, "failed to write upload", nethttp.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := r.blobs.Put(context.WithoutCancel(ctx), tusChunkKey(u, u.Offset), stored); err != nil {
+		log.Printf("tus upload %s: %v", u.UploadID, err)
+		nethttp.Error(w, "failed to write upload", nethttp.StatusInternalServerError)
+		return
+	}
+	copyErr := body.err
+	u.Offset += received.n
+	u.ExpiresAt = time.Now().Add(UploadExpiry()).Unix()
+	if err := r.tus.UpdateOffset(context.WithoutCancel(ctx), u.UploadID, u.Offset, u.ExpiresAt); err != nil {
+		nethttp.Error(w, "failed to record offset", nethttp.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		log.Printf("tus upload %s: %v", u.UploadID, copyErr)
+		nethttp.Error(w, "failed to read request body", nethttp.StatusBadRequest)
+		return
+	}
+
+	if u.Offset == u.Length {
+		if _, err := r.finishTusUpload(ctx, bucket, u); err != nil {
+			r.writeStoreError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Expires", time.Unix(u.ExpiresAt, 0).UTC().Format(nethttp.TimeFormat))
+	w.WriteHeader(nethttp.StatusNoContent)
+}
+
+func (r *Router) tusDelete(w nethttp.ResponseWriter, req *nethttp.Request) {
+	if !checkTusResumable(w, req) {
+		return
+	}
+	_, u, ok := r.tusUpload(w, req)
+	if !ok {
+		return
+	}
+	unlock, ok := lockTusUpload(u.UploadID)
+	if !ok {
+		nethttp.Error(w, "upload is busy", nethttp.StatusLocked)
+		return
+	}
+	defer unlock()
+
+	if err := r.removeTusUpload(req.Context(), u); err != nil {
+		nethttp.Error(w, "failed to terminate upload", nethttp.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(nethttp.StatusNoContent)
+}
+
+// finishTusUpload turns a complete upload into an object, replacing any
+// object stored under the same key, and removes the upload. The upload is
+// also removed if the object is refused for a reason retrying cannot fix;
+// after other failures it is kept so that the client can retry.
+func (r *Router) finishTusUpload(ctx context.Context, bucket *models.Bucket, u *models.TusUpload) (*models.Object, error) {
+	chunks, err := r.tusChunks(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	readers := make([]io.Reader, len(chunks))
+	for i, c := range chunks {
+		readers[i] = c
+	}
+	obj, err := r.storeObject(ctx, bucket, u.ObjectKey, objectAttributes{ContentType: u.ContentType}, io.MultiReader(readers...), u.Length, checksum.Expected{}, writeCondition{})
+	closeAll(chunks)
+	if err != nil {
+		if rejectedUpload(err) {
+			if err := r.removeTusUpload(context.WithoutCancel(ctx), u); err != nil {
+				log.Printf("remove rejected tus upload %s: %v", u.UploadID, err)
+			}
+		}
+		return nil, err
+	}
+	if err := r.removeTusUpload(ctx, u); err != nil {
+		log.Printf("remove finished tus upload %s: %v", u.UploadID, err)
+	}
+	return obj, nil
+}
+
+// rejectedUpload reports whether storing an object failed because its content
+// or the bucket's limits refused it, rather than because of a server error.
+func rejectedUpload(err error) bool {
+	var mismatch *checksum.MismatchError
+	return errors.As(err, &mismatch) ||
+		errors.Is(err, errPreconditionFailed) ||
+		errors.Is(err, errLengthMismatch) ||
+		errors.Is(err, models.ErrObjectTooLarge) ||
+		errors.Is(err, models.ErrQuotaExceeded)
+}
+
+func tusChunkKey(u *models.TusUpload, offset int64) string {
+	return fmt.Sprintf("%s%020d", u.BlobKey, offset)
+}
+
+// tusChunks opens the chunks that make up the upload, in order, decrypting
+// them if the upload has a data key. Writes are limited to the upload's
+// length, so they end exactly at u.Length.
+func (r *Router) tusChunks(ctx context.Context, u *models.TusUpload) ([]io.ReadCloser, error) {
+	dataKey, err := r.stagingDataKey(u.Encryption, u.KeyID, u.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := r.blobs.List(ctx, u.BlobKey)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(infos))
+	for _, info := range infos {
+		sizes[info.Key] = info.Size
+	}
+
+	var chunks []io.ReadCloser
+	for offset := int64(0); offset < u.Length; {
+		key := tusChunkKey(u, offset)
+		size := sizes[key]
+		if size == 0 {
+			closeAll(chunks)
+			return nil, fmt.Errorf("tus upload %s: no data at offset %d", u.UploadID, offset)
+		}
+		f, err := r.blobs.Get(ctx, key)
+		if err != nil {
+			closeAll(chunks)
+			return nil, err
+		}
+		if dataKey != nil {
+			// The stored size includes the encryption overhead.
+			f, size, err = decryptTusChunk(dataKey, f)
+			if err != nil {
+				closeAll(chunks)
+				return nil, fmt.Errorf("tus upload %s: chunk at offset %d: %w", u.UploadID, offset, err)
+			}
+			if size == 0 {
+				f.Close()
+				closeAll(chunks)
+				return nil, fmt.Errorf("tus upload %s: no data at offset %d", u.UploadID, offset)
+			}
+		}
+		chunks = append(chunks, f)
+		offset += size
+	}
+	return chunks, nil
+}
+
+// decryptTusChunk returns a reader of the plaintext of an encrypted chunk
+// and its size. The chunk is closed if that fails.
+func decryptTusChunk(dataKey []byte, chunk io.ReadSeekCloser) (io.ReadSeekCloser, int64, error) {
+	f, err := secret.DecryptReader(dataKey, chunk)
+	if err != nil {
+		chunk.Close()
+		return nil, 0, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+func closeAll(closers []io.ReadCloser) {
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+func (r *Router) removeTusUpload(ctx context.Context, u *models.TusUpload) error {
+	if err := r.tus.DeleteUpload(ctx, u.UploadID); err != nil {
+		return err
+	}
+	tusLocks.Delete(u.UploadID)
+	return storage.DeletePrefix(ctx, r.blobs, u.BlobKey)
+}
+
+// partialReader ends the stream at the first read error instead of
+// returning it, so the data received before the error is kept. The error is
+// recorded in err.
+type partialReader struct {
+	r   io.Reader
+	err error
+}
+
+func (p *partialReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// sweepExpiredTusUploads removes tus uploads that saw no data before their
+// expiry.
+func (r *Router) sweepExpiredTusUploads(ctx context.Context) {
+	uploads, err := r.tus.ListExpired(ctx, time.Now().Unix())
+	if err != nil {
+		log.Printf("sweep expired tus uploads: %v", err)
+		return
+	}
+	for _, u := range uploads {
+		if err := r.removeTusUpload(ctx, u); err != nil {
+			log.Printf("remove expired tus upload %s: %v", u.UploadID, err)
+			continue
+		}
+		log.Printf("removed expired tus upload %s (bucket %d, key %q)", u.UploadID, u.BucketID, u.ObjectKey)
+	}
+}
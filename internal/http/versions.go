@@ -0,0 +1,210 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	nethttp "net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"buck_It_Up/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newVersionID() (string, error) {
+	return newObjectFileName()
+}
+
+// getObjectVersion returns the current object under key, or the given version
+// of it. Delete markers are reported as sql.ErrNoRows, like missing keys.
+func (r *Router) getObjectVersion(ctx context.Context, bucketID int64, objectKey, versionID string) (*models.Object, error) {
+	oStore := r.objects
+	if versionID == "" {
+		return oStore.GetObject(ctx, bucketID, objectKey)
+	}
+	obj, err := oStore.GetVersion(ctx, bucketID, objectKey, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if obj.IsDeleteMarker {
+		return nil, sql.ErrNoRows
+	}
+	return obj, nil
+}
+
+// deleteObjectVersion deletes key. Without a version ID the current object is
+// removed, or hidden behind a delete marker if the bucket keeps versions; with
+// one, that version is removed for good. The version ID of a new delete
+// marker is returned, and sql.ErrNoRows if there is nothing to delete.
+func (r *Router) deleteObjectVersion(ctx context.Context, bucket *models.Bucket, objectKey, versionID string) (string, error) {
+	oStore := r.objects
+	markerID := models.NullVersionID
+	if versionID == "" && bucket.Versioning {
+		var err error
+		if markerID, err = newVersionID(); err != nil {
+			return "", err
+		}
+	}
+
+	unlock := lockObjectKey(bucket.ID, objectKey)
+	var removed *models.Object
+	var err error
+	if versionID != "" {
+		removed, err = oStore.DeleteVersion(ctx, bucket.ID, objectKey, versionID)
+	} else {
+		removed, err = oStore.RemoveCurrentObject(ctx, bucket.ID, objectKey, markerID)
+	}
+	unlock()
+	if err != nil {
+		return "", err
+	}
+	if removed != nil {
+		r.removeObjectBlob(removed)
+	}
+	if versionID != "" || !bucket.Versioning {
+		return "", nil
+	}
+	return markerID, nil
+}
+
+// versionListParams are the query parameters that switch
+// LIST /{bucketName}?versions from returning every version to returning one
+// page.
+var versionListParams = []string{"prefix", "key_marker", "version_id_marker", "max_keys"}
+
+func (r *Router) listObjectVersions(w nethttp.ResponseWriter, req *nethttp.Request, bucket *models.Bucket) {
+	q := req.URL.Query()
+	opts := models.ListVersionsOptions{
+		Prefix:          q.Get("prefix"),
+		KeyMarker:       q.Get("key_marker"),
+		VersionIDMarker: q.Get("version_id_marker"),
+		MaxKeys:         maxListKeys,
+	}
+	if v := q.Get("max_keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			nethttp.Error(w, "invalid max_keys", nethttp.StatusBadRequest)
+			return
+		}
+		opts.MaxKeys = min(n, maxListKeys)
+	}
+	if opts.VersionIDMarker != "" && opts.KeyMarker == "" {
+		nethttp.Error(w, "version_id_marker requires key_marker", nethttp.StatusBadRequest)
+		return
+	}
+
+	paged := slices.ContainsFunc(versionListParams, q.Has)
+	var result any
+	versions := []*models.Object{}
+	for {
+		page, err := r.objects.ListVersionsPage(req.Context(), bucket.ID, opts)
+		if err != nil {
+			nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+			return
+		}
+		if paged {
+			result = page
+			break
+		}
+		versions = append(versions, page.Versions...)
+		if !page.IsTruncated {
+			result = versions
+			break
+		}
+		opts.KeyMarker, opts.VersionIDMarker = page.NextKeyMarker, page.NextVersionIDMarker
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusOK)
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// updateBucket changes bucket settings: versioning, the lifecycle rules and
+// the quota. Lifecycle rules and the quota are replaced as a whole.
+func (r *Router) updateBucket(w nethttp.ResponseWriter, req *nethttp.Request) {
+	name := chi.URLParam(req, "name")
+	if name == "" || strings.Contains(name, "/") {
+		nethttp.Error(w, "invalid bucket name", nethttp.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Versioning     *bool                   `json:"versioning"`
+		LifecycleRules *[]lifecycleRuleRequest `json:"lifecycle_rules"`
+		Quota          *models.BucketQuota     `json:"quota"`
+		Compression    *string                 `json:"compression"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		nethttp.Error(w, "invalid json", nethttp.StatusBadRequest)
+		return
+	}
+	var rules []*models.LifecycleRule
+	if body.LifecycleRules != nil {
+		var err error
+		if rules, err = lifecycleRules(*body.LifecycleRules); err != nil {
+			nethttp.Error(w, err.Error(), nethttp.StatusBadRequest)
+			return
+		}
+	}
+	if q := body.Quota; q != nil && (q.MaxBytes < 0 || q.MaxObjects < 0 || q.MaxObjectSize < 0) {
+		nethttp.Error(w, "invalid quota", nethttp.StatusBadRequest)
+		return
+	}
+	if c := body.Compression; c != nil && *c != "" && *c != encodingGzip {
+		nethttp.Error(w, "invalid compression", nethttp.StatusBadRequest)
+		return
+	}
+
+	store := r.buckets
+	ctx := req.Context()
+	bucket, err := store.GetBucketByName(ctx, name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			nethttp.NotFound(w, req)
+			return
+		}
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+	if body.Versioning != nil {
+		if err := store.SetVersioning(ctx, bucket.ID, *body.Versioning); err != nil {
+			log.Printf("set versioning of bucket %s: %v", name, err)
+			nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+			return
+		}
+		bucket.Versioning = *body.Versioning
+	}
+	if body.LifecycleRules != nil {
+		if err := r.lifecycle.SetRules(ctx, bucket.ID, rules); err != nil {
+			log.Printf("set lifecycle rules of bucket %s: %v", name, err)
+			nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+			return
+		}
+	}
+	if body.Quota != nil {
+		if err := store.SetQuota(ctx, bucket.ID, *body.Quota); err != nil {
+			log.Printf("set quota of bucket %s: %v", name, err)
+			nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+			return
+		}
+		bucket.Quota = *body.Quota
+	}
+	if body.Compression != nil {
+		if err := store.SetCompression(ctx, bucket.ID, *body.Compression); err != nil {
+			log.Printf("set compression of bucket %s: %v", name, err)
+			nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+			return
+		}
+		bucket.Compression = *body.Compression
+	}
+	if err := r.loadBucketDetails(ctx, bucket); err != nil {
+		nethttp.Error(w, "internal error", nethttp.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(nethttp.StatusOK)
+	_ = json.NewEncoder(w).Encode(bucket)
+}
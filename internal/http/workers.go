@@ -0,0 +1,72 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Instances sharing a database split the background work between them.
+// Periodic workers run in whichever instance holds their lease, which it
+// keeps renewing while it is alive; jobs are claimed by the instance running
+// them and taken over by another once they stop making progress.
+
+// Names of the leases of background workers.
+const (
+	leaseUploadSweeper = "upload-sweeper"
+	leaseLifecycle     = "lifecycle"
+	leaseReconcile     = "reconcile"
+)
+
+const (
+	// jobStaleAfter is how long a job may go without recording progress
+	// before another instance takes it over.
+	jobStaleAfter = 10 * time.Minute
+	// JobScanInterval is how often instances look for jobs nobody is
+	// running.
+	JobScanInterval = time.Minute
+)
+
+// InstanceID returns the name this instance claims leases and jobs under,
+// configured via BUCKITUP_INSTANCE_ID. It defaults to the host name and
+// process ID, which stay the same when a container restarts, so a restarted
+// instance picks up its own work without waiting for it to go stale.
+func InstanceID() string {
+	if v := os.Getenv("BUCKITUP_INSTANCE_ID"); v != "" {
+		return v
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "buckitup"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// holdLease takes or extends the lease name for ttl and reports whether this
+// instance holds it. Errors are logged and count as not holding it.
+func (r *Router) holdLease(ctx context.Context, name string, ttl time.Duration) bool {
+	ok, err := r.leases.Acquire(ctx, name, r.instanceID, ttl)
+	if err != nil {
+		log.Printf("acquire lease %s: %v", name, err)
+		return false
+	}
+	return ok
+}
+
+// RunJobScanner resumes the jobs nobody is running every interval until
+// ctx is done: those of instances that stopped, including this one before a
+// restart.
+func (r *Router) RunJobScanner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.ResumeJobs(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
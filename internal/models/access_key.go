@@ -6,17 +6,17 @@ import (
 )
 
 type AccessKeyStore struct {
-	db *sql.DB
+	db *preparedDB
 }
 
 func NewAccessKeyStore(db *sql.DB) *AccessKeyStore {
-	return &AccessKeyStore{db: db}
+	return &AccessKeyStore{db: newPreparedDB(db)}
 }
 
 func (s *AccessKeyStore) GetByKeyID(ctx context.Context, keyID string) (*AccessKey, error) {
 	var ak AccessKey
 	err := s.db.QueryRowContext(ctx, `
-        SELECT id, bucket_id, key_id, secret_hash, role, created_at
+        SELECT id, bucket_id, key_id, secret_hash, COALESCE(secret_sealed, ''), role, created_at
         FROM access_keys
         WHERE key_id = ?
     `, keyID).Scan(
@@ -24,6 +24,7 @@ func (s *AccessKeyStore) GetByKeyID(ctx context.Context, keyID string) (*AccessK
 		&ak.BucketID,
 		&ak.KeyID,
 		&ak.SecretHash,
+		&ak.SecretSealed,
 		&ak.Role,
 		&ak.CreatedAt,
 	)
@@ -34,21 +35,24 @@ func (s *AccessKeyStore) GetByKeyID(ctx context.Context, keyID string) (*AccessK
 }
 
 func (s *AccessKeyStore) CreateAccessKey(ctx context.Context, ak *AccessKey) (int64, error) {
-	res, err := s.db.ExecContext(ctx, `
+	var id int64
+	err := s.db.QueryRowContext(ctx, `
 		INSERT INTO access_keys (
-			bucket_id, key_id, secret_hash, role, created_at
-		) VALUES (?, ?, ?, ?, ?)
+			bucket_id, key_id, secret_hash, secret_sealed, role, created_at
+		) VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id
 	`,
 		ak.BucketID,
 		ak.KeyID,
 		ak.SecretHash,
+		ak.SecretSealed,
 		ak.Role,
 		ak.CreatedAt,
-	)
+	).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	return id, nil
 }
 
 func (s *AccessKeyStore) DeleteAccessKeyByBucketAndRole(ctx context.Context, bucketID int64, role AccessKeyRole) error {
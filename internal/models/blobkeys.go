@@ -0,0 +1,64 @@
+package models
+
+import (
+	"context"
+)
+
+// blobKeyColumns are the columns that hold blob keys.
+var blobKeyColumns = []struct{ table, column string }{
+	{"objects", "file_path"},
+	{"object_versions", "file_path"},
+	{"upload_parts", "file_path"},
+	{"tus_uploads", "file_path"},
+	{"blob_refs", "blob_key"},
+}
+
+// MigrateFilePaths turns the file paths stored before content moved behind
+// a storage backend into blob keys by stripping prefix, the data directory
+// they were created in. Unfinished tus uploads kept their data in a single
+// file, which the chunked layout used now cannot resume; they are deleted
+// and the keys of their files returned so the caller can remove them.
+func (s *ObjectStore) MigrateFilePaths(ctx context.Context, prefix string) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, c := range blobKeyColumns {
+		if _, err := tx.ExecContext(ctx, `
+            UPDATE `+c.table+` SET `+c.column+` = substr(`+c.column+`, length(CAST(?1 AS TEXT)) + 1)
+            WHERE substr(`+c.column+`, 1, length(CAST(?1 AS TEXT))) = ?1
+        `, prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+        SELECT file_path FROM tus_uploads
+        WHERE file_path NOT LIKE '%/'
+    `)
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stale = append(stale, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+        DELETE FROM tus_uploads
+        WHERE file_path NOT LIKE '%/'
+    `); err != nil {
+		return nil, err
+	}
+	return stale, tx.Commit()
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Every row of objects and object_versions that is not a delete marker
+// references the blob under its file_path. blob_refs counts those references
+// per blob so that a blob shared by several objects, as content addressed
+// blobs are, is only removed once the last of them is gone. The counts are
+// kept in the same transaction as the rows; a blob whose count has dropped
+// to zero is removed by the caller through ReleaseBlob.
+
+// BlobStore keeps the reference counts of stored blobs.
+type BlobStore struct {
+	db *preparedDB
+}
+
+func NewBlobStore(db *sql.DB) *BlobStore {
+	return &BlobStore{db: newPreparedDB(db)}
+}
+
+func addBlobRef(ctx context.Context, tx *sql.Tx, o *Object) error {
+	if o.BlobKey == "" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `
+        INSERT INTO blob_refs (blob_key, size, refcount) VALUES (?, ?, 1)
+        ON CONFLICT(blob_key) DO UPDATE SET refcount = blob_refs.refcount + 1
+    `, o.BlobKey, o.Size)
+	return err
+}
+
+func dropBlobRef(ctx context.Context, tx *sql.Tx, o *Object) error {
+	if o.BlobKey == "" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `
+        UPDATE blob_refs SET refcount = refcount - 1
+        WHERE blob_key = ?
+    `, o.BlobKey)
+	return err
+}
+
+// dropBucketBlobRefs drops the references held by every object and version
+// in the bucket.
+func dropBucketBlobRefs(ctx context.Context, tx *sql.Tx, bucketID int64) error {
+	_, err := tx.ExecContext(ctx, `
+        UPDATE blob_refs SET refcount = refcount - (
+            SELECT COUNT(*) FROM (
+                SELECT file_path FROM objects WHERE bucket_id = ?1
+                UNION ALL
+                SELECT file_path FROM object_versions WHERE bucket_id = ?1
+            ) r
+            WHERE r.file_path = blob_refs.blob_key
+        )
+        WHERE blob_key IN (
+            SELECT file_path FROM objects WHERE bucket_id = ?1
+            UNION
+            SELECT file_path FROM object_versions WHERE bucket_id = ?1
+        )
+    `, bucketID)
+	return err
+}
+
+// IsReferenced reports whether any object references the blob.
+func (s *BlobStore) IsReferenced(ctx context.Context, key string) (bool, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, `
+        SELECT refcount FROM blob_refs
+        WHERE blob_key = ?
+    `, key).Scan(&n)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return n > 0, err
+}
+
+// IsKnown reports whether the blob is referenced by an object, a multipart
+// part or a tus upload, whose rows hold the prefix their chunks are stored
+// under.
+func (s *BlobStore) IsKnown(ctx context.Context, key string) (bool, error) {
+	var known bool
+	err := s.db.QueryRowContext(ctx, `
+        SELECT EXISTS (SELECT 1 FROM blob_refs WHERE blob_key = ?1 AND refcount > 0)
+            OR EXISTS (SELECT 1 FROM upload_parts WHERE file_path = ?1)
+            OR EXISTS (SELECT 1 FROM tus_uploads WHERE substr(CAST(?1 AS TEXT), 1, length(file_path)) = file_path)
+    `, key).Scan(&known)
+	return known, err
+}
+
+// ListKnown returns the keys of the blobs objects and multipart parts
+// reference, sorted, and the prefixes tus uploads store their chunks under.
+// Together they are what IsKnown reports as known.
+func (s *BlobStore) ListKnown(ctx context.Context) (keys, prefixes []string, err error) {
+	if keys, err = s.queryStrings(ctx, `
+        SELECT blob_key FROM blob_refs WHERE refcount > 0
+        UNION
+        SELECT file_path FROM upload_parts
+        ORDER BY 1
+    `); err != nil {
+		return nil, nil, err
+	}
+	prefixes, err = s.queryStrings(ctx, `SELECT file_path FROM tus_uploads ORDER BY file_path`)
+	return keys, prefixes, err
+}
+
+func (s *BlobStore) queryStrings(ctx context.Context, query string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// ReleaseBlob forgets the blob if nothing references it any more and
+// reports whether the caller should remove it. The caller must make sure no
+// reference is added concurrently.
+func (s *BlobStore) ReleaseBlob(ctx context.Context, key string) (bool, error) {
+	referenced, err := s.IsReferenced(ctx, key)
+	if err != nil || referenced {
+		return false, err
+	}
+	_, err = s.db.ExecContext(ctx, `
+        DELETE FROM blob_refs
+        WHERE blob_key = ? AND refcount <= 0
+    `, key)
+	return err == nil, err
+}
+
+// ListUnreferenced returns up to limit keys after the given one of blobs that
+// are no longer referenced but were not released yet, e.g. because the
+// server stopped in between.
+func (s *BlobStore) ListUnreferenced(ctx context.Context, after string, limit int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT blob_key FROM blob_refs
+        WHERE refcount <= 0 AND blob_key > ?
+        ORDER BY blob_key
+        LIMIT ?
+    `, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -3,50 +3,80 @@ package models
 import (
 	"context"
 	"database/sql"
+	"errors"
 )
 
+var (
+	// ErrQuotaExceeded is returned by writes that would take a bucket over
+	// its MaxBytes or MaxObjects quota.
+	ErrQuotaExceeded = errors.New("bucket quota exceeded")
+	// ErrObjectTooLarge is returned by writes of objects larger than the
+	// MaxObjectSize of their bucket.
+	ErrObjectTooLarge = errors.New("object exceeds the maximum object size of the bucket")
+)
+
+const bucketColumns = `id, name, created_at, versioning, max_bytes, max_objects, max_object_size, compression`
+
+// queryRower is implemented by *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func scanBucket(row interface{ Scan(...any) error }) (*Bucket, error) {
+	var b Bucket
+	if err := row.Scan(
+		&b.ID, &b.Name, &b.CreatedAt, &b.Versioning,
+		&b.Quota.MaxBytes, &b.Quota.MaxObjects, &b.Quota.MaxObjectSize,
+		&b.Compression,
+	); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
 type BucketStore struct {
-	db *sql.DB
+	db *preparedDB
 }
 
 func NewBucketStore(db *sql.DB) *BucketStore {
-	return &BucketStore{db: db}
+	return &BucketStore{db: newPreparedDB(db)}
 }
 
 func (s *BucketStore) NewBucket(ctx context.Context, b *Bucket) (int64, error) {
-	res, err := s.db.ExecContext(ctx, `
+	var id int64
+	err := s.db.QueryRowContext(ctx, `
         INSERT INTO buckets (
             name, created_at
         ) VALUES (?, ?)
+        RETURNING id
     `,
 		b.Name, b.CreatedAt,
-	)
+	).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	return id, nil
 }
 
 func (s *BucketStore) GetBucketByName(ctx context.Context, bucketName string) (*Bucket, error) {
-	var b Bucket
-	err := s.db.QueryRowContext(ctx, `
-        SELECT id, name, created_at
+	return scanBucket(s.db.QueryRowContext(ctx, `
+        SELECT `+bucketColumns+`
         FROM buckets
         WHERE name = ?
-    `,
-		bucketName,
-	).Scan(
-		&b.ID, &b.Name, &b.CreatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
-	return &b, nil
+    `, bucketName))
+}
+
+func (s *BucketStore) GetBucketByID(ctx context.Context, bucketID int64) (*Bucket, error) {
+	return scanBucket(s.db.QueryRowContext(ctx, `
+        SELECT `+bucketColumns+`
+        FROM buckets
+        WHERE id = ?
+    `, bucketID))
 }
 
 func (s *BucketStore) ListBuckets(ctx context.Context) ([]*Bucket, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, name, created_at
+		SELECT `+bucketColumns+`
 		FROM buckets
 	`)
 	if err != nil {
@@ -56,11 +86,11 @@ func (s *BucketStore) ListBuckets(ctx context.Context) ([]*Bucket, error) {
 
 	var buckets []*Bucket
 	for rows.Next() {
-		var b Bucket
-		if err := rows.Scan(&b.ID, &b.Name, &b.CreatedAt); err != nil {
+		b, err := scanBucket(rows)
+		if err != nil {
 			return nil, err
 		}
-		buckets = append(buckets, &b)
+		buckets = append(buckets, b)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -68,10 +98,206 @@ func (s *BucketStore) ListBuckets(ctx context.Context) ([]*Bucket, error) {
 	return buckets, nil
 }
 
-func (s *BucketStore) DeleteBucketByName(ctx context.Context, bucketName string) error {
+func (s *BucketStore) SetVersioning(ctx context.Context, bucketID int64, enabled bool) error {
 	_, err := s.db.ExecContext(ctx, `
-        DELETE FROM buckets
-        WHERE name = ?
-    `, bucketName)
+        UPDATE buckets SET versioning = ?
+        WHERE id = ?
+    `, enabled, bucketID)
+	return err
+}
+
+func (s *BucketStore) SetQuota(ctx context.Context, bucketID int64, q BucketQuota) error {
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE buckets SET max_bytes = ?, max_objects = ?, max_object_size = ?
+        WHERE id = ?
+    `, q.MaxBytes, q.MaxObjects, q.MaxObjectSize, bucketID)
+	return err
+}
+
+func (s *BucketStore) SetCompression(ctx context.Context, bucketID int64, compression string) error {
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE buckets SET compression = ?
+        WHERE id = ?
+    `, compression, bucketID)
 	return err
 }
+
+func (s *BucketStore) GetUsage(ctx context.Context, bucketID int64) (*BucketUsage, error) {
+	u, err := bucketUsage(ctx, s.db, bucketID)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.QueryRowContext(ctx, `
+        SELECT COALESCE(SUM(size), 0) FROM (`+bucketBlobsQuery+`
+            WHERE bucket_id = ?
+        ) AS blobs
+    `, bucketID).Scan(&u.StoredBytes)
+	if err != nil {
+		return nil, err
+	}
+	u.DedupSavedBytes = u.Bytes - u.StoredBytes
+	return u, nil
+}
+
+// bucketBlobsQuery lists the distinct blobs referenced by each bucket.
+const bucketBlobsQuery = `
+            SELECT DISTINCT bucket_id, file_path, size FROM (
+                SELECT bucket_id, file_path, size FROM objects
+                UNION ALL
+                SELECT bucket_id, file_path, size FROM object_versions WHERE is_delete_marker = FALSE
+            ) AS refs`
+
+// ListUsage returns the usage of every bucket that holds anything, by bucket
+// ID.
+func (s *BucketStore) ListUsage(ctx context.Context) (map[int64]*BucketUsage, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT bucket_id, SUM(objects), SUM(bytes) FROM (
+            SELECT bucket_id, COUNT(*) AS objects, SUM(size) AS bytes
+            FROM objects GROUP BY bucket_id
+            UNION ALL
+            SELECT bucket_id, 0, SUM(size)
+            FROM object_versions WHERE is_delete_marker = FALSE GROUP BY bucket_id
+        ) AS counts
+        GROUP BY bucket_id
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[int64]*BucketUsage)
+	for rows.Next() {
+		var bucketID int64
+		var u BucketUsage
+		if err := rows.Scan(&bucketID, &u.Objects, &u.Bytes); err != nil {
+			return nil, err
+		}
+		usage[bucketID] = &u
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = s.db.QueryContext(ctx, `
+        SELECT bucket_id, SUM(size) FROM (`+bucketBlobsQuery+`
+        ) AS blobs
+        GROUP BY bucket_id
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bucketID, stored int64
+		if err := rows.Scan(&bucketID, &stored); err != nil {
+			return nil, err
+		}
+		if u := usage[bucketID]; u != nil {
+			u.StoredBytes = stored
+			u.DedupSavedBytes = u.Bytes - stored
+		}
+	}
+	return usage, rows.Err()
+}
+
+func bucketUsage(ctx context.Context, q queryRower, bucketID int64) (*BucketUsage, error) {
+	var u BucketUsage
+	err := q.QueryRowContext(ctx, `
+        SELECT
+            (SELECT COUNT(*) FROM objects WHERE bucket_id = ?),
+            (SELECT COALESCE(SUM(size), 0) FROM objects WHERE bucket_id = ?) +
+            (SELECT COALESCE(SUM(size), 0) FROM object_versions WHERE bucket_id = ? AND is_delete_marker = FALSE)
+    `, bucketID, bucketID, bucketID).Scan(&u.Objects, &u.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// checkQuota fails with ErrObjectTooLarge or ErrQuotaExceeded if o, which
+// has just been written in tx, breaks the quota of its bucket. Checking
+// after the write means the usage includes it and anything it replaced.
+func checkQuota(ctx context.Context, tx *sql.Tx, o *Object) error {
+	var q BucketQuota
+	err := tx.QueryRowContext(ctx, `
+        SELECT max_bytes, max_objects, max_object_size
+        FROM buckets
+        WHERE id = ?
+    `, o.BucketID).Scan(&q.MaxBytes, &q.MaxObjects, &q.MaxObjectSize)
+	if err != nil {
+		return err
+	}
+	if q.MaxObjectSize > 0 && o.Size > q.MaxObjectSize {
+		return ErrObjectTooLarge
+	}
+	if q.MaxBytes == 0 && q.MaxObjects == 0 {
+		return nil
+	}
+	u, err := bucketUsage(ctx, tx, o.BucketID)
+	if err != nil {
+		return err
+	}
+	if (q.MaxBytes > 0 && u.Bytes > q.MaxBytes) || (q.MaxObjects > 0 && u.Objects > q.MaxObjects) {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// DeleteBucketByName deletes the bucket together with its access keys and
+// lifecycle rules. Where foreign keys are enforced it fails with a foreign
+// key violation if objects or uploads still refer to the bucket.
+func (s *BucketStore) DeleteBucketByName(ctx context.Context, bucketName string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`DELETE FROM access_keys WHERE bucket_id IN (SELECT id FROM buckets WHERE name = ?)`,
+		`DELETE FROM lifecycle_rules WHERE bucket_id IN (SELECT id FROM buckets WHERE name = ?)`,
+		`DELETE FROM buckets WHERE name = ?`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt, bucketName); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteBucketWithContents deletes the bucket together with all rows that
+// belong to it: objects and their versions, metadata and tags, unfinished
+// uploads, jobs and access keys. The caller removes the blobs that are no longer
+// referenced.
+func (s *BucketStore) DeleteBucketWithContents(ctx context.Context, bucketID int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := dropBucketBlobRefs(ctx, tx, bucketID); err != nil {
+		return err
+	}
+	stmts := []string{
+		`DELETE FROM object_tags WHERE bucket_id = ?`,
+		`DELETE FROM object_metadata WHERE bucket_id = ?`,
+		`DELETE FROM object_versions WHERE bucket_id = ?`,
+		`DELETE FROM objects WHERE bucket_id = ?`,
+		`DELETE FROM upload_parts WHERE upload_id IN (SELECT upload_id FROM multipart_uploads WHERE bucket_id = ?)`,
+		`DELETE FROM multipart_uploads WHERE bucket_id = ?`,
+		`DELETE FROM tus_uploads WHERE bucket_id = ?`,
+		`DELETE FROM jobs WHERE bucket_id = ?`,
+		`DELETE FROM lifecycle_rules WHERE bucket_id = ?`,
+		`DELETE FROM access_keys WHERE bucket_id = ?`,
+		`DELETE FROM buckets WHERE id = ?`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt, bucketID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
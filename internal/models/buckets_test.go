@@ -0,0 +1,117 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	type write struct {
+		key       string
+		versionID string
+		size      int64
+		err       error
+	}
+	tests := []struct {
+		name   string
+		quota  BucketQuota
+		writes []write
+		// usage after the writes.
+		objects, bytes int64
+	}{
+		{
+			name:  "max object size",
+			quota: BucketQuota{MaxObjectSize: 10},
+			writes: []write{
+				{"a", "", 10, nil},
+				{"b", "", 11, ErrObjectTooLarge},
+				{"a", "", 11, ErrObjectTooLarge},
+			},
+			objects: 1, bytes: 10,
+		},
+		{
+			name:  "max objects",
+			quota: BucketQuota{MaxObjects: 2},
+			writes: []write{
+				{"a", "", 1, nil},
+				{"b", "", 1, nil},
+				{"c", "", 1, ErrQuotaExceeded},
+				// Replacing an object does not add one.
+				{"b", "", 5, nil},
+			},
+			objects: 2, bytes: 6,
+		},
+		{
+			name:  "max bytes",
+			quota: BucketQuota{MaxBytes: 100},
+			writes: []write{
+				{"a", "", 50, nil},
+				{"b", "", 50, nil},
+				{"c", "", 1, ErrQuotaExceeded},
+				// What is replaced is freed.
+				{"a", "", 40, nil},
+				{"c", "", 10, nil},
+				{"b", "", 51, ErrQuotaExceeded},
+			},
+			objects: 3, bytes: 100,
+		},
+		{
+			name:  "versions count towards max bytes",
+			quota: BucketQuota{MaxBytes: 100},
+			writes: []write{
+				{"a", "v1", 50, nil},
+				{"a", "v2", 50, nil},
+				{"a", "v3", 1, ErrQuotaExceeded},
+				{"b", "v1", 1, ErrQuotaExceeded},
+			},
+			objects: 1, bytes: 100,
+		},
+		{
+			name:  "no quota",
+			quota: BucketQuota{},
+			writes: []write{
+				{"a", "", 1 << 40, nil},
+				{"b", "", 1 << 40, nil},
+			},
+			objects: 2, bytes: 2 << 40,
+		},
+	}
+	for name, open := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			d := open()
+			bStore := NewBucketStore(d)
+			oStore := NewObjectStore(d)
+			for _, tt := range tests {
+				bucketID := newTestBucket(t, d)
+				if err := bStore.SetQuota(ctx, bucketID, tt.quota); err != nil {
+					t.Fatalf("%s: set quota: %v", tt.name, err)
+				}
+				for i, w := range tt.writes {
+					_, err := oStore.ReplaceObject(ctx, &Object{
+						BucketID:  bucketID,
+						ObjectKey: w.key,
+						BlobKey:   fmt.Sprintf("test/%d/%d", bucketID, i),
+						Size:      w.size,
+						Checksum:  "0",
+						CreatedAt: int64(1000 + i),
+						VersionID: w.versionID,
+					}, nil)
+					if !errors.Is(err, w.err) {
+						t.Errorf("%s: write %d of %d bytes to %s = %v, want %v", tt.name, i, w.size, w.key, err, w.err)
+					}
+				}
+				// Refused writes leave nothing behind.
+				u, err := bStore.GetUsage(ctx, bucketID)
+				if err != nil {
+					t.Fatalf("%s: usage: %v", tt.name, err)
+				}
+				if u.Objects != tt.objects || u.Bytes != tt.bytes {
+					t.Errorf("%s: usage %d objects, %d bytes; want %d, %d", tt.name, u.Objects, u.Bytes, tt.objects, tt.bytes)
+				}
+			}
+		})
+	}
+}
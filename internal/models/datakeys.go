@@ -0,0 +1,90 @@
+package models
+
+import (
+	"context"
+	"fmt"
+)
+
+const rewrapBatchSize = 500
+
+// RewrapDataKeys rewraps the data keys of the objects, versions and
+// unfinished uploads encrypted under a master key other than currentKeyID.
+// rewrap is given the ID of the master key a data key is wrapped by and the
+// wrapped key, and returns the key wrapped by the current master key. Object
+// content is not touched. It returns the number of data keys rewrapped.
+func (s *ObjectStore) RewrapDataKeys(ctx context.Context, currentKeyID string, rewrap func(keyID, dataKey string) (string, error)) (int, error) {
+	rewrapped := 0
+	for _, table := range []string{"objects", "object_versions", "multipart_uploads", "tus_uploads"} {
+		var after int64
+		for {
+			n, last, err := s.rewrapBatch(ctx, table, after, currentKeyID, rewrap)
+			rewrapped += n
+			if err != nil {
+				return rewrapped, err
+			}
+			if last == 0 {
+				break
+			}
+			after = last
+		}
+	}
+	return rewrapped, nil
+}
+
+// rewrapBatch rewraps up to rewrapBatchSize data keys of table from rows
+// after the given id in one transaction. It returns the number of keys
+// rewrapped and the id of the last row, 0 if there were none left.
+func (s *ObjectStore) rewrapBatch(ctx context.Context, table string, after int64, currentKeyID string, rewrap func(keyID, dataKey string) (string, error)) (int, int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+        SELECT id, key_id, data_key FROM `+table+`
+        WHERE encryption = ? AND key_id != ? AND id > ?
+        ORDER BY id
+        LIMIT ?
+    `, EncryptionMaster, currentKeyID, after, rewrapBatchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	type wrappedKey struct {
+		id           int64
+		keyID, value string
+	}
+	var keys []wrappedKey
+	for rows.Next() {
+		var k wrappedKey
+		if err := rows.Scan(&k.id, &k.keyID, &k.value); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(keys) == 0 {
+		return 0, 0, nil
+	}
+
+	for _, k := range keys {
+		value, err := rewrap(k.keyID, k.value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("rewrap data key of %s row %d: %w", table, k.id, err)
+		}
+		if _, err := tx.ExecContext(ctx, `
+            UPDATE `+table+` SET key_id = ?, data_key = ?
+            WHERE id = ? AND data_key = ?
+        `, currentKeyID, value, k.id, k.value); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return len(keys), keys[len(keys)-1].id, nil
+}
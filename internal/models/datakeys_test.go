@@ -0,0 +1,112 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRewrapDataKeys(t *testing.T) {
+	for name, open := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			d := open()
+			oStore := NewObjectStore(d)
+			mStore := NewMultipartStore(d)
+			tStore := NewTusStore(d)
+			bucketID := newTestBucket(t, d)
+			// Key IDs of their own keep rows of other tests sharing the
+			// database out of the way.
+			oldKey := fmt.Sprintf("old-%d", time.Now().UnixNano())
+			newKey := fmt.Sprintf("new-%d", time.Now().UnixNano())
+
+			put := func(key, versionID, encryption string) {
+				t.Helper()
+				_, err := oStore.ReplaceObject(ctx, &Object{
+					BucketID:   bucketID,
+					ObjectKey:  key,
+					BlobKey:    fmt.Sprintf("test/%d/%s-%s", bucketID, key, versionID),
+					Checksum:   "0",
+					CreatedAt:  1000,
+					VersionID:  versionID,
+					Encryption: encryption,
+					KeyID:      oldKey,
+					DataKey:    "key of " + key + "@" + versionID,
+				}, nil)
+				if err != nil {
+					t.Fatalf("put %s@%s: %v", key, versionID, err)
+				}
+			}
+			put("a", "a1", EncryptionMaster)
+			put("a", "a2", EncryptionMaster)
+			put("customer", "c1", EncryptionCustomer)
+
+			uploadID := fmt.Sprintf("upload-%d", time.Now().UnixNano())
+			if _, err := mStore.CreateUpload(ctx, &MultipartUpload{
+				UploadID: uploadID, BucketID: bucketID, ObjectKey: "m", CreatedAt: 1000,
+				Encryption: EncryptionMaster, KeyID: oldKey, DataKey: "key of " + uploadID,
+			}); err != nil {
+				t.Fatalf("create multipart upload: %v", err)
+			}
+			t.Cleanup(func() { _ = mStore.DeleteUpload(ctx, uploadID) })
+			tusID := fmt.Sprintf("tus-%d", time.Now().UnixNano())
+			if _, err := tStore.CreateUpload(ctx, &TusUpload{
+				UploadID: tusID, BucketID: bucketID, ObjectKey: "t", BlobKey: "test/" + tusID + "/",
+				Length: 1, CreatedAt: 1000, ExpiresAt: time.Now().Add(time.Hour).Unix(),
+				Encryption: EncryptionMaster, KeyID: oldKey, DataKey: "key of " + tusID,
+			}); err != nil {
+				t.Fatalf("create tus upload: %v", err)
+			}
+			t.Cleanup(func() { _ = tStore.DeleteUpload(ctx, tusID) })
+
+			rewrap := func(keyID, dataKey string) (string, error) {
+				if keyID != oldKey {
+					return "", fmt.Errorf("rewrap of a key wrapped by %s", keyID)
+				}
+				return "rewrapped " + dataKey, nil
+			}
+			n, err := oStore.RewrapDataKeys(ctx, newKey, rewrap)
+			if err != nil {
+				t.Fatalf("rewrap: %v", err)
+			}
+			if n != 4 {
+				t.Errorf("rewrapped %d keys, want 4", n)
+			}
+
+			page, err := oStore.ListVersionsPage(ctx, bucketID, ListVersionsOptions{})
+			if err != nil {
+				t.Fatalf("list versions: %v", err)
+			}
+			for _, v := range page.Versions {
+				want := "rewrapped key of " + v.ObjectKey + "@" + v.VersionID
+				if v.Encryption == EncryptionCustomer {
+					// Customer keys are not the server's to rewrap.
+					want = want[len("rewrapped "):]
+				}
+				if v.DataKey != want {
+					t.Errorf("%s@%s: data key %q, want %q", v.ObjectKey, v.VersionID, v.DataKey, want)
+				}
+			}
+			u, err := mStore.GetUpload(ctx, bucketID, uploadID)
+			if err != nil {
+				t.Fatalf("get multipart upload: %v", err)
+			}
+			if u.KeyID != newKey || u.DataKey != "rewrapped key of "+uploadID {
+				t.Errorf("multipart upload: key %s %q", u.KeyID, u.DataKey)
+			}
+			tu, err := tStore.GetUpload(ctx, bucketID, tusID)
+			if err != nil {
+				t.Fatalf("get tus upload: %v", err)
+			}
+			if tu.KeyID != newKey || tu.DataKey != "rewrapped key of "+tusID {
+				t.Errorf("tus upload: key %s %q", tu.KeyID, tu.DataKey)
+			}
+
+			// Keys wrapped by the current master key are left alone.
+			if n, err := oStore.RewrapDataKeys(ctx, newKey, rewrap); err != nil || n != 0 {
+				t.Errorf("second rewrap = %d, %v; want nothing to do", n, err)
+			}
+		})
+	}
+}
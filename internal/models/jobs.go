@@ -0,0 +1,136 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrJobLost is returned by updates of a job that another instance has
+// claimed, having found it stale.
+var ErrJobLost = errors.New("job claimed by another instance")
+
+type JobStore struct {
+	db *preparedDB
+}
+
+func NewJobStore(db *sql.DB) *JobStore {
+	return &JobStore{db: newPreparedDB(db)}
+}
+
+const jobColumns = `id, bucket_id, kind, prefix, status, processed, error, created_at, updated_at, owner`
+
+func scanJob(row rowScanner) (*Job, error) {
+	var j Job
+	err := row.Scan(
+		&j.ID, &j.BucketID, &j.Kind, &j.Prefix, &j.Status, &j.Processed,
+		&j.Error, &j.CreatedAt, &j.UpdatedAt, &j.Owner,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (s *JobStore) CreateJob(ctx context.Context, j *Job) error {
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO jobs (`+jobColumns+`)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+		j.ID, j.BucketID, j.Kind, j.Prefix, j.Status, j.Processed,
+		j.Error, j.CreatedAt, j.UpdatedAt, j.Owner,
+	)
+	return err
+}
+
+func (s *JobStore) GetJob(ctx context.Context, bucketID int64, id string) (*Job, error) {
+	return scanJob(s.db.QueryRowContext(ctx, `
+        SELECT `+jobColumns+`
+        FROM jobs
+        WHERE bucket_id = ? AND id = ?
+    `, bucketID, id))
+}
+
+// ListRunningJobs returns the jobs of all buckets that have not finished,
+// oldest first.
+func (s *JobStore) ListRunningJobs(ctx context.Context) ([]*Job, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT `+jobColumns+`
+        FROM jobs
+        WHERE status = ?
+        ORDER BY created_at
+    `, JobRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// ClaimJob makes owner the instance running the job, provided the job is
+// still running and either nobody runs it, owner already does, or its owner
+// has not recorded progress since staleBefore. It reports whether the job
+// was claimed.
+func (s *JobStore) ClaimJob(ctx context.Context, j *Job, owner string, staleBefore int64) (bool, error) {
+	now := time.Now().Unix()
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE jobs SET owner = ?, updated_at = ?
+        WHERE id = ? AND status = ? AND (owner = '' OR owner = ? OR updated_at < ?)
+    `, owner, now, j.ID, JobRunning, owner, staleBefore)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	j.Owner, j.UpdatedAt = owner, now
+	return true, nil
+}
+
+// UpdateProgress records the number of objects the job has handled so far.
+// ErrJobLost is returned if another instance has claimed the job since.
+func (s *JobStore) UpdateProgress(ctx context.Context, j *Job) error {
+	j.UpdatedAt = time.Now().Unix()
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE jobs SET processed = ?, updated_at = ?
+        WHERE id = ? AND owner = ?
+    `, j.Processed, j.UpdatedAt, j.ID, j.Owner)
+	return jobUpdated(res, err)
+}
+
+// FinishJob records the final status of the job. errMsg is empty unless the
+// job failed. ErrJobLost is returned if another instance has claimed the job
+// since.
+func (s *JobStore) FinishJob(ctx context.Context, j *Job, status JobStatus, errMsg string) error {
+	j.Status, j.Error, j.UpdatedAt = status, errMsg, time.Now().Unix()
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE jobs SET status = ?, processed = ?, error = ?, updated_at = ?
+        WHERE id = ? AND owner = ?
+    `, j.Status, j.Processed, j.Error, j.UpdatedAt, j.ID, j.Owner)
+	return jobUpdated(res, err)
+}
+
+func jobUpdated(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobLost
+	}
+	return nil
+}
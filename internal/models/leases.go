@@ -0,0 +1,42 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// LeaseStore hands out named leases, so that of several instances sharing
+// the database only one at a time does a piece of background work.
+type LeaseStore struct {
+	db *preparedDB
+}
+
+func NewLeaseStore(db *sql.DB) *LeaseStore {
+	return &LeaseStore{db: newPreparedDB(db)}
+}
+
+// Acquire takes the lease name for owner until ttl from now, and reports
+// whether it did. A lease owner already holds is extended; one held by
+// another owner can only be taken once it has expired.
+func (s *LeaseStore) Acquire(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx, `
+        INSERT INTO leases (name, owner, expires_at) VALUES (?, ?, ?)
+        ON CONFLICT(name) DO UPDATE SET owner = excluded.owner, expires_at = excluded.expires_at
+        WHERE leases.owner = excluded.owner OR leases.expires_at <= ?
+    `, name, owner, now.Add(ttl).Unix(), now.Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Release gives up the lease name if owner holds it.
+func (s *LeaseStore) Release(ctx context.Context, name, owner string) error {
+	_, err := s.db.ExecContext(ctx, `
+        DELETE FROM leases WHERE name = ? AND owner = ?
+    `, name, owner)
+	return err
+}
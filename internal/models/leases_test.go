@@ -0,0 +1,106 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLeaseAcquire(t *testing.T) {
+	for name, open := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			leases := NewLeaseStore(open())
+			lease := fmt.Sprintf("test-%d", time.Now().UnixNano())
+			t.Cleanup(func() {
+				_ = leases.Release(ctx, lease, "a")
+				_ = leases.Release(ctx, lease, "b")
+			})
+
+			steps := []struct {
+				owner string
+				ttl   time.Duration
+				want  bool
+			}{
+				{"a", time.Hour, true},
+				{"a", time.Hour, true},
+				{"b", time.Hour, false},
+				// a gives the lease up by letting it expire at once.
+				{"a", -time.Second, true},
+				{"b", time.Hour, true},
+				{"a", time.Hour, false},
+			}
+			for i, s := range steps {
+				got, err := leases.Acquire(ctx, lease, s.owner, s.ttl)
+				if err != nil {
+					t.Fatalf("step %d: acquire as %s: %v", i, s.owner, err)
+				}
+				if got != s.want {
+					t.Errorf("step %d: acquire as %s = %v, want %v", i, s.owner, got, s.want)
+				}
+			}
+
+			if err := leases.Release(ctx, lease, "a"); err != nil {
+				t.Fatalf("release as a: %v", err)
+			}
+			if ok, _ := leases.Acquire(ctx, lease, "a", time.Hour); ok {
+				t.Errorf("a took the lease after releasing one it did not hold")
+			}
+			if err := leases.Release(ctx, lease, "b"); err != nil {
+				t.Fatalf("release as b: %v", err)
+			}
+			if ok, _ := leases.Acquire(ctx, lease, "a", time.Hour); !ok {
+				t.Errorf("a could not take the lease after b released it")
+			}
+		})
+	}
+}
+
+func TestClaimJob(t *testing.T) {
+	for name, open := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			d := open()
+			jobs := NewJobStore(d)
+			bucketID := newTestBucket(t, d)
+
+			now := time.Now().Unix()
+			job := &Job{
+				ID:        fmt.Sprintf("job-%d", time.Now().UnixNano()),
+				BucketID:  bucketID,
+				Kind:      JobDeletePrefix,
+				Status:    JobRunning,
+				CreatedAt: now,
+				UpdatedAt: now,
+				Owner:     "a",
+			}
+			if err := jobs.CreateJob(ctx, job); err != nil {
+				t.Fatalf("create job: %v", err)
+			}
+
+			stolen := *job
+			if ok, err := jobs.ClaimJob(ctx, &stolen, "b", now-60); err != nil || ok {
+				t.Fatalf("claim of a job in progress = %v, %v; want false", ok, err)
+			}
+			if ok, err := jobs.ClaimJob(ctx, &stolen, "b", now+60); err != nil || !ok {
+				t.Fatalf("claim of a stale job = %v, %v; want true", ok, err)
+			}
+
+			job.Processed = 1
+			if err := jobs.UpdateProgress(ctx, job); !errors.Is(err, ErrJobLost) {
+				t.Errorf("progress of the former owner = %v, want ErrJobLost", err)
+			}
+			if err := jobs.FinishJob(ctx, job, JobSucceeded, ""); !errors.Is(err, ErrJobLost) {
+				t.Errorf("finish by the former owner = %v, want ErrJobLost", err)
+			}
+			if err := jobs.FinishJob(ctx, &stolen, JobSucceeded, ""); err != nil {
+				t.Errorf("finish by the new owner: %v", err)
+			}
+			if ok, err := jobs.ClaimJob(ctx, job, "a", now+60); err != nil || ok {
+				t.Errorf("claim of a finished job = %v, %v; want false", ok, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+type LifecycleStore struct {
+	db *preparedDB
+}
+
+func NewLifecycleStore(db *sql.DB) *LifecycleStore {
+	return &LifecycleStore{db: newPreparedDB(db)}
+}
+
+// GetRules returns the lifecycle rules of the bucket in the order they were
+// given.
+func (s *LifecycleStore) GetRules(ctx context.Context, bucketID int64) ([]*LifecycleRule, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT rule_id, prefix, enabled, expiration_days, keep_newest, abort_incomplete_upload_days
+        FROM lifecycle_rules
+        WHERE bucket_id = ?
+        ORDER BY id
+    `, bucketID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*LifecycleRule
+	for rows.Next() {
+		var rule LifecycleRule
+		if err := rows.Scan(
+			&rule.ID, &rule.Prefix, &rule.Enabled, &rule.ExpirationDays,
+			&rule.KeepNewest, &rule.AbortIncompleteUploadDays,
+		); err != nil {
+			return nil, err
+		}
+		rules = append(rules, &rule)
+	}
+	return rules, rows.Err()
+}
+
+// SetRules replaces the lifecycle rules of the bucket.
+func (s *LifecycleStore) SetRules(ctx context.Context, bucketID int64, rules []*LifecycleRule) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM lifecycle_rules WHERE bucket_id = ?`, bucketID); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO lifecycle_rules (
+                bucket_id, rule_id, prefix, enabled, expiration_days, keep_newest, abort_incomplete_upload_days
+            ) VALUES (?, ?, ?, ?, ?, ?, ?)
+        `,
+			bucketID, rule.ID, rule.Prefix, rule.Enabled, rule.ExpirationDays,
+			rule.KeepNewest, rule.AbortIncompleteUploadDays,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
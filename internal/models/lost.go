@@ -0,0 +1,116 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Objects whose blob has gone missing cannot be read any more. Rather than
+// leaving their rows in place to fail every read, they are moved into
+// lost_objects, which keeps enough of them to tell what was lost.
+
+// ListObjectRows returns up to limit rows with an id above after, ordered by
+// id, of the objects table or, if history is set, of object_versions. Delete
+// markers are skipped. Rows of the objects table are flagged as the latest
+// version.
+func (s *ObjectStore) ListObjectRows(ctx context.Context, history bool, after int64, limit int) ([]*Object, error) {
+	if !history {
+		rows, err := s.db.QueryContext(ctx, `
+            SELECT `+objectColumns+`
+            FROM objects
+            WHERE id > ?
+            ORDER BY id
+            LIMIT ?
+        `, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		objects, err := scanObjects(rows)
+		for _, o := range objects {
+			o.IsLatest = true
+		}
+		return objects, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT `+versionColumns+`
+        FROM object_versions
+        WHERE id > ? AND is_delete_marker = FALSE
+        ORDER BY id
+        LIMIT ?
+    `, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []*Object
+	for rows.Next() {
+		o, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// rowTable returns the table a row returned by ListObjectRows is stored in.
+func rowTable(o *Object) string {
+	if o.IsLatest {
+		return "objects"
+	}
+	return "object_versions"
+}
+
+// LoseObject removes the row o was read from by ListObjectRows and records
+// it in lost_objects with the given reason. When the current object is
+// removed, the newest older version becomes current unless it is a delete
+// marker. sql.ErrNoRows is returned if the row was removed or now references
+// a different blob.
+func (s *ObjectStore) LoseObject(ctx context.Context, o *Object, reason string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+        DELETE FROM `+rowTable(o)+`
+        WHERE id = ? AND file_path = ?
+    `, o.ID, o.BlobKey)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := dropBlobRef(ctx, tx, o); err != nil {
+		return err
+	}
+	if err := deleteAttributes(ctx, tx, o); err != nil {
+		return err
+	}
+	if o.IsLatest {
+		if err := promoteNewestVersion(ctx, tx, o.BucketID, o.ObjectKey); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO lost_objects (
+            bucket_id, object_key, version_id, file_path, size, checksum, reason, detected_at
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+		o.BucketID, o.ObjectKey, o.VersionID, o.BlobKey, o.Size, o.Checksum, reason, time.Now().Unix(),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// User metadata and tags are stored per version of an object, keyed by its
+// version ID ("null" for objects without one). Metadata is fixed when the
+// object is written; tags can be changed afterwards.
+
+func attributeVersionID(o *Object) string {
+	if o.VersionID == "" {
+		return NullVersionID
+	}
+	return o.VersionID
+}
+
+func insertAttributes(ctx context.Context, tx *sql.Tx, o *Object) error {
+	for name, value := range o.Metadata {
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO object_metadata (bucket_id, object_key, version_id, name, value)
+            VALUES (?, ?, ?, ?, ?)
+        `, o.BucketID, o.ObjectKey, attributeVersionID(o), name, value); err != nil {
+			return err
+		}
+	}
+	return insertTags(ctx, tx, o, o.Tags)
+}
+
+func insertTags(ctx context.Context, tx *sql.Tx, o *Object, tags map[string]string) error {
+	for name, value := range tags {
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO object_tags (bucket_id, object_key, version_id, name, value)
+            VALUES (?, ?, ?, ?, ?)
+        `, o.BucketID, o.ObjectKey, attributeVersionID(o), name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteTags(ctx context.Context, tx *sql.Tx, o *Object) error {
+	_, err := tx.ExecContext(ctx, `
+        DELETE FROM object_tags
+        WHERE bucket_id = ? AND object_key = ? AND version_id = ?
+    `, o.BucketID, o.ObjectKey, attributeVersionID(o))
+	return err
+}
+
+// deleteAttributes removes the metadata and tags of o.
+func deleteAttributes(ctx context.Context, tx *sql.Tx, o *Object) error {
+	if _, err := tx.ExecContext(ctx, `
+        DELETE FROM object_metadata
+        WHERE bucket_id = ? AND object_key = ? AND version_id = ?
+    `, o.BucketID, o.ObjectKey, attributeVersionID(o)); err != nil {
+		return err
+	}
+	return deleteTags(ctx, tx, o)
+}
+
+// LoadAttributes fills in the user metadata and tags of o.
+func (s *ObjectStore) LoadAttributes(ctx context.Context, o *Object) error {
+	var err error
+	if o.Metadata, err = s.loadAttributeTable(ctx, "object_metadata", o); err != nil {
+		return err
+	}
+	o.Tags, err = s.loadAttributeTable(ctx, "object_tags", o)
+	return err
+}
+
+func (s *ObjectStore) loadAttributeTable(ctx context.Context, table string, o *Object) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT name, value FROM `+table+`
+        WHERE bucket_id = ? AND object_key = ? AND version_id = ?
+    `, o.BucketID, o.ObjectKey, attributeVersionID(o))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attrs map[string]string
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[name] = value
+	}
+	return attrs, rows.Err()
+}
+
+// SetTags replaces the tags of o. An empty map removes all of them.
+func (s *ObjectStore) SetTags(ctx context.Context, o *Object, tags map[string]string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteTags(ctx, tx, o); err != nil {
+		return err
+	}
+	if err := insertTags(ctx, tx, o, tags); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	o.Tags = tags
+	return nil
+}
@@ -4,6 +4,52 @@ type Bucket struct {
 	ID        int64  `json:"-"`
 	Name      string `json:"name"`
 	CreatedAt int64  `json:"created_at"`
+	// Versioning keeps replaced and deleted objects as older versions.
+	Versioning bool `json:"versioning"`
+	// LifecycleRules are only filled in where they are needed; see
+	// LifecycleStore.GetRules.
+	LifecycleRules []*LifecycleRule `json:"lifecycle_rules,omitempty"`
+	Quota          BucketQuota      `json:"quota"`
+	// Compression names the encoding new objects with a compressible content
+	// type are stored with, e.g. "gzip"; empty stores them as they are.
+	Compression string `json:"compression"`
+	// Usage is only filled in where it is needed; see BucketStore.GetUsage.
+	Usage *BucketUsage `json:"usage,omitempty"`
+}
+
+// BucketQuota limits what a bucket may hold. Zero means no limit.
+type BucketQuota struct {
+	// MaxBytes counts the current objects and their older versions.
+	MaxBytes      int64 `json:"max_bytes"`
+	MaxObjects    int64 `json:"max_objects"`
+	MaxObjectSize int64 `json:"max_object_size"`
+}
+
+type BucketUsage struct {
+	// Bytes counts the current objects and their older versions, like
+	// BucketQuota.MaxBytes.
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+	// StoredBytes counts every blob the bucket references once, however
+	// many of its objects share it; DedupSavedBytes is what that saves.
+	StoredBytes     int64 `json:"stored_bytes"`
+	DedupSavedBytes int64 `json:"dedup_saved_bytes"`
+}
+
+// LifecycleRule is applied periodically to the objects of a bucket whose
+// keys start with Prefix. Each of the actions that is set is carried out on
+// its own.
+type LifecycleRule struct {
+	ID      string `json:"id"`
+	Prefix  string `json:"prefix"`
+	Enabled bool   `json:"enabled"`
+	// ExpirationDays deletes objects this many days after they were written.
+	ExpirationDays int `json:"expiration_days,omitempty"`
+	// KeepNewest deletes all but this many of the newest objects.
+	KeepNewest int `json:"keep_newest,omitempty"`
+	// AbortIncompleteUploadDays aborts multipart and tus uploads this many
+	// days after they were started.
+	AbortIncompleteUploadDays int `json:"abort_incomplete_upload_days,omitempty"`
 }
 
 type AccessKeyRole string
@@ -15,23 +61,180 @@ const (
 )
 
 type AccessKey struct {
-	ID         int64         `json:"-"`
-	BucketID   int64         `json:"bucket_id"`
-	KeyID      string        `json:"key_id"`
-	SecretHash string        `json:"-"`
-	Role       AccessKeyRole `json:"role"`
-	CreatedAt  int64         `json:"created_at"`
+	ID         int64  `json:"-"`
+	BucketID   int64  `json:"bucket_id"`
+	KeyID      string `json:"key_id"`
+	SecretHash string `json:"-"`
+	// SecretSealed is the secret encrypted with the server key. It is needed
+	// to verify AWS Signature V4 requests and is empty for keys created before
+	// it was stored.
+	SecretSealed string        `json:"-"`
+	Role         AccessKeyRole `json:"role"`
+	CreatedAt    int64         `json:"created_at"`
 }
 
 type Object struct {
+	ID             int64  `json:"-"`
+	BucketID       int64  `json:"bucket_id"`
+	ObjectKey      string `json:"object_key"`
+	BlobKey        string `json:"-"`
+	Size           int64  `json:"size"`
+	ContentType    string `json:"content_type"`
+	Checksum       string `json:"checksum"`
+	ChecksumSHA256 string `json:"checksum_sha256,omitempty"`
+	ChecksumMD5    string `json:"checksum_md5,omitempty"`
+	ChecksumCRC32C string `json:"checksum_crc32c,omitempty"`
+	// Encoding is the compression the blob is stored with, if any. Size and
+	// the checksums always describe the uncompressed content.
+	Encoding string `json:"encoding,omitempty"`
+	// Encryption is EncryptionMaster or EncryptionCustomer if the blob is
+	// encrypted with DataKey, which is wrapped by the master key KeyID or by
+	// the customer key whose MD5 is KeyID.
+	Encryption string `json:"encryption,omitempty"`
+	KeyID      string `json:"-"`
+	DataKey    string `json:"-"`
+	// Corrupt says what is wrong with the blob if fsck found it missing or
+	// not matching Size and the checksums. Such objects are not served.
+	Corrupt   string `json:"corrupt,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	// VersionID is empty for objects written while the bucket did not have
+	// versioning enabled.
+	VersionID      string `json:"version_id,omitempty"`
+	IsDeleteMarker bool   `json:"is_delete_marker,omitempty"`
+	IsLatest       bool   `json:"is_latest,omitempty"`
+	// Metadata and Tags are only filled in where they are needed; see
+	// ObjectStore.LoadAttributes.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// Values of Object.Encryption.
+const (
+	EncryptionMaster   = "master"
+	EncryptionCustomer = "customer"
+)
+
+// ListObjectsOptions selects one page of a bucket listing. Keys are listed in
+// byte order, starting after StartAfter.
+type ListObjectsOptions struct {
+	Prefix     string
+	Delimiter  string
+	StartAfter string
+	MaxKeys    int
+	// Tags restricts the listing to objects carrying all of these tags.
+	Tags map[string]string
+}
+
+// ObjectPage is one page of a bucket listing. Keys containing the delimiter
+// after the prefix are rolled up into CommonPrefixes, each of which counts as
+// one entry. Next is the last entry of the page; listing continues from there
+// by passing it as StartAfter.
+type ObjectPage struct {
+	Objects        []*Object `json:"objects"`
+	CommonPrefixes []string  `json:"common_prefixes"`
+	IsTruncated    bool      `json:"is_truncated"`
+	Next           string    `json:"-"`
+}
+
+// ListVersionsOptions selects one page of a version listing, which lists the
+// versions of each key newest first. Listing starts after the version
+// VersionIDMarker of the key KeyMarker, or after every version of KeyMarker
+// if no version is given. A version marker that no longer exists lists its
+// key from the start.
+type ListVersionsOptions struct {
+	Prefix          string
+	KeyMarker       string
+	VersionIDMarker string
+	MaxKeys         int
+}
+
+// VersionPage is one page of a version listing. If it is truncated,
+// NextKeyMarker and NextVersionIDMarker name its last version; listing
+// continues from there by passing them as the markers.
+type VersionPage struct {
+	Versions            []*Object `json:"versions"`
+	IsTruncated         bool      `json:"is_truncated"`
+	NextKeyMarker       string    `json:"next_key_marker,omitempty"`
+	NextVersionIDMarker string    `json:"next_version_id_marker,omitempty"`
+}
+
+type MultipartUpload struct {
 	ID          int64  `json:"-"`
+	UploadID    string `json:"upload_id"`
 	BucketID    int64  `json:"bucket_id"`
 	ObjectKey   string `json:"object_key"`
-	FilePath    string `json:"-"`
-	Size        int64  `json:"size"`
 	ContentType string `json:"content_type"`
-	Checksum    string `json:"checksum"`
 	CreatedAt   int64  `json:"created_at"`
+	// Metadata and Tags are applied to the object once the upload completes.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	// Encryption, KeyID and DataKey describe the key the parts are encrypted
+	// with, as they do for objects. Parts are only ever encrypted with
+	// EncryptionMaster.
+	Encryption string `json:"-"`
+	KeyID      string `json:"-"`
+	DataKey    string `json:"-"`
+}
+
+type UploadPart struct {
+	UploadID   string `json:"-"`
+	PartNumber int    `json:"part_number"`
+	BlobKey    string `json:"-"`
+	Size       int64  `json:"size"`
+	ETag       string `json:"etag"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// TusUpload is a resumable upload created through the tus protocol. Offset
+// is the number of bytes received so far; the object is created once it
+// reaches Length.
+type TusUpload struct {
+	ID          int64  `json:"-"`
+	UploadID    string `json:"upload_id"`
+	BucketID    int64  `json:"bucket_id"`
+	ObjectKey   string `json:"object_key"`
+	ContentType string `json:"content_type"`
+	BlobKey     string `json:"-"`
+	Length      int64  `json:"length"`
+	Offset      int64  `json:"offset"`
+	Metadata    string `json:"-"`
+	CreatedAt   int64  `json:"created_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+	// Encryption, KeyID and DataKey describe the key the received data is
+	// encrypted with, like those of a multipart upload.
+	Encryption string `json:"-"`
+	KeyID      string `json:"-"`
+	DataKey    string `json:"-"`
+}
+
+type JobKind string
+
+const (
+	JobDeletePrefix JobKind = "delete_prefix"
+)
+
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// Job is a long running operation on a bucket that is carried out in the
+// background. Processed counts the objects handled so far.
+type Job struct {
+	ID        string    `json:"id"`
+	BucketID  int64     `json:"bucket_id"`
+	Kind      JobKind   `json:"kind"`
+	Prefix    string    `json:"prefix"`
+	Status    JobStatus `json:"status"`
+	Processed int64     `json:"processed"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt int64     `json:"created_at"`
+	UpdatedAt int64     `json:"updated_at"`
+	// Owner identifies the instance running the job.
+	Owner string `json:"-"`
 }
 
 // Dtos that will be returned to the client
@@ -49,44 +252,60 @@ func (b *Bucket) ToResponse() *BucketResponse {
 }
 
 type ObjectResponse struct {
-	BucketID    int64  `json:"bucket_id"`
-	ObjectKey   string `json:"object_key"`
-	Size        int64  `json:"size"`
-	ContentType string `json:"content_type"`
-	Checksum    string `json:"checksum"`
-	CreatedAt   int64  `json:"created_at"`
+	BucketID       int64  `json:"bucket_id"`
+	ObjectKey      string `json:"object_key"`
+	Size           int64  `json:"size"`
+	ContentType    string `json:"content_type"`
+	Checksum       string `json:"checksum"`
+	ChecksumSHA256 string `json:"checksum_sha256,omitempty"`
+	ChecksumMD5    string `json:"checksum_md5,omitempty"`
+	ChecksumCRC32C string `json:"checksum_crc32c,omitempty"`
+	CreatedAt      int64  `json:"created_at"`
+	VersionID      string `json:"version_id,omitempty"`
 }
 
 func (o *Object) ToResponse() *ObjectResponse {
 	return &ObjectResponse{
-		BucketID:    o.BucketID,
-		ObjectKey:   o.ObjectKey,
-		Size:        o.Size,
-		ContentType: o.ContentType,
-		Checksum:    o.Checksum,
-		CreatedAt:   o.CreatedAt,
+		BucketID:       o.BucketID,
+		ObjectKey:      o.ObjectKey,
+		Size:           o.Size,
+		ContentType:    o.ContentType,
+		Checksum:       o.Checksum,
+		ChecksumSHA256: o.ChecksumSHA256,
+		ChecksumMD5:    o.ChecksumMD5,
+		ChecksumCRC32C: o.ChecksumCRC32C,
+		CreatedAt:      o.CreatedAt,
+		VersionID:      o.VersionID,
 	}
 }
 
 type ObjectWithContentResponse struct {
-	BucketID    int64  `json:"bucket_id"`
-	ObjectKey   string `json:"object_key"`
-	Size        int64  `json:"size"`
-	ContentType string `json:"content_type"`
-	Checksum    string `json:"checksum"`
-	CreatedAt   int64  `json:"created_at"`
-	Content     string `json:"content"`
+	BucketID       int64  `json:"bucket_id"`
+	ObjectKey      string `json:"object_key"`
+	Size           int64  `json:"size"`
+	ContentType    string `json:"content_type"`
+	Checksum       string `json:"checksum"`
+	ChecksumSHA256 string `json:"checksum_sha256,omitempty"`
+	ChecksumMD5    string `json:"checksum_md5,omitempty"`
+	ChecksumCRC32C string `json:"checksum_crc32c,omitempty"`
+	CreatedAt      int64  `json:"created_at"`
+	VersionID      string `json:"version_id,omitempty"`
+	Content        string `json:"content"`
 }
 
 func (o *Object) ToResponseWithContent(content string) *ObjectWithContentResponse {
 	return &ObjectWithContentResponse{
-		BucketID:    o.BucketID,
-		ObjectKey:   o.ObjectKey,
-		Size:        o.Size,
-		ContentType: o.ContentType,
-		Checksum:    o.Checksum,
-		CreatedAt:   o.CreatedAt,
-		Content:     content,
+		BucketID:       o.BucketID,
+		ObjectKey:      o.ObjectKey,
+		Size:           o.Size,
+		ContentType:    o.ContentType,
+		Checksum:       o.Checksum,
+		ChecksumSHA256: o.ChecksumSHA256,
+		ChecksumMD5:    o.ChecksumMD5,
+		ChecksumCRC32C: o.ChecksumCRC32C,
+		CreatedAt:      o.CreatedAt,
+		VersionID:      o.VersionID,
+		Content:        content,
 	}
 }
 
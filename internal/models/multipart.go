@@ -0,0 +1,279 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// ErrUploadCompleting is returned by PutPart while the upload is being
+// completed, which uses the parts it listed when it started.
+var ErrUploadCompleting = errors.New("upload is being completed")
+
+type MultipartStore struct {
+	db *preparedDB
+}
+
+func NewMultipartStore(db *sql.DB) *MultipartStore {
+	return &MultipartStore{db: newPreparedDB(db)}
+}
+
+// uploadColumns is the column list of multipart_uploads queries, in the order
+// expected by scanUpload.
+const uploadColumns = `id, upload_id, bucket_id, object_key, COALESCE(content_type, ''), created_at,
+		COALESCE(metadata, ''), COALESCE(tags, ''), encryption, key_id, data_key`
+
+func scanUpload(row rowScanner) (*MultipartUpload, error) {
+	var u MultipartUpload
+	var metadata, tags string
+	if err := row.Scan(
+		&u.ID, &u.UploadID, &u.BucketID, &u.ObjectKey, &u.ContentType, &u.CreatedAt,
+		&metadata, &tags, &u.Encryption, &u.KeyID, &u.DataKey,
+	); err != nil {
+		return nil, err
+	}
+	if err := unmarshalAttributes(metadata, &u.Metadata); err != nil {
+		return nil, err
+	}
+	if err := unmarshalAttributes(tags, &u.Tags); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// The user metadata and tags of an upload are kept as JSON objects until the
+// upload is completed.
+
+func marshalAttributes(attrs map[string]string) (any, error) {
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(attrs)
+	return string(b), err
+}
+
+func unmarshalAttributes(s string, attrs *map[string]string) error {
+	if s == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(s), attrs)
+}
+
+func (s *MultipartStore) CreateUpload(ctx context.Context, u *MultipartUpload) (int64, error) {
+	metadata, err := marshalAttributes(u.Metadata)
+	if err != nil {
+		return 0, err
+	}
+	tags, err := marshalAttributes(u.Tags)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = s.db.QueryRowContext(ctx, `
+		INSERT INTO multipart_uploads (
+			upload_id, bucket_id, object_key, content_type, created_at, metadata, tags,
+			encryption, key_id, data_key
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`,
+		u.UploadID, u.BucketID, u.ObjectKey, u.ContentType, u.CreatedAt, metadata, tags,
+		u.Encryption, u.KeyID, u.DataKey,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *MultipartStore) GetUpload(ctx context.Context, bucketID int64, uploadID string) (*MultipartUpload, error) {
+	return scanUpload(s.db.QueryRowContext(ctx, `
+		SELECT `+uploadColumns+`
+		FROM multipart_uploads
+		WHERE bucket_id = ? AND upload_id = ?
+	`, bucketID, uploadID))
+}
+
+func (s *MultipartStore) ListUploads(ctx context.Context, bucketID int64) ([]*MultipartUpload, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+uploadColumns+`
+		FROM multipart_uploads
+		WHERE bucket_id = ?
+		ORDER BY object_key, created_at
+	`, bucketID)
+	if err != nil {
+		return nil, err
+	}
+	return scanUploads(rows)
+}
+
+// ListUploadsCreatedBefore returns uploads of all buckets started before the
+// given unix time.
+func (s *MultipartStore) ListUploadsCreatedBefore(ctx context.Context, before int64) ([]*MultipartUpload, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+uploadColumns+`
+		FROM multipart_uploads
+		WHERE created_at < ?
+	`, before)
+	if err != nil {
+		return nil, err
+	}
+	return scanUploads(rows)
+}
+
+func scanUploads(rows *sql.Rows) ([]*MultipartUpload, error) {
+	defer rows.Close()
+
+	var uploads []*MultipartUpload
+	for rows.Next() {
+		u, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+// PutPart stores a part, replacing an earlier upload of the same part number.
+// It returns the blob key of the replaced part, if there was one. It fails
+// with sql.ErrNoRows if the upload is gone and with ErrUploadCompleting if it
+// is being completed.
+func (s *MultipartStore) PutPart(ctx context.Context, p *UploadPart) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Touching the upload's row holds off StartCompletion until the part
+	// is committed, and waits for a completion that started first.
+	res, err := tx.ExecContext(ctx, `
+		UPDATE multipart_uploads SET completing_at = completing_at
+		WHERE upload_id = ? AND completing_at = 0
+	`, p.UploadID)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return "", err
+		}
+		var exists bool
+		err = tx.QueryRowContext(ctx, `
+			SELECT TRUE FROM multipart_uploads WHERE upload_id = ?
+		`, p.UploadID).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		return "", ErrUploadCompleting
+	}
+
+	var oldKey string
+	err = tx.QueryRowContext(ctx, `
+		SELECT file_path FROM upload_parts
+		WHERE upload_id = ? AND part_number = ?
+	`, p.UploadID, p.PartNumber).Scan(&oldKey)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO upload_parts (
+			upload_id, part_number, file_path, size, etag, created_at
+		) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(upload_id, part_number) DO UPDATE SET
+			file_path = excluded.file_path,
+			size = excluded.size,
+			etag = excluded.etag,
+			created_at = excluded.created_at
+	`,
+		p.UploadID, p.PartNumber, p.BlobKey, p.Size, p.ETag, p.CreatedAt,
+	)
+	if err != nil {
+		return "", err
+	}
+	return oldKey, tx.Commit()
+}
+
+// StartCompletion marks the upload as being completed at the unix time now,
+// so that no more parts are stored, and reports whether it did. An upload
+// another completion marked before staleBefore, which has presumably died, is
+// taken over.
+func (s *MultipartStore) StartCompletion(ctx context.Context, uploadID string, now, staleBefore int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE multipart_uploads SET completing_at = ?
+		WHERE upload_id = ? AND completing_at < ?
+	`, now, uploadID, staleBefore)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CancelCompletion lets parts be stored again after the completion started
+// at the unix time startedAt failed.
+func (s *MultipartStore) CancelCompletion(ctx context.Context, uploadID string, startedAt int64) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE multipart_uploads SET completing_at = 0
+		WHERE upload_id = ? AND completing_at = ?
+	`, uploadID, startedAt)
+	return err
+}
+
+func (s *MultipartStore) ListParts(ctx context.Context, uploadID string) ([]*UploadPart, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT upload_id, part_number, file_path, size, etag, created_at
+		FROM upload_parts
+		WHERE upload_id = ?
+		ORDER BY part_number
+	`, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var parts []*UploadPart
+	for rows.Next() {
+		var p UploadPart
+		if err := rows.Scan(&p.UploadID, &p.PartNumber, &p.BlobKey, &p.Size, &p.ETag, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		parts = append(parts, &p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// DeletePart removes the row of one part, provided it still references the
+// blob under blobKey.
+func (s *MultipartStore) DeletePart(ctx context.Context, uploadID string, partNumber int, blobKey string) error {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM upload_parts
+		WHERE upload_id = ? AND part_number = ? AND file_path = ?
+	`, uploadID, partNumber, blobKey)
+	return err
+}
+
+// DeleteUpload removes an upload and all of its part rows.
+func (s *MultipartStore) DeleteUpload(ctx context.Context, uploadID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM upload_parts WHERE upload_id = ?`, uploadID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM multipart_uploads WHERE upload_id = ?`, uploadID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
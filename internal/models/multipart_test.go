@@ -0,0 +1,81 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPutPartWhileCompleting(t *testing.T) {
+	for name, open := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			d := open()
+			store := NewMultipartStore(d)
+			bucketID := newTestBucket(t, d)
+
+			uploadID := fmt.Sprintf("upload-%d", time.Now().UnixNano())
+			if _, err := store.CreateUpload(ctx, &MultipartUpload{
+				UploadID:  uploadID,
+				BucketID:  bucketID,
+				ObjectKey: "key",
+				CreatedAt: 1000,
+			}); err != nil {
+				t.Fatalf("create upload: %v", err)
+			}
+			t.Cleanup(func() { _ = store.DeleteUpload(ctx, uploadID) })
+			putPart := func(id string, n int) error {
+				_, err := store.PutPart(ctx, &UploadPart{
+					UploadID:   id,
+					PartNumber: n,
+					BlobKey:    fmt.Sprintf("test/%s/%d", id, n),
+					ETag:       "0",
+					CreatedAt:  1000,
+				})
+				return err
+			}
+
+			if err := putPart(uploadID, 1); err != nil {
+				t.Fatalf("put part before completion: %v", err)
+			}
+			if ok, err := store.StartCompletion(ctx, uploadID, 2000, 1000); err != nil || !ok {
+				t.Fatalf("start completion = %v, %v; want true", ok, err)
+			}
+			if ok, err := store.StartCompletion(ctx, uploadID, 2001, 1001); err != nil || ok {
+				t.Errorf("second completion = %v, %v; want false", ok, err)
+			}
+			if err := putPart(uploadID, 2); !errors.Is(err, ErrUploadCompleting) {
+				t.Errorf("put part while completing = %v, want ErrUploadCompleting", err)
+			}
+
+			// Only the completion that marked the upload can cancel it.
+			if err := store.CancelCompletion(ctx, uploadID, 1999); err != nil {
+				t.Fatalf("cancel other completion: %v", err)
+			}
+			if err := putPart(uploadID, 2); !errors.Is(err, ErrUploadCompleting) {
+				t.Errorf("put part after cancelling another completion = %v, want ErrUploadCompleting", err)
+			}
+			if err := store.CancelCompletion(ctx, uploadID, 2000); err != nil {
+				t.Fatalf("cancel completion: %v", err)
+			}
+			if err := putPart(uploadID, 2); err != nil {
+				t.Errorf("put part after cancelled completion: %v", err)
+			}
+
+			// A completion that stalled is taken over.
+			if ok, err := store.StartCompletion(ctx, uploadID, 3000, 1000); err != nil || !ok {
+				t.Fatalf("start completion = %v, %v; want true", ok, err)
+			}
+			if ok, err := store.StartCompletion(ctx, uploadID, 5000, 4000); err != nil || !ok {
+				t.Errorf("take over stale completion = %v, %v; want true", ok, err)
+			}
+
+			if err := putPart("missing", 1); err != sql.ErrNoRows {
+				t.Errorf("put part of missing upload = %v, want sql.ErrNoRows", err)
+			}
+		})
+	}
+}
@@ -3,112 +3,470 @@ package models
 import (
 	"context"
 	"database/sql"
+	"encoding/binary"
+	"hash/fnv"
+	"slices"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"buck_It_Up/internal/db"
 )
 
 type ObjectStore struct {
-	db *sql.DB
+	db *preparedDB
 }
 
 func NewObjectStore(db *sql.DB) *ObjectStore {
-	return &ObjectStore{db: db}
+	return &ObjectStore{db: newPreparedDB(db)}
 }
 
-func (s *ObjectStore) PutObject(ctx context.Context, o *Object) (int64, error) {
-	res, err := s.db.ExecContext(ctx, `
+// objectColumns is the column list every object query selects, in the order
+// expected by scanObject. Digest and version columns are NULL for objects
+// stored before those were recorded.
+const objectColumns = `id, bucket_id, object_key, file_path, size, content_type, checksum,
+        COALESCE(checksum_sha256, ''), COALESCE(checksum_md5, ''), COALESCE(checksum_crc32c, ''),
+        encoding, encryption, key_id, data_key, corrupt, created_at, COALESCE(version_id, '')`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanObject(row rowScanner) (*Object, error) {
+	var o Object
+	if err := row.Scan(
+		&o.ID, &o.BucketID, &o.ObjectKey, &o.BlobKey, &o.Size,
+		&o.ContentType, &o.Checksum,
+		&o.ChecksumSHA256, &o.ChecksumMD5, &o.ChecksumCRC32C,
+		&o.Encoding, &o.Encryption, &o.KeyID, &o.DataKey, &o.Corrupt, &o.CreatedAt, &o.VersionID,
+	); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func scanObjects(rows *sql.Rows) ([]*Object, error) {
+	defer rows.Close()
+
+	var objects []*Object
+	for rows.Next() {
+		o, err := scanObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// ReplaceObject stores o under its key, replacing the row of an existing
+// object with the same key in place. check is called with the current object
+// (nil if there is none) inside the transaction and can veto the write by
+// returning an error. If o or the existing object carries a version ID the
+// existing object is kept as an older version; otherwise the object that is
+// no longer reachable, if any, is returned so the caller can remove its blob.
+// Writes that break the bucket's quota fail with ErrObjectTooLarge or
+// ErrQuotaExceeded.
+func (s *ObjectStore) ReplaceObject(ctx context.Context, o *Object, check func(existing *Object) error) (*Object, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := s.db.lockObjectKeys(ctx, tx, objectRef{o.BucketID, o.ObjectKey}); err != nil {
+		return nil, err
+	}
+	replaced, err := replaceObject(ctx, tx, o, check)
+	if err != nil {
+		return nil, err
+	}
+	return replaced, tx.Commit()
+}
+
+// MoveObject stores o like ReplaceObject and removes the current object src,
+// as RemoveCurrentObject does with markerID, in the same transaction. It
+// returns the objects that are no longer reachable at the destination and
+// the source. sql.ErrNoRows is returned if src is no longer the current
+// object under its key.
+func (s *ObjectStore) MoveObject(ctx context.Context, o *Object, check func(existing *Object) error, src *Object, markerID string) (replaced, removed *Object, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	if err := s.db.lockObjectKeys(ctx, tx, objectRef{src.BucketID, src.ObjectKey}, objectRef{o.BucketID, o.ObjectKey}); err != nil {
+		return nil, nil, err
+	}
+	current, err := currentObject(ctx, tx, src.BucketID, src.ObjectKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if current == nil || current.ID != src.ID || current.BlobKey != src.BlobKey {
+		return nil, nil, sql.ErrNoRows
+	}
+	if removed, err = removeCurrentObject(ctx, tx, src.BucketID, src.ObjectKey, markerID); err != nil {
+		return nil, nil, err
+	}
+	if replaced, err = replaceObject(ctx, tx, o, check); err != nil {
+		return nil, nil, err
+	}
+	return replaced, removed, tx.Commit()
+}
+
+func replaceObject(ctx context.Context, tx *sql.Tx, o *Object, check func(existing *Object) error) (*Object, error) {
+	existing, err := currentObject(ctx, tx, o.BucketID, o.ObjectKey)
+	if err != nil {
+		return nil, err
+	}
+	if check != nil {
+		if err := check(existing); err != nil {
+			return nil, err
+		}
+	}
+
+	var replaced *Object
+	switch {
+	case existing != nil && existing.VersionID == "" && o.VersionID == "":
+		replaced = existing
+	case existing != nil:
+		// Only one "null" version can exist per key; a new one replaces it.
+		if o.VersionID == "" || existing.VersionID == "" {
+			if replaced, err = deleteNullVersion(ctx, tx, o.BucketID, o.ObjectKey); err != nil {
+				return nil, err
+			}
+		}
+		if err := insertVersion(ctx, tx, existing); err != nil {
+			return nil, err
+		}
+	case o.VersionID == "":
+		if replaced, err = deleteNullVersion(ctx, tx, o.BucketID, o.ObjectKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if replaced != nil {
+		if err := deleteAttributes(ctx, tx, replaced); err != nil {
+			return nil, err
+		}
+	}
+	if err := insertAttributes(ctx, tx, o); err != nil {
+		return nil, err
+	}
+
+	if existing == nil {
+		if o.ID, err = insertObject(ctx, tx, o); err != nil {
+			return nil, err
+		}
+	} else {
+		_, err := tx.ExecContext(ctx, `
+            UPDATE objects SET
+                file_path = ?, size = ?, content_type = ?, checksum = ?,
+                checksum_sha256 = ?, checksum_md5 = ?, checksum_crc32c = ?, encoding = ?,
+                encryption = ?, key_id = ?, data_key = ?, corrupt = ?, created_at = ?, version_id = ?
+            WHERE id = ?
+        `,
+			o.BlobKey, o.Size, o.ContentType, o.Checksum,
+			o.ChecksumSHA256, o.ChecksumMD5, o.ChecksumCRC32C, o.Encoding,
+			o.Encryption, o.KeyID, o.DataKey, o.Corrupt, o.CreatedAt,
+			nullableVersionID(o.VersionID),
+			existing.ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := dropBlobRef(ctx, tx, existing); err != nil {
+			return nil, err
+		}
+		if err := addBlobRef(ctx, tx, o); err != nil {
+			return nil, err
+		}
+		o.ID = existing.ID
+	}
+	if err := checkQuota(ctx, tx, o); err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
+
+func insertObject(ctx context.Context, tx *sql.Tx, o *Object) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, `
         INSERT INTO objects (
-            bucket_id, object_key, file_path, size, content_type, checksum, created_at
-        ) VALUES (?, ?, ?, ?, ?, ?, ?)
+            bucket_id, object_key, file_path, size, content_type, checksum,
+            checksum_sha256, checksum_md5, checksum_crc32c, encoding,
+            encryption, key_id, data_key, corrupt, created_at, version_id
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        RETURNING id
     `,
-		o.BucketID, o.ObjectKey, o.FilePath, o.Size, o.ContentType, o.Checksum, o.CreatedAt,
-	)
+		o.BucketID, o.ObjectKey, o.BlobKey, o.Size, o.ContentType, o.Checksum,
+		o.ChecksumSHA256, o.ChecksumMD5, o.ChecksumCRC32C, o.Encoding,
+		o.Encryption, o.KeyID, o.DataKey, o.Corrupt, o.CreatedAt,
+		nullableVersionID(o.VersionID),
+	).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	if err := addBlobRef(ctx, tx, o); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func nullableVersionID(versionID string) any {
+	if versionID == "" {
+		return nil
+	}
+	return versionID
+}
+
+// objectRef names the key of an object in a bucket.
+type objectRef struct {
+	bucketID  int64
+	objectKey string
+}
+
+// lockObjectKeys makes tx the only transaction writing the given keys until
+// it ends, across every process sharing the database, so the current object
+// it reads stays current. SQLite needs nothing for that, as its transactions
+// take the write lock when they begin. On PostgreSQL, whose transactions only
+// see committed rows, a row lock would not cover keys that have no object
+// yet, so transaction level advisory locks on a hash of each key are taken
+// instead, in a fixed order.
+func (p *preparedDB) lockObjectKeys(ctx context.Context, tx *sql.Tx, refs ...objectRef) error {
+	if p.dialect != db.Postgres {
+		return nil
+	}
+	ids := make([]int64, 0, len(refs))
+	for _, ref := range refs {
+		h := fnv.New64a()
+		_ = binary.Write(h, binary.BigEndian, ref.bucketID)
+		h.Write([]byte(ref.objectKey))
+		ids = append(ids, int64(h.Sum64()))
+	}
+	slices.Sort(ids)
+	for _, id := range slices.Compact(ids) {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(?)`, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentObject returns the object stored under key, or nil if there is none.
+func currentObject(ctx context.Context, tx *sql.Tx, bucketID int64, objectKey string) (*Object, error) {
+	o, err := scanObject(tx.QueryRowContext(ctx, `
+        SELECT `+objectColumns+`
+        FROM objects
+        WHERE bucket_id = ? AND object_key = ?
+    `, bucketID, objectKey))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return o, err
 }
 
 func (s *ObjectStore) GetObject(ctx context.Context, bucketID int64, objectKey string) (*Object, error) {
-	var o Object
-	err := s.db.QueryRowContext(ctx, `
-        SELECT id, bucket_id, object_key, file_path, size, content_type, checksum, created_at
+	return scanObject(s.db.QueryRowContext(ctx, `
+        SELECT `+objectColumns+`
         FROM objects
         WHERE bucket_id = ? AND object_key = ?
     `,
 		bucketID, objectKey,
-	).Scan(
-		&o.ID, &o.BucketID, &o.ObjectKey, &o.FilePath, &o.Size,
-		&o.ContentType, &o.Checksum, &o.CreatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
-	return &o, nil
+	))
 }
 
 func (s *ObjectStore) ListObjects(ctx context.Context, bucketID int64) ([]*Object, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, bucket_id, object_key, file_path, size, content_type, checksum, created_at
+		SELECT `+objectColumns+`
 		FROM objects
 		WHERE bucket_id = ?
 	`, bucketID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return scanObjects(rows)
+}
 
-	var objects []*Object
-	for rows.Next() {
-		var o Object
-		if err := rows.Scan(
-			&o.ID, &o.BucketID, &o.ObjectKey, &o.FilePath, &o.Size,
-			&o.ContentType, &o.Checksum, &o.CreatedAt,
-		); err != nil {
+// ListObjectsPage returns one page of the bucket's objects. It walks the
+// (bucket_id, object_key) index in batches and skips over the keys below a
+// common prefix, so large buckets are never loaded at once.
+func (s *ObjectStore) ListObjectsPage(ctx context.Context, bucketID int64, opts ListObjectsOptions) (*ObjectPage, error) {
+	page := &ObjectPage{Objects: []*Object{}, CommonPrefixes: []string{}}
+	after := opts.StartAfter
+	limit := opts.MaxKeys + 1
+	var lastPrefix string
+	for {
+		batch, err := s.listObjectsAfter(ctx, bucketID, opts, after, limit)
+		if err != nil {
 			return nil, err
 		}
-		objects = append(objects, &o)
+		for _, o := range batch {
+			after = o.ObjectKey
+			if lastPrefix != "" && strings.HasPrefix(o.ObjectKey, lastPrefix) {
+				continue
+			}
+			entry, isPrefix := o.ObjectKey, false
+			if opts.Delimiter != "" {
+				if i := strings.Index(entry[len(opts.Prefix):], opts.Delimiter); i >= 0 {
+					entry = entry[:len(opts.Prefix)+i+len(opts.Delimiter)]
+					isPrefix = true
+					lastPrefix = entry
+					if entry <= opts.StartAfter {
+						continue
+					}
+				}
+			}
+			if len(page.Objects)+len(page.CommonPrefixes) >= opts.MaxKeys {
+				page.IsTruncated = true
+				return page, nil
+			}
+			if isPrefix {
+				page.CommonPrefixes = append(page.CommonPrefixes, entry)
+			} else {
+				page.Objects = append(page.Objects, o)
+			}
+			page.Next = entry
+		}
+		if len(batch) < limit {
+			return page, nil
+		}
+		if lastPrefix != "" && strings.HasPrefix(after, lastPrefix) {
+			// Continue behind the rest of the keys below this prefix. This
+			// sorts after all of them but those continuing with maxKeyRune,
+			// which the prefix check above skips.
+			after = lastPrefix + string(maxKeyRune)
+		}
 	}
-	if err := rows.Err(); err != nil {
+}
+
+// listObjectsAfter returns up to limit objects whose keys start with the
+// prefix of opts, carry its tags and sort after the given key.
+func (s *ObjectStore) listObjectsAfter(ctx context.Context, bucketID int64, opts ListObjectsOptions, after string, limit int) ([]*Object, error) {
+	query := `
+        SELECT ` + objectColumns + `
+        FROM objects
+        WHERE bucket_id = ? AND object_key > ? AND object_key >= ?`
+	args := []any{bucketID, after, opts.Prefix}
+	if end := prefixEnd(opts.Prefix); end != "" {
+		query += ` AND object_key < ?`
+		args = append(args, end)
+	}
+	for name, value := range opts.Tags {
+		query += `
+          AND EXISTS (
+            SELECT 1 FROM object_tags t
+            WHERE t.bucket_id = objects.bucket_id AND t.object_key = objects.object_key
+              AND t.version_id = COALESCE(objects.version_id, 'null')
+              AND t.name = ? AND t.value = ?
+          )`
+		args = append(args, name, value)
+	}
+	query += `
+        ORDER BY object_key
+        LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
 		return nil, err
 	}
-	return objects, nil
+	return scanObjects(rows)
 }
 
-func (s *ObjectStore) DeleteObject(ctx context.Context, bucketID int64, objectKey string) error {
-	_, err := s.db.ExecContext(ctx, `
-		DELETE FROM objects
-		WHERE bucket_id = ? AND object_key = ?
-	`,
-		bucketID, objectKey,
-	)
-	return err
+// ListObjectsByAge returns up to limit objects whose keys start with prefix,
+// newest first, leaving out the skip newest ones. With createdBefore set,
+// only objects created before that unix time are considered.
+func (s *ObjectStore) ListObjectsByAge(ctx context.Context, bucketID int64, prefix string, createdBefore int64, skip, limit int) ([]*Object, error) {
+	query := `
+        SELECT ` + objectColumns + `
+        FROM objects
+        WHERE bucket_id = ? AND object_key >= ?`
+	args := []any{bucketID, prefix}
+	if end := prefixEnd(prefix); end != "" {
+		query += ` AND object_key < ?`
+		args = append(args, end)
+	}
+	if createdBefore > 0 {
+		query += ` AND created_at < ?`
+		args = append(args, createdBefore)
+	}
+	query += `
+        ORDER BY created_at DESC, id DESC
+        LIMIT ? OFFSET ?`
+	args = append(args, limit, skip)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanObjects(rows)
+}
+
+// maxKeyRune sorts after every other rune. Keys are compared byte by byte,
+// which for UTF-8 is the order of their runes.
+const maxKeyRune = utf8.MaxRune
+
+// prefixEnd returns the smallest string that sorts after every string
+// starting with prefix, or "" if there is no such bound. The bound is valid
+// UTF-8 if prefix is, as PostgreSQL rejects anything else in text
+// parameters: the last rune that can be is incremented, skipping surrogates.
+func prefixEnd(prefix string) string {
+	if !utf8.ValidString(prefix) {
+		b := []byte(prefix)
+		for i := len(b) - 1; i >= 0; i-- {
+			if b[i] < 0xff {
+				b[i]++
+				return string(b[:i+1])
+			}
+		}
+		return ""
+	}
+	runes := []rune(prefix)
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] == maxKeyRune {
+			continue
+		}
+		runes[i]++
+		if utf16.IsSurrogate(runes[i]) {
+			runes[i] = 0xe000
+		}
+		return string(runes[:i+1])
+	}
+	return ""
 }
 
 func (s *ObjectStore) ListObjectsByBucketName(ctx context.Context, bucketName string) ([]*Object, error) {
 	rows, err := s.db.QueryContext(ctx, `
-        SELECT o.id, o.bucket_id, o.object_key, o.file_path, o.size, o.content_type, o.checksum, o.created_at
-        FROM objects o
-        JOIN buckets b ON b.id = o.bucket_id
-        WHERE b.name = ?
-        ORDER BY o.id
+        SELECT `+objectColumns+`
+        FROM objects
+        WHERE bucket_id = (SELECT id FROM buckets WHERE name = ?)
+        ORDER BY id
     `, bucketName)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return scanObjects(rows)
+}
 
-	var objects []*Object
-	for rows.Next() {
-		var o Object
-		if err := rows.Scan(
-			&o.ID, &o.BucketID, &o.ObjectKey, &o.FilePath, &o.Size,
-			&o.ContentType, &o.Checksum, &o.CreatedAt,
-		); err != nil {
-			return nil, err
-		}
-		objects = append(objects, &o)
+// SetCorrupt records what is wrong with the blob of the row o was read from
+// by ListObjectRows; an empty problem clears the mark. sql.ErrNoRows is
+// returned if the row was removed or now references a different blob.
+func (s *ObjectStore) SetCorrupt(ctx context.Context, o *Object, problem string) error {
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE `+rowTable(o)+` SET corrupt = ?
+        WHERE id = ? AND file_path = ?
+    `, problem, o.ID, o.BlobKey)
+	if err != nil {
+		return err
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = sql.ErrNoRows
 	}
-	return objects, nil
+	return err
 }
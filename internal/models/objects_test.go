@@ -0,0 +1,311 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"buck_It_Up/internal/db"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix, want string
+	}{
+		{"", ""},
+		{"a/", "a0"},
+		{"a\x7f", "a\u0080"},
+		{"é", "ê"},
+		{"a\U0010FFFF", "b"},
+		{"\U0010FFFF", ""},
+		{"x\ud7ff", "x\ue000"},
+	}
+	for _, tt := range tests {
+		got := prefixEnd(tt.prefix)
+		if got != tt.want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("prefixEnd(%q) = %q is not valid UTF-8", tt.prefix, got)
+		}
+		if got != "" && (got <= tt.prefix || got <= tt.prefix+"\U0010FFFF") {
+			t.Errorf("prefixEnd(%q) = %q does not sort after the prefix", tt.prefix, got)
+		}
+	}
+}
+
+// testDatabases returns the databases the store tests run against, each as a
+// function opening another handle on it: a fresh SQLite database, and the
+// PostgreSQL database named by BUCKITUP_TEST_DB_URL if that is set. The
+// handles are closed when the test ends.
+func testDatabases(t *testing.T) map[string]func() *sql.DB {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opens := map[string]func() *sql.DB{
+		"sqlite": func() *sql.DB { return db.Open(path) },
+	}
+	if url := os.Getenv("BUCKITUP_TEST_DB_URL"); url != "" {
+		opens["postgres"] = func() *sql.DB { return db.OpenPostgres(url) }
+	}
+	for name, open := range opens {
+		opens[name] = func() *sql.DB {
+			d := open()
+			t.Cleanup(func() { d.Close() })
+			return d
+		}
+		if _, err := db.Migrate(opens[name]()); err != nil {
+			t.Fatalf("migrate %s: %v", name, err)
+		}
+	}
+	return opens
+}
+
+// newTestBucket creates a bucket with a unique name, which is removed with
+// its contents when the test ends.
+func newTestBucket(t *testing.T, d *sql.DB) int64 {
+	ctx := context.Background()
+	bStore := NewBucketStore(d)
+	bucketID, err := bStore.NewBucket(ctx, &Bucket{Name: fmt.Sprintf("test-%d", time.Now().UnixNano()), CreatedAt: time.Now().Unix()})
+	if err != nil {
+		t.Fatalf("create bucket: %v", err)
+	}
+	t.Cleanup(func() { _ = bStore.DeleteBucketWithContents(ctx, bucketID) })
+	return bucketID
+}
+
+// TestListObjectsNonASCIIPrefixes lists keys whose prefix bounds are not
+// plain byte increments; PostgreSQL rejects bounds that are not valid UTF-8.
+func TestListObjectsNonASCIIPrefixes(t *testing.T) {
+	if os.Getenv("BUCKITUP_TEST_DB_URL") == "" {
+		t.Log("BUCKITUP_TEST_DB_URL not set, running against SQLite only")
+	}
+	for name, open := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			d := open()
+			oStore := NewObjectStore(d)
+			bucketID := newTestBucket(t, d)
+
+			keys := []string{
+				"a/1", "a/2", "a/ü/x", "a\x7f", "a\x7fb",
+				"b/é1", "b/é2", "z", "é/1", "é/2", "é/3", "éa",
+			}
+			for i, key := range keys {
+				_, err := oStore.ReplaceObject(ctx, &Object{
+					BucketID:    bucketID,
+					ObjectKey:   key,
+					BlobKey:     fmt.Sprintf("test/%d/%d", bucketID, i),
+					ContentType: "text/plain",
+					Checksum:    "0",
+					CreatedAt:   int64(1000 + i),
+				}, nil)
+				if err != nil {
+					t.Fatalf("put %q: %v", key, err)
+				}
+			}
+
+			// One entry per page makes every page span several batches and
+			// skip rolled up keys with the sentinel bound.
+			var entries []string
+			opts := ListObjectsOptions{Delimiter: "/", MaxKeys: 1}
+			for {
+				page, err := oStore.ListObjectsPage(ctx, bucketID, opts)
+				if err != nil {
+					t.Fatalf("list after %q: %v", opts.StartAfter, err)
+				}
+				for _, o := range page.Objects {
+					entries = append(entries, o.ObjectKey)
+				}
+				entries = append(entries, page.CommonPrefixes...)
+				if !page.IsTruncated {
+					break
+				}
+				opts.StartAfter = page.Next
+			}
+			want := []string{"a/", "a\x7f", "a\x7fb", "b/", "z", "é/", "éa"}
+			if !slices.Equal(entries, want) {
+				t.Errorf("delimiter listing = %q, want %q", entries, want)
+			}
+
+			for prefix, want := range map[string][]string{
+				"é":     {"é/1", "é/2", "é/3", "éa"},
+				"a\x7f": {"a\x7f", "a\x7fb"},
+				"b/é":   {"b/é1", "b/é2"},
+			} {
+				page, err := oStore.ListObjectsPage(ctx, bucketID, ListObjectsOptions{Prefix: prefix, MaxKeys: 100})
+				if err != nil {
+					t.Fatalf("list prefix %q: %v", prefix, err)
+				}
+				var got []string
+				for _, o := range page.Objects {
+					got = append(got, o.ObjectKey)
+				}
+				if !slices.Equal(got, want) {
+					t.Errorf("prefix %q lists %q, want %q", prefix, got, want)
+				}
+
+				byAge, err := oStore.ListObjectsByAge(ctx, bucketID, prefix, 0, 0, 100)
+				if err != nil {
+					t.Fatalf("list prefix %q by age: %v", prefix, err)
+				}
+				if len(byAge) != len(want) {
+					t.Errorf("prefix %q lists %d objects by age, want %d", prefix, len(byAge), len(want))
+				}
+
+				if _, err := oStore.ListNoncurrentVersions(ctx, bucketID, prefix, time.Now().Unix(), 100); err != nil {
+					t.Fatalf("list noncurrent versions of prefix %q: %v", prefix, err)
+				}
+			}
+		})
+	}
+}
+
+// TestReplaceObjectConcurrently writes the same key from two database handles
+// at once, as two instances sharing a database do. Every write has to see
+// the one before it: each keeps the object it replaces as an older version,
+// and no blob loses a reference it still has.
+func TestReplaceObjectConcurrently(t *testing.T) {
+	const writers, writes = 4, 10
+	for name, open := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			handles := []*sql.DB{open(), open()}
+			bucketID := newTestBucket(t, handles[0])
+
+			var wg sync.WaitGroup
+			errs := make(chan error, writers*writes)
+			for w := range writers {
+				oStore := NewObjectStore(handles[w%len(handles)])
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range writes {
+						_, err := oStore.ReplaceObject(ctx, &Object{
+							BucketID:    bucketID,
+							ObjectKey:   "key",
+							BlobKey:     fmt.Sprintf("test/%d/%d-%d", bucketID, w, i),
+							Size:        1,
+							ContentType: "text/plain",
+							Checksum:    "0",
+							CreatedAt:   time.Now().Unix(),
+							VersionID:   fmt.Sprintf("v%d-%d", w, i),
+						}, nil)
+						if err != nil {
+							errs <- err
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Errorf("replace object: %v", err)
+			}
+
+			page, err := NewObjectStore(handles[0]).ListVersionsPage(ctx, bucketID, ListVersionsOptions{MaxKeys: 2 * writers * writes})
+			if err != nil {
+				t.Fatalf("list versions: %v", err)
+			}
+			if len(page.Versions) != writers*writes {
+				t.Errorf("got %d versions, want %d", len(page.Versions), writers*writes)
+			}
+			blobs := NewBlobStore(handles[1])
+			for w := range writers {
+				for i := range writes {
+					key := fmt.Sprintf("test/%d/%d-%d", bucketID, w, i)
+					if ok, err := blobs.IsReferenced(ctx, key); err != nil || !ok {
+						t.Errorf("blob %s referenced = %v, %v; want true", key, ok, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestListObjectsPage(t *testing.T) {
+	for name, open := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			d := open()
+			oStore := NewObjectStore(d)
+			bucketID := newTestBucket(t, d)
+
+			keys := []string{
+				"a/1", "a/2", "a/b/3", "b", "c/1", "c/2", "d",
+				"photos/2024/x", "photos/2024/y", "photos/2025/z", "photos/cover",
+			}
+			for i, key := range keys {
+				_, err := oStore.ReplaceObject(ctx, &Object{
+					BucketID:    bucketID,
+					ObjectKey:   key,
+					BlobKey:     fmt.Sprintf("test/%d/%d", bucketID, i),
+					ContentType: "text/plain",
+					Checksum:    "0",
+					CreatedAt:   int64(1000 + i),
+				}, nil)
+				if err != nil {
+					t.Fatalf("put %q: %v", key, err)
+				}
+			}
+
+			tests := []struct {
+				name string
+				opts ListObjectsOptions
+				want []string
+			}{
+				{"all", ListObjectsOptions{}, keys},
+				{"prefix", ListObjectsOptions{Prefix: "photos/2024/"}, []string{"photos/2024/x", "photos/2024/y"}},
+				{"start after", ListObjectsOptions{StartAfter: "c/1"}, keys[5:]},
+				{"delimiter", ListObjectsOptions{Delimiter: "/"}, []string{"a/", "b", "c/", "d", "photos/"}},
+				{"prefix and delimiter", ListObjectsOptions{Prefix: "photos/", Delimiter: "/"}, []string{"photos/2024/", "photos/2025/", "photos/cover"}},
+				{"nested prefix", ListObjectsOptions{Prefix: "a/", Delimiter: "/"}, []string{"a/1", "a/2", "a/b/"}},
+				{"start after a rolled up key", ListObjectsOptions{Delimiter: "/", StartAfter: "a/1"}, []string{"b", "c/", "d", "photos/"}},
+				{"start after a common prefix", ListObjectsOptions{Delimiter: "/", StartAfter: "c/"}, []string{"d", "photos/"}},
+				{"longer delimiter", ListObjectsOptions{Prefix: "photos/", Delimiter: "/x"}, []string{"photos/2024/x", "photos/2024/y", "photos/2025/z", "photos/cover"}},
+				{"no match", ListObjectsOptions{Prefix: "e"}, nil},
+			}
+			for _, tt := range tests {
+				for _, maxKeys := range []int{1, 2, 3, 100} {
+					opts := tt.opts
+					opts.MaxKeys = maxKeys
+					var got []string
+					for pages := 0; ; pages++ {
+						if pages > len(keys) {
+							t.Fatalf("%s, %d per page: listing does not end", tt.name, maxKeys)
+						}
+						page, err := oStore.ListObjectsPage(ctx, bucketID, opts)
+						if err != nil {
+							t.Fatalf("%s, %d per page: %v", tt.name, maxKeys, err)
+						}
+						var entries []string
+						for _, o := range page.Objects {
+							entries = append(entries, o.ObjectKey)
+						}
+						entries = append(entries, page.CommonPrefixes...)
+						slices.Sort(entries)
+						if len(entries) > maxKeys {
+							t.Errorf("%s: page of %d entries, want at most %d", tt.name, len(entries), maxKeys)
+						}
+						got = append(got, entries...)
+						if !page.IsTruncated {
+							break
+						}
+						if page.Next != entries[len(entries)-1] {
+							t.Errorf("%s, %d per page: next is %q, want the last entry %q", tt.name, maxKeys, page.Next, entries[len(entries)-1])
+						}
+						opts.StartAfter = page.Next
+					}
+					if !slices.Equal(got, tt.want) {
+						t.Errorf("%s, %d per page: got %q, want %q", tt.name, maxKeys, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
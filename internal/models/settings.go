@@ -0,0 +1,44 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// SettingsStore keeps server wide settings as name/value pairs.
+type SettingsStore struct {
+	db *preparedDB
+}
+
+func NewSettingsStore(db *sql.DB) *SettingsStore {
+	return &SettingsStore{db: newPreparedDB(db)}
+}
+
+func (s *SettingsStore) GetSetting(ctx context.Context, name string) (string, error) {
+	var value string
+	err := s.db.QueryRowContext(ctx, `
+        SELECT value FROM settings
+        WHERE name = ?
+    `, name).Scan(&value)
+	return value, err
+}
+
+func (s *SettingsStore) SetSetting(ctx context.Context, name, value string) error {
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO settings (name, value) VALUES (?, ?)
+        ON CONFLICT(name) DO UPDATE SET value = excluded.value
+    `, name, value)
+	return err
+}
+
+// InitSetting stores value under name unless the setting already exists, and
+// returns the stored value either way.
+func (s *SettingsStore) InitSetting(ctx context.Context, name, value string) (string, error) {
+	if _, err := s.db.ExecContext(ctx, `
+        INSERT INTO settings (name, value) VALUES (?, ?)
+        ON CONFLICT(name) DO NOTHING
+    `, name, value); err != nil {
+		return "", err
+	}
+	return s.GetSetting(ctx, name)
+}
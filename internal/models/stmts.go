@@ -0,0 +1,84 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"buck_It_Up/internal/db"
+)
+
+// maxPreparedStmts bounds the statements a store keeps prepared. Queries
+// are built from a fixed set of fragments, but some repeat a fragment per
+// filter, so the number of distinct ones is not fixed.
+const maxPreparedStmts = 128
+
+// preparedDB runs the queries of a store outside transactions as prepared
+// statements, each prepared once and kept for the life of the store.
+// database/sql prepares a statement again on every connection it runs on.
+type preparedDB struct {
+	*sql.DB
+	dialect db.Dialect
+	mu      sync.Mutex
+	stmts   map[string]*sql.Stmt
+}
+
+func newPreparedDB(d *sql.DB) *preparedDB {
+	return &preparedDB{DB: d, dialect: db.DialectOf(d), stmts: make(map[string]*sql.Stmt)}
+}
+
+// stmt returns the prepared statement for query, or nil if it could not be
+// prepared or too many are prepared already, in which case the query is run
+// directly. Preparing is a round trip to the database, so it happens outside
+// the lock; of two goroutines preparing the same query, the second one's
+// statement is closed again.
+func (p *preparedDB) stmt(ctx context.Context, query string) *sql.Stmt {
+	p.mu.Lock()
+	stmt, ok := p.stmts[query]
+	full := len(p.stmts) >= maxPreparedStmts
+	p.mu.Unlock()
+	if ok {
+		return stmt
+	}
+	if full {
+		return nil
+	}
+
+	stmt, err := p.DB.PrepareContext(ctx, query)
+	if err != nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing, ok := p.stmts[query]; ok {
+		stmt.Close()
+		return existing
+	}
+	if len(p.stmts) >= maxPreparedStmts {
+		stmt.Close()
+		return nil
+	}
+	p.stmts[query] = stmt
+	return stmt
+}
+
+func (p *preparedDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	if stmt := p.stmt(ctx, query); stmt != nil {
+		return stmt.ExecContext(ctx, args...)
+	}
+	return p.DB.ExecContext(ctx, query, args...)
+}
+
+func (p *preparedDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	if stmt := p.stmt(ctx, query); stmt != nil {
+		return stmt.QueryContext(ctx, args...)
+	}
+	return p.DB.QueryContext(ctx, query, args...)
+}
+
+func (p *preparedDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	if stmt := p.stmt(ctx, query); stmt != nil {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+	return p.DB.QueryRowContext(ctx, query, args...)
+}
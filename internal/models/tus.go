@@ -0,0 +1,119 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+type TusStore struct {
+	db *preparedDB
+}
+
+func NewTusStore(db *sql.DB) *TusStore {
+	return &TusStore{db: newPreparedDB(db)}
+}
+
+const tusColumns = `id, upload_id, bucket_id, object_key, COALESCE(content_type, ''), file_path,
+		upload_length, upload_offset, COALESCE(metadata, ''), created_at, expires_at,
+		encryption, key_id, data_key`
+
+func scanTusUpload(row rowScanner) (*TusUpload, error) {
+	var u TusUpload
+	err := row.Scan(
+		&u.ID, &u.UploadID, &u.BucketID, &u.ObjectKey, &u.ContentType, &u.BlobKey,
+		&u.Length, &u.Offset, &u.Metadata, &u.CreatedAt, &u.ExpiresAt,
+		&u.Encryption, &u.KeyID, &u.DataKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *TusStore) CreateUpload(ctx context.Context, u *TusUpload) (int64, error) {
+	var id int64
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO tus_uploads (
+			upload_id, bucket_id, object_key, content_type, file_path,
+			upload_length, upload_offset, metadata, created_at, expires_at,
+			encryption, key_id, data_key
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`,
+		u.UploadID, u.BucketID, u.ObjectKey, u.ContentType, u.BlobKey,
+		u.Length, u.Offset, u.Metadata, u.CreatedAt, u.ExpiresAt,
+		u.Encryption, u.KeyID, u.DataKey,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *TusStore) GetUpload(ctx context.Context, bucketID int64, uploadID string) (*TusUpload, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT `+tusColumns+`
+		FROM tus_uploads
+		WHERE bucket_id = ? AND upload_id = ?
+	`, bucketID, uploadID)
+	return scanTusUpload(row)
+}
+
+// UpdateOffset records how many bytes of the upload have been received and
+// when it expires if no more data arrives.
+func (s *TusStore) UpdateOffset(ctx context.Context, uploadID string, offset, expiresAt int64) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE tus_uploads SET upload_offset = ?, expires_at = ?
+		WHERE upload_id = ?
+	`, offset, expiresAt, uploadID)
+	return err
+}
+
+// ListExpired returns uploads of all buckets whose expiry lies before the
+// given unix time.
+func (s *TusStore) ListExpired(ctx context.Context, now int64) ([]*TusUpload, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+tusColumns+`
+		FROM tus_uploads
+		WHERE expires_at < ?
+	`, now)
+	if err != nil {
+		return nil, err
+	}
+	return scanTusUploads(rows)
+}
+
+func (s *TusStore) ListUploads(ctx context.Context, bucketID int64) ([]*TusUpload, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+tusColumns+`
+		FROM tus_uploads
+		WHERE bucket_id = ?
+		ORDER BY object_key, created_at
+	`, bucketID)
+	if err != nil {
+		return nil, err
+	}
+	return scanTusUploads(rows)
+}
+
+func scanTusUploads(rows *sql.Rows) ([]*TusUpload, error) {
+	defer rows.Close()
+
+	var uploads []*TusUpload
+	for rows.Next() {
+		u, err := scanTusUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+func (s *TusStore) DeleteUpload(ctx context.Context, uploadID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM tus_uploads WHERE upload_id = ?`, uploadID)
+	return err
+}
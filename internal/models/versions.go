@@ -0,0 +1,510 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// NullVersionID names the version of an object that was written while the
+// bucket did not have versioning enabled.
+const NullVersionID = "null"
+
+// versionColumns is the column list of object_versions queries, in the order
+// expected by scanVersion.
+const versionColumns = `id, bucket_id, object_key, file_path, size, content_type, checksum,
+        COALESCE(checksum_sha256, ''), COALESCE(checksum_md5, ''), COALESCE(checksum_crc32c, ''),
+        encoding, encryption, key_id, data_key, corrupt, created_at, version_id, is_delete_marker`
+
+func scanVersion(row rowScanner) (*Object, error) {
+	var o Object
+	if err := row.Scan(
+		&o.ID, &o.BucketID, &o.ObjectKey, &o.BlobKey, &o.Size,
+		&o.ContentType, &o.Checksum,
+		&o.ChecksumSHA256, &o.ChecksumMD5, &o.ChecksumCRC32C,
+		&o.Encoding, &o.Encryption, &o.KeyID, &o.DataKey, &o.Corrupt, &o.CreatedAt, &o.VersionID, &o.IsDeleteMarker,
+	); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// insertVersion copies o into the version history. Objects without a version
+// ID are recorded as the "null" version.
+func insertVersion(ctx context.Context, tx *sql.Tx, o *Object) error {
+	versionID := o.VersionID
+	if versionID == "" {
+		versionID = NullVersionID
+	}
+	_, err := tx.ExecContext(ctx, `
+        INSERT INTO object_versions (
+            bucket_id, object_key, version_id, file_path, size, content_type, checksum,
+            checksum_sha256, checksum_md5, checksum_crc32c, encoding,
+            encryption, key_id, data_key, corrupt, is_delete_marker, created_at
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+		o.BucketID, o.ObjectKey, versionID, o.BlobKey, o.Size, o.ContentType, o.Checksum,
+		o.ChecksumSHA256, o.ChecksumMD5, o.ChecksumCRC32C, o.Encoding,
+		o.Encryption, o.KeyID, o.DataKey, o.Corrupt, o.IsDeleteMarker, o.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	return addBlobRef(ctx, tx, o)
+}
+
+// deleteNullVersion removes the "null" version of key from the history and
+// returns it, or nil if there is none.
+func deleteNullVersion(ctx context.Context, tx *sql.Tx, bucketID int64, objectKey string) (*Object, error) {
+	return deleteHistoryVersion(ctx, tx, bucketID, objectKey, NullVersionID)
+}
+
+func deleteHistoryVersion(ctx context.Context, tx *sql.Tx, bucketID int64, objectKey, versionID string) (*Object, error) {
+	o, err := scanVersion(tx.QueryRowContext(ctx, `
+        SELECT `+versionColumns+`
+        FROM object_versions
+        WHERE bucket_id = ? AND object_key = ? AND version_id = ?
+    `, bucketID, objectKey, versionID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM object_versions WHERE id = ?`, o.ID); err != nil {
+		return nil, err
+	}
+	if err := dropBlobRef(ctx, tx, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func hasHistory(ctx context.Context, tx *sql.Tx, bucketID int64, objectKey string) (bool, error) {
+	var n int
+	err := tx.QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM object_versions
+        WHERE bucket_id = ? AND object_key = ?
+    `, bucketID, objectKey).Scan(&n)
+	return n > 0, err
+}
+
+// RemoveCurrentObject deletes the object stored under key the way a delete
+// without a version ID does. If versioning is enabled, or the key already has
+// older versions, the object is kept in the history and a delete marker named
+// markerID is recorded on top of it; pass NullVersionID as markerID when
+// versioning is not enabled. The returned object is the one that is no longer
+// reachable at all, if any, so the caller can remove its blob.
+// sql.ErrNoRows is returned if the key has neither an object nor versions.
+func (s *ObjectStore) RemoveCurrentObject(ctx context.Context, bucketID int64, objectKey, markerID string) (*Object, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := s.db.lockObjectKeys(ctx, tx, objectRef{bucketID, objectKey}); err != nil {
+		return nil, err
+	}
+	removed, err := removeCurrentObject(ctx, tx, bucketID, objectKey, markerID)
+	if err != nil {
+		return nil, err
+	}
+	return removed, tx.Commit()
+}
+
+// RemoveCurrentObjects removes several objects as RemoveCurrentObject does,
+// using markerIDs[i] for objs[i], in a single transaction. Objects that are
+// no longer the current object under their key, because they were deleted or
+// overwritten in the meantime, are skipped. It returns the number of objects
+// removed and those of them that are no longer reachable at all.
+func (s *ObjectStore) RemoveCurrentObjects(ctx context.Context, objs []*Object, markerIDs []string) (int, []*Object, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	refs := make([]objectRef, len(objs))
+	for i, obj := range objs {
+		refs[i] = objectRef{obj.BucketID, obj.ObjectKey}
+	}
+	if err := s.db.lockObjectKeys(ctx, tx, refs...); err != nil {
+		return 0, nil, err
+	}
+	n := 0
+	var removed []*Object
+	for i, obj := range objs {
+		current, err := currentObject(ctx, tx, obj.BucketID, obj.ObjectKey)
+		if err != nil {
+			return 0, nil, err
+		}
+		if current == nil || current.BlobKey != obj.BlobKey {
+			continue
+		}
+		o, err := removeCurrentObject(ctx, tx, obj.BucketID, obj.ObjectKey, markerIDs[i])
+		if err != nil {
+			return 0, nil, err
+		}
+		n++
+		if o != nil {
+			removed = append(removed, o)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return n, removed, nil
+}
+
+func removeCurrentObject(ctx context.Context, tx *sql.Tx, bucketID int64, objectKey, markerID string) (*Object, error) {
+	existing, err := currentObject(ctx, tx, bucketID, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	versioned, err := hasHistory(ctx, tx, bucketID, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil && !versioned {
+		return nil, sql.ErrNoRows
+	}
+
+	var removed *Object
+	if existing != nil {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM objects WHERE id = ?`, existing.ID); err != nil {
+			return nil, err
+		}
+		if err := dropBlobRef(ctx, tx, existing); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case markerID == NullVersionID && !versioned && existing.VersionID == "":
+		// Plain delete in a bucket that never had versioning.
+		removed = existing
+	case markerID == NullVersionID:
+		if removed, err = deleteNullVersion(ctx, tx, bucketID, objectKey); err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			if existing.VersionID == "" {
+				removed = existing
+			} else if err := insertVersion(ctx, tx, existing); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		if existing != nil {
+			if existing.VersionID == "" {
+				if removed, err = deleteNullVersion(ctx, tx, bucketID, objectKey); err != nil {
+					return nil, err
+				}
+			}
+			if err := insertVersion(ctx, tx, existing); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if markerID != NullVersionID || versioned || existing.VersionID != "" {
+		marker := &Object{
+			BucketID:       bucketID,
+			ObjectKey:      objectKey,
+			VersionID:      markerID,
+			IsDeleteMarker: true,
+			CreatedAt:      time.Now().Unix(),
+		}
+		if err := insertVersion(ctx, tx, marker); err != nil {
+			return nil, err
+		}
+	}
+
+	if removed != nil {
+		if err := deleteAttributes(ctx, tx, removed); err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+// GetVersion returns a specific version of key, which may be the current
+// object or a delete marker.
+func (s *ObjectStore) GetVersion(ctx context.Context, bucketID int64, objectKey, versionID string) (*Object, error) {
+	current, err := s.GetObject(ctx, bucketID, objectKey)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if current != nil && versionMatches(current, versionID) {
+		current.IsLatest = true
+		return current, nil
+	}
+	return scanVersion(s.db.QueryRowContext(ctx, `
+        SELECT `+versionColumns+`
+        FROM object_versions
+        WHERE bucket_id = ? AND object_key = ? AND version_id = ?
+    `, bucketID, objectKey, versionID))
+}
+
+func versionMatches(current *Object, versionID string) bool {
+	return current.VersionID == versionID || (current.VersionID == "" && versionID == NullVersionID)
+}
+
+// ListVersionsPage returns one page of the versions of the keys in the
+// bucket, ordered by key and then newest first. The newest version of each
+// key is flagged as the latest one.
+func (s *ObjectStore) ListVersionsPage(ctx context.Context, bucketID int64, opts ListVersionsOptions) (*VersionPage, error) {
+	// Both tables are listed from the same position: current objects
+	// come before the older versions of their key.
+	currentAfter, historyAfter := ``, ``
+	var currentArgs, historyArgs []any
+	if opts.KeyMarker != "" {
+		currentAfter, historyAfter = ` AND object_key > ?`, ` AND v.object_key > ?`
+		currentArgs, historyArgs = []any{opts.KeyMarker}, []any{opts.KeyMarker}
+	}
+	if opts.KeyMarker != "" && opts.VersionIDMarker != "" {
+		marker, err := s.GetVersion(ctx, bucketID, opts.KeyMarker, opts.VersionIDMarker)
+		switch {
+		case err == sql.ErrNoRows:
+			currentAfter, historyAfter = ` AND object_key >= ?`, ` AND v.object_key >= ?`
+		case err != nil:
+			return nil, err
+		case marker.IsLatest:
+			historyAfter = ` AND v.object_key >= ?`
+		default:
+			historyAfter = ` AND (v.object_key > ? OR (v.object_key = ? AND v.id < ?))`
+			historyArgs = append(historyArgs, opts.KeyMarker, marker.ID)
+		}
+	}
+	currentRange, historyRange := ` AND object_key >= ?`, ` AND v.object_key >= ?`
+	prefixArgs := []any{opts.Prefix}
+	if end := prefixEnd(opts.Prefix); end != "" {
+		currentRange += ` AND object_key < ?`
+		historyRange += ` AND v.object_key < ?`
+		prefixArgs = append(prefixArgs, end)
+	}
+
+	args := append([]any{bucketID}, prefixArgs...)
+	args = append(args, currentArgs...)
+	args = append(args, bucketID)
+	args = append(args, prefixArgs...)
+	args = append(args, historyArgs...)
+	args = append(args, opts.MaxKeys+1)
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT `+objectColumns+`, FALSE, FALSE AS history, TRUE AS is_latest
+        FROM objects
+        WHERE bucket_id = ?`+currentRange+currentAfter+`
+        UNION ALL
+        SELECT `+versionColumns+`, TRUE AS history,
+            NOT EXISTS (SELECT 1 FROM objects o
+                        WHERE o.bucket_id = v.bucket_id AND o.object_key = v.object_key)
+            AND NOT EXISTS (SELECT 1 FROM object_versions n
+                            WHERE n.bucket_id = v.bucket_id AND n.object_key = v.object_key AND n.id > v.id) AS is_latest
+        FROM object_versions v
+        WHERE v.bucket_id = ?`+historyRange+historyAfter+`
+        ORDER BY object_key, history, id DESC
+        LIMIT ?
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &VersionPage{Versions: []*Object{}}
+	for rows.Next() {
+		var o Object
+		var history bool
+		if err := rows.Scan(
+			&o.ID, &o.BucketID, &o.ObjectKey, &o.BlobKey, &o.Size,
+			&o.ContentType, &o.Checksum,
+			&o.ChecksumSHA256, &o.ChecksumMD5, &o.ChecksumCRC32C,
+			&o.Encoding, &o.Encryption, &o.KeyID, &o.DataKey, &o.Corrupt, &o.CreatedAt, &o.VersionID, &o.IsDeleteMarker,
+			&history, &o.IsLatest,
+		); err != nil {
+			return nil, err
+		}
+		if o.VersionID == "" {
+			o.VersionID = NullVersionID
+		}
+		if len(page.Versions) >= opts.MaxKeys {
+			page.IsTruncated = true
+			if n := len(page.Versions); n > 0 {
+				page.NextKeyMarker, page.NextVersionIDMarker = page.Versions[n-1].ObjectKey, page.Versions[n-1].VersionID
+			}
+			break
+		}
+		page.Versions = append(page.Versions, &o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// DeleteVersion permanently removes one version of key and returns it. When
+// the current object is removed, the newest older version becomes current
+// unless it is a delete marker.
+func (s *ObjectStore) DeleteVersion(ctx context.Context, bucketID int64, objectKey, versionID string) (*Object, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := s.db.lockObjectKeys(ctx, tx, objectRef{bucketID, objectKey}); err != nil {
+		return nil, err
+	}
+	current, err := currentObject(ctx, tx, bucketID, objectKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed *Object
+	if current != nil && versionMatches(current, versionID) {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM objects WHERE id = ?`, current.ID); err != nil {
+			return nil, err
+		}
+		if err := dropBlobRef(ctx, tx, current); err != nil {
+			return nil, err
+		}
+		removed, current = current, nil
+	} else {
+		if removed, err = deleteHistoryVersion(ctx, tx, bucketID, objectKey, versionID); err != nil {
+			return nil, err
+		}
+		if removed == nil {
+			return nil, sql.ErrNoRows
+		}
+	}
+
+	if err := deleteAttributes(ctx, tx, removed); err != nil {
+		return nil, err
+	}
+	if current == nil {
+		if err := promoteNewestVersion(ctx, tx, bucketID, objectKey); err != nil {
+			return nil, err
+		}
+	}
+	return removed, tx.Commit()
+}
+
+// promoteNewestVersion makes the newest older version of key current, unless
+// it is a delete marker.
+func promoteNewestVersion(ctx context.Context, tx *sql.Tx, bucketID int64, objectKey string) error {
+	newest, err := scanVersion(tx.QueryRowContext(ctx, `
+        SELECT `+versionColumns+`
+        FROM object_versions
+        WHERE bucket_id = ? AND object_key = ?
+        ORDER BY id DESC
+        LIMIT 1
+    `, bucketID, objectKey))
+	if err == sql.ErrNoRows || (err == nil && newest.IsDeleteMarker) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM object_versions WHERE id = ?`, newest.ID); err != nil {
+		return err
+	}
+	if err := dropBlobRef(ctx, tx, newest); err != nil {
+		return err
+	}
+	if newest.VersionID == NullVersionID {
+		newest.VersionID = ""
+	}
+	_, err = insertObject(ctx, tx, newest)
+	return err
+}
+
+// ListNoncurrentVersions returns up to limit older versions of keys starting
+// with prefix, oldest first, that were superseded before the unix time
+// noncurrentBefore. A version is superseded when the next newer version or
+// delete marker of its key, or the current object, was written.
+func (s *ObjectStore) ListNoncurrentVersions(ctx context.Context, bucketID int64, prefix string, noncurrentBefore int64, limit int) ([]*Object, error) {
+	query := `
+        SELECT ` + versionColumns + `
+        FROM object_versions v
+        WHERE v.bucket_id = ? AND v.object_key >= ?`
+	args := []any{bucketID, prefix}
+	if end := prefixEnd(prefix); end != "" {
+		query += ` AND v.object_key < ?`
+		args = append(args, end)
+	}
+	query += `
+          AND COALESCE(
+                (SELECT n.created_at FROM object_versions n
+                 WHERE n.bucket_id = v.bucket_id AND n.object_key = v.object_key AND n.id > v.id
+                 ORDER BY n.id LIMIT 1),
+                (SELECT o.created_at FROM objects o
+                 WHERE o.bucket_id = v.bucket_id AND o.object_key = v.object_key)
+              ) < ?
+        ORDER BY v.id
+        LIMIT ?`
+	args = append(args, noncurrentBefore, limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanVersions(rows)
+}
+
+// ListExpiredDeleteMarkers returns up to limit delete markers of keys
+// starting with prefix that hide nothing: the key has neither a current
+// object nor any other version.
+func (s *ObjectStore) ListExpiredDeleteMarkers(ctx context.Context, bucketID int64, prefix string, limit int) ([]*Object, error) {
+	query := `
+        SELECT ` + versionColumns + `
+        FROM object_versions v
+        WHERE v.bucket_id = ? AND v.object_key >= ?`
+	args := []any{bucketID, prefix}
+	if end := prefixEnd(prefix); end != "" {
+		query += ` AND v.object_key < ?`
+		args = append(args, end)
+	}
+	query += `
+          AND v.is_delete_marker = TRUE
+          AND NOT EXISTS (SELECT 1 FROM object_versions n
+                          WHERE n.bucket_id = v.bucket_id AND n.object_key = v.object_key AND n.id <> v.id)
+          AND NOT EXISTS (SELECT 1 FROM objects o
+                          WHERE o.bucket_id = v.bucket_id AND o.object_key = v.object_key)
+        ORDER BY v.id
+        LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanVersions(rows)
+}
+
+func scanVersions(rows *sql.Rows) ([]*Object, error) {
+	defer rows.Close()
+
+	var versions []*Object
+	for rows.Next() {
+		o, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// IsBucketEmpty reports whether the bucket has neither objects nor older
+// versions of objects.
+func (s *ObjectStore) IsBucketEmpty(ctx context.Context, bucketID int64) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+        SELECT (SELECT COUNT(*) FROM objects WHERE bucket_id = ?)
+             + (SELECT COUNT(*) FROM object_versions WHERE bucket_id = ?)
+    `, bucketID, bucketID).Scan(&n)
+	return n == 0, err
+}
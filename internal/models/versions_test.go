@@ -0,0 +1,95 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestListVersionsPage(t *testing.T) {
+	for name, open := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			d := open()
+			oStore := NewObjectStore(d)
+			bucketID := newTestBucket(t, d)
+
+			put := func(key, versionID string) {
+				t.Helper()
+				_, err := oStore.ReplaceObject(ctx, &Object{
+					BucketID:    bucketID,
+					ObjectKey:   key,
+					BlobKey:     fmt.Sprintf("test/%d/%s-%s", bucketID, key, versionID),
+					ContentType: "text/plain",
+					Checksum:    "0",
+					CreatedAt:   1000,
+					VersionID:   versionID,
+				}, nil)
+				if err != nil {
+					t.Fatalf("put %s@%s: %v", key, versionID, err)
+				}
+			}
+			put("a", "a1")
+			put("a", "a2")
+			put("a", "a3")
+			put("b", "b1")
+			if _, err := oStore.RemoveCurrentObject(ctx, bucketID, "b", "bm"); err != nil {
+				t.Fatalf("delete b: %v", err)
+			}
+			put("c/x", "c1")
+			put("d", "")
+
+			// Entries are key@version, with a * on the latest version of
+			// each key.
+			all := []string{"a@a3*", "a@a2", "a@a1", "b@bm*", "b@b1", "c/x@c1*", "d@null*"}
+			tests := []struct {
+				name string
+				opts ListVersionsOptions
+				want []string
+			}{
+				{"all", ListVersionsOptions{}, all},
+				{"prefix", ListVersionsOptions{Prefix: "c/"}, []string{"c/x@c1*"}},
+				{"after key", ListVersionsOptions{KeyMarker: "a"}, all[3:]},
+				{"after current version", ListVersionsOptions{KeyMarker: "a", VersionIDMarker: "a3"}, all[1:]},
+				{"after older version", ListVersionsOptions{KeyMarker: "a", VersionIDMarker: "a2"}, all[2:]},
+				{"after delete marker", ListVersionsOptions{KeyMarker: "b", VersionIDMarker: "bm"}, all[4:]},
+				{"after null version", ListVersionsOptions{KeyMarker: "d", VersionIDMarker: NullVersionID}, nil},
+				{"after missing version", ListVersionsOptions{KeyMarker: "b", VersionIDMarker: "gone"}, all[3:]},
+			}
+			for _, tt := range tests {
+				for _, maxKeys := range []int{1, 2, 3, 100} {
+					opts := tt.opts
+					opts.MaxKeys = maxKeys
+					var got []string
+					for pages := 0; ; pages++ {
+						if pages > len(all) {
+							t.Fatalf("%s, %d per page: listing does not end", tt.name, maxKeys)
+						}
+						page, err := oStore.ListVersionsPage(ctx, bucketID, opts)
+						if err != nil {
+							t.Fatalf("%s, %d per page: %v", tt.name, maxKeys, err)
+						}
+						if len(page.Versions) > maxKeys {
+							t.Errorf("%s: page of %d versions, want at most %d", tt.name, len(page.Versions), maxKeys)
+						}
+						for _, v := range page.Versions {
+							entry := v.ObjectKey + "@" + v.VersionID
+							if v.IsLatest {
+								entry += "*"
+							}
+							got = append(got, entry)
+						}
+						if !page.IsTruncated {
+							break
+						}
+						opts.KeyMarker, opts.VersionIDMarker = page.NextKeyMarker, page.NextVersionIDMarker
+					}
+					if !slices.Equal(got, tt.want) {
+						t.Errorf("%s, %d per page: got %q, want %q", tt.name, maxKeys, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package secret
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrUnknownMasterKey is returned when a data key is wrapped by a master key
+// that is not configured.
+var ErrUnknownMasterKey = errors.New("unknown master key")
+
+// A Keyring holds the master keys that wrap the data keys of encrypted
+// objects. The current key wraps new data keys; the others are only used to
+// unwrap data keys wrapped before the master key was rotated.
+type Keyring struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+// LoadMasterKeys reads the master keys from BUCKITUP_MASTER_KEY, a comma
+// separated list, or from the file named by BUCKITUP_MASTER_KEY_FILE, one key
+// per line. The first key is the current one. It returns nil if neither is
+// set.
+func LoadMasterKeys() (*Keyring, error) {
+	var materials []string
+	if v := os.Getenv("BUCKITUP_MASTER_KEY"); v != "" {
+		materials = strings.Split(v, ",")
+	} else if path := os.Getenv("BUCKITUP_MASTER_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read master key file: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				materials = append(materials, line)
+			}
+		}
+		if len(materials) == 0 {
+			return nil, fmt.Errorf("master key file %s holds no key", path)
+		}
+	} else {
+		return nil, nil
+	}
+	return NewKeyring(materials)
+}
+
+// NewKeyring returns a keyring of the given master keys, the first of which
+// is the current one. Like BUCKITUP_SECRET_KEY, keys may be any string and
+// are turned into AES-256 keys by hashing.
+func NewKeyring(materials []string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string][]byte)}
+	for _, material := range materials {
+		material = strings.TrimSpace(material)
+		if material == "" {
+			return nil, errors.New("empty master key")
+		}
+		key := deriveKey(material)
+		id := masterKeyID(key)
+		if k.currentID == "" {
+			k.currentID = id
+		}
+		k.keys[id] = key
+	}
+	if k.currentID == "" {
+		return nil, errors.New("no master key")
+	}
+	return k, nil
+}
+
+// masterKeyID identifies a master key without revealing it.
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("buckitup master key id\x00"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// CurrentID returns the ID of the master key that wraps new data keys.
+func (k *Keyring) CurrentID() string {
+	return k.currentID
+}
+
+// Wrap seals dataKey with the current master key and returns the master
+// key's ID along with the wrapped key.
+func (k *Keyring) Wrap(dataKey []byte) (keyID, wrapped string, err error) {
+	wrapped, err = Seal(k.keys[k.currentID], dataKey)
+	return k.currentID, wrapped, err
+}
+
+// Unwrap reverses Wrap with the master key keyID.
+func (k *Keyring) Unwrap(keyID, wrapped string) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownMasterKey, keyID)
+	}
+	return Open(key, wrapped)
+}
+
+// Rewrap unwraps a data key wrapped by the master key keyID and wraps it
+// with the current master key.
+func (k *Keyring) Rewrap(keyID, wrapped string) (string, error) {
+	dataKey, err := k.Unwrap(keyID, wrapped)
+	if err != nil {
+		return "", err
+	}
+	_, wrapped, err = k.Wrap(dataKey)
+	return wrapped, err
+}
+
+// NewDataKey returns a random AES-256 key for encrypting one object.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
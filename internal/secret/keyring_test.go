@@ -0,0 +1,48 @@
+package secret
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKeyringRewrap(t *testing.T) {
+	old, err := NewKeyring([]string{"old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := NewKeyring([]string{"new", "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := NewKeyring([]string{"new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.CurrentID() != current.CurrentID() || rotated.CurrentID() == old.CurrentID() {
+		t.Fatalf("key IDs: old %s, rotated %s, current %s", old.CurrentID(), rotated.CurrentID(), current.CurrentID())
+	}
+
+	dataKey, _ := NewDataKey()
+	oldID, wrapped, err := old.Wrap(dataKey)
+	if err != nil {
+		t.Fatalf("wrap: %v", err)
+	}
+	if _, err := current.Unwrap(oldID, wrapped); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("unwrap with the old key dropped = %v, want ErrUnknownMasterKey", err)
+	}
+	if got, err := rotated.Unwrap(oldID, wrapped); err != nil || !bytes.Equal(got, dataKey) {
+		t.Errorf("unwrap after rotation = %x, %v", got, err)
+	}
+
+	rewrapped, err := rotated.Rewrap(oldID, wrapped)
+	if err != nil {
+		t.Fatalf("rewrap: %v", err)
+	}
+	if got, err := current.Unwrap(current.CurrentID(), rewrapped); err != nil || !bytes.Equal(got, dataKey) {
+		t.Errorf("unwrap of the rewrapped key = %x, %v", got, err)
+	}
+	if _, err := current.Unwrap(current.CurrentID(), wrapped); err == nil {
+		t.Errorf("the key wrapped by the old master key unwraps with the new one")
+	}
+}
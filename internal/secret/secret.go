@@ -0,0 +1,95 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const keyFileName = "secret.key"
+
+// LoadServerKey returns the 32 byte server key used to seal secrets stored in
+// the database. It is taken from BUCKITUP_SECRET_KEY when set; otherwise it is
+// read from (or generated into) secret.key in dataRoot.
+func LoadServerKey(dataRoot string) ([]byte, error) {
+	if v := os.Getenv("BUCKITUP_SECRET_KEY"); v != "" {
+		return deriveKey(v), nil
+	}
+
+	path := filepath.Join(dataRoot, keyFileName)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return deriveKey(strings.TrimSpace(string(data))), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(raw)
+	if err := os.MkdirAll(dataRoot, 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(encoded+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	log.Printf("generated new server secret key at %s; set BUCKITUP_SECRET_KEY or keep this file safe", path)
+	return deriveKey(encoded), nil
+}
+
+// deriveKey turns the configured key material into an AES-256 key.
+func deriveKey(material string) []byte {
+	sum := sha256.Sum256([]byte(material))
+	return sum[:]
+}
+
+// Seal encrypts plaintext with AES-GCM and returns it base64 encoded with the
+// nonce prepended.
+func Seal(key, plaintext []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open reverses Seal.
+func Open(key []byte, sealed string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("decode sealed secret: %w", err)
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("sealed secret too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
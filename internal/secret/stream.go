@@ -0,0 +1,189 @@
+package secret
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Encrypted content is split into chunks of chunkSize bytes, each sealed
+// with AES-GCM under the data key on its own so any part of the content can
+// be read without decrypting what comes before it. A chunk's nonce is its
+// index plus a flag marking the last chunk, so chunks can be neither
+// reordered nor cut off at the end. Empty content is a single empty chunk.
+
+const (
+	chunkSize       = 64 << 10
+	tagSize         = 16
+	sealedChunkSize = chunkSize + tagSize
+)
+
+// ErrCorrupt is returned when encrypted content fails to authenticate.
+var ErrCorrupt = errors.New("encrypted content is corrupt or the key is wrong")
+
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// EncryptReader returns a reader of the content of r encrypted with key.
+func EncryptReader(key []byte, r io.Reader) (io.Reader, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		gcm:    gcm,
+		r:      r,
+		in:     make([]byte, 0, chunkSize+1),
+		sealed: make([]byte, 0, sealedChunkSize),
+	}, nil
+}
+
+type encryptReader struct {
+	gcm cipher.AEAD
+	r   io.Reader
+	// in holds the plaintext read so far, one byte more than a chunk to tell
+	// whether the chunk is the last one.
+	in     []byte
+	sealed []byte
+	// out is the part of sealed not returned yet.
+	out   []byte
+	index int64
+	done  bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.sealChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *encryptReader) sealChunk() error {
+	n, err := io.ReadFull(e.r, e.in[len(e.in):chunkSize+1])
+	e.in = e.in[:len(e.in)+n]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := len(e.in) <= chunkSize
+	chunk := e.in[:min(len(e.in), chunkSize)]
+	e.sealed = e.gcm.Seal(e.sealed[:0], chunkNonce(e.index, last), chunk, nil)
+	e.out = e.sealed
+	e.in = append(e.in[:0], e.in[len(chunk):]...)
+	e.index++
+	e.done = last
+	return nil
+}
+
+// DecryptReader returns a reader of the plaintext of the content encrypted
+// with key that r reads. Closing it closes r.
+func DecryptReader(key []byte, r io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealedSize, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	chunks := (sealedSize + sealedChunkSize - 1) / sealedChunkSize
+	if chunks == 0 || sealedSize-(chunks-1)*sealedChunkSize < tagSize {
+		return nil, ErrCorrupt
+	}
+	return &decryptReader{
+		gcm:        gcm,
+		r:          r,
+		sealedSize: sealedSize,
+		chunks:     chunks,
+		size:       sealedSize - chunks*tagSize,
+		index:      -1,
+		sealed:     make([]byte, sealedChunkSize),
+	}, nil
+}
+
+type decryptReader struct {
+	gcm        cipher.AEAD
+	r          io.ReadSeekCloser
+	sealedSize int64
+	chunks     int64
+	// size is the size of the plaintext and pos the position reads continue
+	// from.
+	size, pos int64
+	// plain is the plaintext of the chunk index, -1 if none is decrypted.
+	plain  []byte
+	index  int64
+	sealed []byte
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		if d.size == 0 && d.index < 0 {
+			// Authenticate empty content all the same.
+			if err := d.openChunk(0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	index := d.pos / chunkSize
+	if index != d.index {
+		if err := d.openChunk(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.pos-index*chunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptReader) openChunk(index int64) error {
+	d.index = -1
+	offset := index * sealedChunkSize
+	if _, err := d.r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := d.sealed[:min(sealedChunkSize, d.sealedSize-offset)]
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := d.gcm.Open(d.plain[:0], chunkNonce(index, index == d.chunks-1), sealed, nil)
+	if err != nil {
+		return ErrCorrupt
+	}
+	d.plain, d.index = plain, index
+	return nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of content")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.r.Close()
+}
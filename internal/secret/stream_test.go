@@ -0,0 +1,117 @@
+package secret
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+type readSeekNopCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekNopCloser) Close() error { return nil }
+
+func encrypt(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+	r, err := EncryptReader(key, bytes.NewReader(plain))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	return sealed
+}
+
+func decrypt(key, sealed []byte) (io.ReadSeekCloser, error) {
+	return DecryptReader(key, readSeekNopCloser{bytes.NewReader(sealed)})
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		sealed := encrypt(t, key, plain)
+		chunks := max(1, (size+chunkSize-1)/chunkSize)
+		if len(sealed) != size+chunks*tagSize {
+			t.Errorf("size %d: sealed %d bytes, want %d", size, len(sealed), size+chunks*tagSize)
+		}
+
+		d, err := decrypt(key, sealed)
+		if err != nil {
+			t.Fatalf("size %d: decrypt: %v", size, err)
+		}
+		got, err := io.ReadAll(d)
+		if err != nil {
+			t.Fatalf("size %d: read: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: plaintext differs", size)
+		}
+
+		// Reads continue from any position, across chunk boundaries.
+		for _, offset := range []int{size / 2, size - 1, chunkSize - 3} {
+			if offset < 0 || offset >= size {
+				continue
+			}
+			if _, err := d.Seek(int64(offset), io.SeekStart); err != nil {
+				t.Fatalf("size %d: seek to %d: %v", size, offset, err)
+			}
+			got, err := io.ReadAll(d)
+			if err != nil {
+				t.Fatalf("size %d: read from %d: %v", size, offset, err)
+			}
+			if !bytes.Equal(got, plain[offset:]) {
+				t.Errorf("size %d: plaintext from %d differs", size, offset)
+			}
+		}
+		if end, err := d.Seek(0, io.SeekEnd); err != nil || end != int64(size) {
+			t.Errorf("size %d: seek to end = %d, %v", size, end, err)
+		}
+	}
+}
+
+func TestStreamCorrupt(t *testing.T) {
+	key, _ := NewDataKey()
+	otherKey, _ := NewDataKey()
+	plain := bytes.Repeat([]byte("x"), 2*chunkSize+100)
+	sealed := encrypt(t, key, plain)
+	empty := encrypt(t, key, nil)
+
+	flipped := bytes.Clone(sealed)
+	flipped[chunkSize+tagSize+5] ^= 1
+	swapped := bytes.Clone(sealed)
+	copy(swapped, sealed[sealedChunkSize:2*sealedChunkSize])
+	copy(swapped[sealedChunkSize:], sealed[:sealedChunkSize])
+
+	tests := []struct {
+		name   string
+		key    []byte
+		sealed []byte
+	}{
+		{"wrong key", otherKey, sealed},
+		{"flipped bit", key, flipped},
+		{"chunks swapped", key, swapped},
+		{"last chunk cut off", key, sealed[:2*sealedChunkSize]},
+		{"truncated", key, sealed[:len(sealed)-1]},
+		{"empty content, wrong key", otherKey, empty},
+		{"nothing", key, nil},
+	}
+	for _, tt := range tests {
+		d, err := decrypt(tt.key, tt.sealed)
+		if err == nil {
+			_, err = io.ReadAll(d)
+		}
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: got %v, want ErrCorrupt", tt.name, err)
+		}
+	}
+}
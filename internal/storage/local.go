@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tempPrefix marks files that are still being written by Put.
+const tempPrefix = ".tmp-"
+
+// Local keeps blobs as files below a root directory, at the path given by
+// their key.
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+func (l *Local) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return 0, err
+	}
+	dir := filepath.Dir(p)
+	f, err := l.createTemp(dir)
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := f.Name()
+	_ = f.Chmod(0o644)
+
+	// The content is synced before the rename and the rename before Put
+	// returns, so a blob whose key has been recorded survives a crash whole,
+	// and an interrupted Put leaves at most a temporary file behind.
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, p)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return 0, err
+	}
+	if err := syncDir(dir); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// syncDir makes the creation, renaming and removal of entries in dir
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// createTemp creates a temporary file in dir, creating dir first. Delete
+// removes directories once they are empty, so one may vanish in between;
+// that is retried once.
+func (l *Local) createTemp(dir string) (*os.File, error) {
+	var err error
+	for range 2 {
+		if err = os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create directory: %w", err)
+		}
+		var f *os.File
+		if f, err = os.CreateTemp(dir, tempPrefix+"*"); err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	return nil, fmt.Errorf("create temp file: %w", err)
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (Info, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && fi.IsDir()) {
+		return Info{}, ErrNotExist
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Delete removes the file of the blob and then every parent directory
+// below the root that is left empty.
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	root := filepath.Clean(l.root)
+	for dir := filepath.Dir(p); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]Info, error) {
+	// Walk the deepest directory that contains every match.
+	start := l.root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		dir := prefix[:i]
+		if !validKey(dir) {
+			return nil, ErrInvalidKey
+		}
+		start = filepath.Join(l.root, filepath.FromSlash(dir))
+	}
+
+	var blobs []Info
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		blobs = append(blobs, Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, nil
+}
+
+// Copy hard links dst to src where the file system allows it, so copies
+// take no extra space, and copies the file otherwise.
+func (l *Local) Copy(ctx context.Context, src, dst string) error {
+	srcPath, err := l.path(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := l.path(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	err = os.Link(srcPath, dstPath)
+	if err == nil {
+		return syncDir(filepath.Dir(dstPath))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, statErr := os.Stat(srcPath); errors.Is(statErr, fs.ErrNotExist) {
+			return ErrNotExist
+		}
+	}
+
+	f, err := l.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = l.Put(ctx, dst, f)
+	return err
+}
+
+// RemoveTemp removes the temporary files left behind by writes that were
+// interrupted, e.g. by a crash. Files modified since olderThan are left
+// alone, as they may belong to writes still in progress.
+func (l *Local) RemoveTemp(ctx context.Context, olderThan time.Time) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), tempPrefix) {
+			return ctx.Err()
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(olderThan) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps blobs in memory. It suits tests and throwaway instances;
+// everything is lost when the process exits.
+type Memory struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{blobs: make(map[string]memoryBlob)}
+}
+
+func (m *Memory) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	if !validKey(key) {
+		return 0, ErrInvalidKey
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	m.blobs[key] = memoryBlob{data, time.Now()}
+	m.mu.Unlock()
+	return int64(len(data)), nil
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error { return nil }
+
+func (m *Memory) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	m.mu.RLock()
+	b, ok := m.blobs[key]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotExist
+	}
+	// Blobs are never modified in place, so readers can share the data.
+	return memoryReader{bytes.NewReader(b.data)}, nil
+}
+
+func (m *Memory) Stat(ctx context.Context, key string) (Info, error) {
+	m.mu.RLock()
+	b, ok := m.blobs[key]
+	m.mu.RUnlock()
+	if !ok {
+		return Info{}, ErrNotExist
+	}
+	return Info{Key: key, Size: int64(len(b.data)), ModTime: b.modTime}, nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	delete(m.blobs, key)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) List(ctx context.Context, prefix string) ([]Info, error) {
+	m.mu.RLock()
+	var blobs []Info
+	for key, b := range m.blobs {
+		if strings.HasPrefix(key, prefix) {
+			blobs = append(blobs, Info{Key: key, Size: int64(len(b.data)), ModTime: b.modTime})
+		}
+	}
+	m.mu.RUnlock()
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, nil
+}
+
+func (m *Memory) Copy(ctx context.Context, src, dst string) error {
+	if !validKey(dst) {
+		return ErrInvalidKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.blobs[src]
+	if !ok {
+		return ErrNotExist
+	}
+	m.blobs[dst] = memoryBlob{b.data, time.Now()}
+	return nil
+}
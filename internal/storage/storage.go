@@ -0,0 +1,102 @@
+// Package storage keeps the content of objects and uploads as blobs under
+// slash separated keys such as "buckets/1/objects/<name>". Which backend
+// holds them is chosen by configuration; the database only records keys.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotExist   = errors.New("blob does not exist")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+type Backend interface {
+	// Put stores everything read from r under key, replacing any blob
+	// stored there, and returns its size. The blob only becomes visible
+	// once r is exhausted; if reading or writing fails nothing is stored.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Get opens the blob under key for reading.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	Stat(ctx context.Context, key string) (Info, error)
+	// Delete removes the blob under key; a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+	// List returns the blobs whose keys start with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]Info, error)
+}
+
+// Copier is implemented by backends that can copy a blob without streaming
+// it through the caller.
+type Copier interface {
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// TempRemover is implemented by backends that can be left with partial
+// writes by a crash.
+type TempRemover interface {
+	// RemoveTemp removes the partial writes started before olderThan.
+	RemoveTemp(ctx context.Context, olderThan time.Time) (int, error)
+}
+
+// Open returns the backend of the given kind: "local" (the default) keeps
+// blobs as files below root, "memory" keeps them in memory until the
+// process exits.
+func Open(kind, root string) (Backend, error) {
+	switch kind {
+	case "", "local":
+		return NewLocal(root), nil
+	case "memory":
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", kind)
+	}
+}
+
+// Copy copies the blob under src to dst, letting b do it if it is a Copier.
+func Copy(ctx context.Context, b Backend, src, dst string) error {
+	if c, ok := b.(Copier); ok {
+		return c.Copy(ctx, src, dst)
+	}
+	r, err := b.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = b.Put(ctx, dst, r)
+	return err
+}
+
+// DeletePrefix deletes every blob whose key starts with prefix.
+func DeletePrefix(ctx context.Context, b Backend, prefix string) error {
+	blobs, err := b.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, info := range blobs {
+		if err := b.Delete(ctx, info.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validKey rejects keys that are not clean relative paths, so no key can
+// point outside of a backend's root.
+func validKey(key string) bool {
+	return key != "" && key != "." && path.Clean(key) == key &&
+		!strings.HasPrefix(key, "/") && key != ".." && !strings.HasPrefix(key, "../") &&
+		!strings.ContainsAny(key, "\\\x00")
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"log"
 	"os"
+	"time"
 
 	nethttp "net/http"
 
 	"buck_It_Up/internal/db"
 	httpinternal "buck_It_Up/internal/http"
+	"buck_It_Up/internal/secret"
+	"buck_It_Up/internal/storage"
 )
 
 func main() {
@@ -16,18 +21,92 @@ func main() {
 		dbPath = "data.db"
 	}
 
-	d := db.Open(dbPath)
+	dataRoot := os.Getenv("BUCKITUP_DATA_PATH")
+	if dataRoot == "" {
+		dataRoot = "data"
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restore(dbPath, dataRoot, os.Args[2:])
+		return
+	}
+
+	var d *sql.DB
+	dbName := dbPath
+	if dbURL := os.Getenv("BUCKITUP_DB_URL"); dbURL != "" {
+		d, dbName = db.OpenPostgres(dbURL), "postgres"
+	} else {
+		d = db.Open(dbPath)
+	}
 	defer d.Close()
 
-	r := httpinternal.New(d)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrateCommand(d, os.Args[2:])
+		return
+	}
+	if n, err := db.Migrate(d); err != nil {
+		log.Fatalf("failed to run migrations: %v", err)
+	} else if n > 0 {
+		log.Printf("applied %d schema migrations", n)
+	}
+
+	keys, err := secret.LoadMasterKeys()
+	if err != nil {
+		log.Fatalf("failed to load master keys: %v", err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rewrap-keys":
+			rewrapKeys(d, keys)
+		case "fsck":
+			fsck(newRouter(d, keys, dataRoot), os.Args[2:])
+		case "backup":
+			backup(newRouter(d, keys, dataRoot), os.Args[2:])
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+		return
+	}
+
+	r := newRouter(d, keys, dataRoot)
+	if mode := httpinternal.ReconcileMode(); mode != httpinternal.ReconcileOff {
+		if err := r.Reconcile(context.Background(), mode == httpinternal.ReconcileRepair); err != nil {
+			log.Fatalf("failed to reconcile storage: %v", err)
+		}
+	}
+
+	go r.RunUploadSweeper(context.Background(), time.Hour, httpinternal.UploadExpiry())
+	go r.RunLifecycleWorker(context.Background(), httpinternal.LifecycleInterval())
+	go r.RunJobScanner(context.Background(), httpinternal.JobScanInterval)
 
 	addr := ":8080"
 	if p := os.Getenv("PORT"); p != "" {
 		addr = ":" + p
 	}
 
-	log.Printf("starting server on %s (db=%s)", addr, dbPath)
+	log.Printf("starting server on %s (db=%s)", addr, dbName)
 	if err := nethttp.ListenAndServe(addr, r.Handler()); err != nil {
 		log.Fatalf("server exited: %v", err)
 	}
 }
+
+// newRouter opens the storage below dataRoot and returns the router serving
+// it, with the blob keys of older databases migrated.
+func newRouter(d *sql.DB, keys *secret.Keyring, dataRoot string) *httpinternal.Router {
+	secretKey, err := secret.LoadServerKey(dataRoot)
+	if err != nil {
+		log.Fatalf("failed to load server secret key: %v", err)
+	}
+
+	blobs, err := storage.Open(os.Getenv("BUCKITUP_STORAGE"), dataRoot)
+	if err != nil {
+		log.Fatalf("failed to open storage: %v", err)
+	}
+
+	r := httpinternal.New(d, secretKey, blobs, keys)
+	if err := r.MigrateBlobKeys(context.Background(), dataRoot); err != nil {
+		log.Fatalf("failed to migrate blob keys: %v", err)
+	}
+	return r
+}
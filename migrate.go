@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"buck_It_Up/internal/db"
+)
+
+// migrateCommand runs "migrate status", "migrate up" or "migrate down [n]".
+// The server applies pending migrations itself when it starts; down reverts
+// the last n (default 1) and is meant for rolling back before a downgrade.
+func migrateCommand(d *sql.DB, args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: buckitup migrate status|up|down [n]")
+	}
+	switch args[0] {
+	case "status":
+		statuses, err := db.Status(d)
+		if err != nil {
+			log.Fatalf("migrate status: %v", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != 0 {
+				applied = time.Unix(s.AppliedAt, 0).Format(time.RFC3339)
+			}
+			if s.Unknown {
+				applied += " (unknown to this binary)"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		tw.Flush()
+	case "up":
+		n, err := db.Migrate(d)
+		if err != nil {
+			log.Fatalf("migrate up: applied %d migrations, then failed: %v", n, err)
+		}
+		log.Printf("migrate up: applied %d migrations", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				log.Fatalf("migrate down: invalid number of migrations %q", args[1])
+			}
+		}
+		n, err := db.Rollback(d, steps)
+		if err != nil {
+			log.Fatalf("migrate down: reverted %d migrations, then failed: %v", n, err)
+		}
+		log.Printf("migrate down: reverted %d migrations", n)
+	default:
+		log.Fatalf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"buck_It_Up/internal/models"
+	"buck_It_Up/internal/secret"
+)
+
+// rewrapKeys wraps the data keys of all objects encrypted under an older
+// master key with the current one. Run it after putting a new master key
+// first in BUCKITUP_MASTER_KEY (or the key file) while keeping the old ones
+// listed after it; once it succeeds, the old keys can be dropped.
+func rewrapKeys(d *sql.DB, keys *secret.Keyring) {
+	if keys == nil {
+		log.Fatal("rewrap-keys: no master key configured; set BUCKITUP_MASTER_KEY or BUCKITUP_MASTER_KEY_FILE")
+	}
+	n, err := models.NewObjectStore(d).RewrapDataKeys(context.Background(), keys.CurrentID(), keys.Rewrap)
+	if err != nil {
+		log.Fatalf("rewrap-keys: rewrapped %d data keys, then failed: %v", n, err)
+	}
+	log.Printf("rewrap-keys: rewrapped %d data keys with master key %s", n, keys.CurrentID())
+}